@@ -0,0 +1,123 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus-community/json_exporter/exporter"
+)
+
+// An entry of the audit log, written as a line of json for each probe
+type auditEntry struct {
+	Time       time.Time `json:"time"`
+	Module     string    `json:"module"`
+	Target     string    `json:"target"`
+	Method     string    `json:"method"`
+	StatusCode int       `json:"status_code"`
+	Bytes      int       `json:"bytes"`
+	Shared     bool      `json:"shared,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Body       *string   `json:"body,omitempty"`
+}
+
+// The audit log of the fetches of the targets. The file is opened in append
+// mode, and opened again on SIGHUP, so that it can be rotated by an external
+// tool such as logrotate.
+type auditLog struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	bodies bool
+}
+
+func openAuditLog(path string, bodies bool) (*auditLog, error) {
+	a := &auditLog{path: path, bodies: bodies}
+	if err := a.reopen(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Opens the file again, e.g. after it was moved away, closing the previous
+// one once no entry is being written to it
+func (a *auditLog) reopen() error {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	previous := a.file
+	a.file = file
+	a.mu.Unlock()
+	if previous != nil {
+		return previous.Close()
+	}
+	return nil
+}
+
+// Opens the file again on each SIGHUP
+func (a *auditLog) reopenOnSIGHUP(logger *slog.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := a.reopen(); err != nil {
+				logger.Error("Failed to reopen audit log", "file", a.path, "err", err)
+				continue
+			}
+			logger.Info("Reopened audit log", "file", a.path)
+		}
+	}()
+}
+
+// Writes the entry of the fetch of the target. The body of the response is
+// only written if enabled.
+func (a *auditLog) record(logger *slog.Logger, module, target string, fetch exporter.FetchRecord, fetchErr error) {
+	entry := auditEntry{
+		Time:       time.Now().UTC(),
+		Module:     module,
+		Target:     target,
+		Method:     fetch.Method,
+		StatusCode: fetch.StatusCode,
+		Bytes:      fetch.Bytes,
+		Shared:     fetch.Shared,
+	}
+	if fetchErr != nil {
+		entry.Error = fetchErr.Error()
+	}
+	if a.bodies && fetch.Body != nil {
+		body := string(fetch.Body)
+		entry.Body = &body
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		logger.Error("Failed to marshal audit log entry", "err", err)
+		return
+	}
+
+	// Each entry is written at once, so that the entries of concurrent probes
+	// are never interleaved
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		logger.Error("Failed to write audit log", "file", a.path, "err", err)
+	}
+}
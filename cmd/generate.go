@@ -0,0 +1,214 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus-community/json_exporter/config"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	identifierRE  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	invalidNameRE = regexp.MustCompile(`[^a-z0-9_]+`)
+)
+
+// Writes a starter configuration, with a default module scraping the numbers
+// and booleans of the sample json document in the file
+func writeGeneratedConfig(w io.Writer, file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	c, err := generateConfig(data)
+	if err != nil {
+		return fmt.Errorf("%w, in sample: '%s'", err, file)
+	}
+	out, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "# Generated from %s, to be reviewed: names, labels and value types are only suggestions.\n", file)
+	_, err = w.Write(out)
+	return err
+}
+
+// Returns a configuration whose default module has a value metric for each
+// number or boolean of the document, and an object metric for each array of
+// objects, labeled by the strings of its elements
+func generateConfig(data []byte) (config.Config, error) {
+	var document interface{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return config.Config{}, err
+	}
+	metrics := generateMetrics(nil, "", document)
+	if len(metrics) == 0 {
+		return config.Config{}, errors.New("no number or boolean found")
+	}
+	return config.Config{
+		Modules: map[string]config.Module{
+			"default": {Metrics: metrics},
+		},
+	}, nil
+}
+
+func generateMetrics(names []string, path string, value interface{}) []config.Metric {
+	switch v := value.(type) {
+	case float64, bool:
+		if path == "" {
+			path = "$"
+		}
+		return []config.Metric{generatedMetric(names, "{"+path+"}", config.ValueScrape)}
+	case map[string]interface{}:
+		var metrics []config.Metric
+		for _, key := range sortedKeys(v) {
+			metrics = append(metrics, generateMetrics(append(names[:len(names):len(names)], key), path+pathKey(key), v[key])...)
+		}
+		return metrics
+	case []interface{}:
+		return generateArrayMetrics(names, path, v)
+	}
+	return nil
+}
+
+// Returns a multi value metric for an array of numbers or booleans, or an
+// object metric for an array of objects. Other arrays are skipped.
+func generateArrayMetrics(names []string, path string, elements []interface{}) []config.Metric {
+	if len(elements) == 0 {
+		return nil
+	}
+	elementsPath := "{" + path + "[*]}"
+	objects := make([]map[string]interface{}, 0, len(elements))
+	for _, element := range elements {
+		switch e := element.(type) {
+		case float64, bool:
+			if len(objects) != 0 {
+				return nil
+			}
+		case map[string]interface{}:
+			objects = append(objects, e)
+		default:
+			return nil
+		}
+	}
+	if len(objects) == 0 {
+		metric := generatedMetric(names, elementsPath, config.ValueScrape)
+		metric.Multi = true
+		return []config.Metric{metric}
+	}
+	if len(objects) != len(elements) {
+		return nil
+	}
+
+	// The keys missing from some elements would fail their extraction
+	labels, values := elementFields(nil, "", objects[0])
+	for _, object := range objects[1:] {
+		l, v := elementFields(nil, "", object)
+		labels, values = intersect(labels, l), intersect(values, v)
+	}
+	metric := generatedMetric(names, elementsPath, config.ObjectScrape)
+	metric.Labels, metric.Values = labels, values
+	for name := range metric.Values {
+		delete(metric.Labels, name)
+	}
+	if len(metric.Values) == 0 {
+		return nil
+	}
+	if len(metric.Labels) == 0 {
+		metric.Labels = nil
+	}
+	return []config.Metric{metric}
+}
+
+// Returns the paths of the strings of the element, by label name, and of its
+// numbers and booleans, by value name, including those of its nested objects
+func elementFields(names []string, path string, element map[string]interface{}) (map[string]string, map[string]string) {
+	labels, values := map[string]string{}, map[string]string{}
+	for key, value := range element {
+		keyNames, keyPath := append(names[:len(names):len(names)], key), path+pathKey(key)
+		switch v := value.(type) {
+		case string:
+			labels[labelName(strings.Join(keyNames, "_"))] = "{" + keyPath + "}"
+		case float64, bool:
+			values[labelName(strings.Join(keyNames, "_"))] = "{" + keyPath + "}"
+		case map[string]interface{}:
+			nestedLabels, nestedValues := elementFields(keyNames, keyPath, v)
+			for name, p := range nestedLabels {
+				labels[name] = p
+			}
+			for name, p := range nestedValues {
+				values[name] = p
+			}
+		}
+	}
+	return labels, values
+}
+
+// Returns the entries of a also in b
+func intersect(a, b map[string]string) map[string]string {
+	for name, path := range a {
+		if b[name] != path {
+			delete(a, name)
+		}
+	}
+	return a
+}
+
+func generatedMetric(names []string, path string, scrapeType config.ScrapeType) config.Metric {
+	name := labelName(strings.Join(names, "_"))
+	if name == "" {
+		name = "value"
+	}
+	return config.Metric{
+		Name:      name,
+		Path:      path,
+		Type:      scrapeType,
+		ValueType: config.ValueTypeGauge,
+		Help:      "Generated from " + path,
+	}
+}
+
+// Returns the json path step selecting the key of an object
+func pathKey(key string) string {
+	if identifierRE.MatchString(key) {
+		return "." + key
+	}
+	return "['" + key + "']"
+}
+
+// Returns the key made a valid metric or label name, in snake case
+func labelName(key string) string {
+	name := strings.Trim(invalidNameRE.ReplaceAllString(strings.ToLower(key), "_"), "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build http3
+
+package cmd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus-community/json_exporter/config"
+	pconfig "github.com/prometheus/common/config"
+	"github.com/prometheus/common/promslog"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestHTTP3(t *testing.T) {
+	// Only used for its certificate
+	tlsTarget := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsTarget.Close()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	server := &http3.Server{
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: tlsTarget.TLS.Certificates}),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprintf(w, `{"proto": %d}`, r.ProtoMajor)
+		}),
+	}
+	go server.Serve(conn)
+	defer server.Close()
+
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				HTTP3: true,
+				HTTPClientConfig: pconfig.HTTPClientConfig{
+					BasicAuth: &pconfig.BasicAuth{Username: "foo", Password: "bar"},
+					TLSConfig: pconfig.TLSConfig{InsecureSkipVerify: true},
+				},
+				Metrics: []config.Metric{
+					{Name: "proto", Path: "{.proto}", Type: config.ValueScrape, ValueType: config.ValueTypeGauge, Help: "proto"},
+				},
+			},
+		},
+	}
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target=https://"+conn.LocalAddr().String()+"/", nil)
+	recorder := httptest.NewRecorder()
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "proto 3\n") {
+		t.Fatalf("HTTP/3 test fails unexpectedly, got %d:\n%s", resp.StatusCode, body)
+	}
+}
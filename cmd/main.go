@@ -16,10 +16,15 @@ package cmd
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/prometheus-community/json_exporter/config"
@@ -34,13 +39,79 @@ import (
 )
 
 var (
-	configFile  = kingpin.Flag("config.file", "JSON exporter configuration file.").Default("config.yml").ExistingFile()
-	configCheck = kingpin.Flag("config.check", "If true validate the config file and then exit.").Default("false").Bool()
+	configFile     = kingpin.Flag("config.file", "JSON exporter configuration file, directory of configuration files, or glob pattern.").Default("config.yml").String()
+	configCheck    = kingpin.Flag("config.check", "If true validate the config file and then exit.").Default("false").Bool()
+	configGenerate = kingpin.Flag(
+		"config.generate-from",
+		"Sample JSON document to generate a starter config file from, printed to stdout, and then exit.",
+	).Default("").String()
+	defaultValueType = kingpin.Flag(
+		"metrics.default-value-type",
+		"Value type of the metrics which do not set a valuetype. One of: [untyped, gauge, counter]",
+	).Default(string(config.ValueTypeUntyped)).Enum(string(config.ValueTypeUntyped), string(config.ValueTypeGauge), string(config.ValueTypeCounter))
+	metricsPrefix = kingpin.Flag(
+		"metrics.prefix",
+		"Prefix of the names of the metrics of every module, before their namespace, subsystem and metric name prefix. The metrics of the exporter itself are not prefixed.",
+	).Default("").String()
+	probeDefaultTimeout = kingpin.Flag(
+		"probe.default-timeout",
+		"Maximum duration of a probe. Lowered by the module timeout or the Prometheus scrape timeout if smaller. 0 disables it.",
+	).Default("30s").Duration()
 	metricsPath = kingpin.Flag(
 		"web.telemetry-path",
 		"Path under which to expose metrics.",
 	).Default("/metrics").String()
+	disableLandingPage = kingpin.Flag(
+		"web.disable-landing-page",
+		"If true, do not serve the landing page at /.",
+	).Default("false").Bool()
+	enableOpenMetrics = kingpin.Flag(
+		"web.enable-openmetrics",
+		"If true, offer the OpenMetrics format to the probe requests accepting it.",
+	).Default("false").Bool()
+	textfileDirectory = kingpin.Flag(
+		"textfile.directory",
+		"Directory to write the metrics of the textfile targets to, for the textfile collector of the node exporter. Disabled if empty.",
+	).Default("").String()
+	textfileInterval = kingpin.Flag(
+		"textfile.interval",
+		"Interval between two probes of the textfile targets.",
+	).Default("1m").Duration()
+	textfileTargets = kingpin.Flag(
+		"textfile.target",
+		"Target probed on an interval, whose metrics are written to the textfile directory, as <module>=<url>. Can be repeated.",
+	).Strings()
+	textfileStaleAfter = kingpin.Flag(
+		"textfile.stale-after",
+		"Duration after which the file of a textfile target whose probes keep failing is removed, so that its series disappear. Kept if 0.",
+	).Default("0s").Duration()
+	cardinalityMetrics = kingpin.Flag(
+		"debug.cardinality-metrics",
+		"If true, expose with each probe the number of distinct values of each label of each metric, as json_distinct_label_values.",
+	).Default("false").Bool()
+	auditFile = kingpin.Flag(
+		"audit.file",
+		"File to append a line of json to for each fetch of a target, with its target, method, status code and size. Reopened on SIGHUP. Disabled if empty.",
+	).Default("").String()
+	auditBodies = kingpin.Flag(
+		"debug.audit-bodies",
+		"If true, also write the body of each response to the audit file.",
+	).Default("false").Bool()
 	toolkitFlags = kingpinflag.AddFlags(kingpin.CommandLine, ":7979")
+
+	// The audit log of the fetches, if enabled
+	auditor *auditLog
+	// The parsed json paths of the loaded config, parsed per probe if nil
+	jsonPaths *exporter.JSONPaths
+
+	probeTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "json_probe_timeouts_total",
+		Help: "Number of probes whose fetch of the target was canceled or timed out, by module.",
+	}, []string{"module"})
+	moduleConfigHash = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "json_module_config_hash",
+		Help: "Hash of the configuration of the module loaded, by module.",
+	}, []string{"module"})
 )
 
 func Run() {
@@ -53,11 +124,19 @@ func Run() {
 	kingpin.Parse()
 	logger := promslog.New(promslogConfig)
 
+	if *configGenerate != "" {
+		if err := writeGeneratedConfig(os.Stdout, *configGenerate); err != nil {
+			logger.Error("Error generating config", "err", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	logger.Info("Starting json_exporter", "version", version.Info())
 	logger.Info("Build context", "build", version.BuildContext())
 
 	logger.Info("Loading config file", "file", *configFile)
-	config, err := config.LoadConfig(*configFile)
+	config, err := config.LoadConfig(*configFile, config.ValueType(*defaultValueType))
 	if err != nil {
 		logger.Error("Error loading config", "err", err)
 		os.Exit(1)
@@ -67,16 +146,63 @@ func Run() {
 		logger.Error("Failed to marshal config to JSON", "err", err)
 	}
 	logger.Info("Loaded config file", "config", string(configJSON))
+	for name, module := range config.Modules {
+		hash, err := module.Hash()
+		if err != nil {
+			logger.Error("Failed to hash module config", "module", name, "err", err)
+			continue
+		}
+		moduleConfigHash.WithLabelValues(name).Set(hash)
+	}
+
+	errs := exporter.ValidateConfig(config, *metricsPrefix)
+	for _, err := range errs {
+		logger.Error("Invalid config", "err", err)
+	}
 
 	if *configCheck {
+		if len(errs) != 0 {
+			os.Exit(1)
+		}
 		os.Exit(0)
 	}
 
+	jsonPaths = &exporter.JSONPaths{}
+
+	if *auditFile != "" {
+		if auditor, err = openAuditLog(*auditFile, *auditBodies); err != nil {
+			logger.Error("Error opening audit file", "err", err)
+			os.Exit(1)
+		}
+		auditor.reopenOnSIGHUP(logger)
+	}
+
+	if *textfileDirectory != "" {
+		targets, err := parseTextfileTargets(*textfileTargets, config)
+		if err != nil {
+			logger.Error("Invalid textfile targets", "err", err)
+			os.Exit(1)
+		}
+		if *textfileInterval <= 0 {
+			logger.Error("Invalid textfile interval", "interval", *textfileInterval)
+			os.Exit(1)
+		}
+		go runTextfile(context.Background(), logger, config, targets, *textfileDirectory, *textfileInterval, *textfileStaleAfter)
+	}
+
+	prometheus.MustRegister(probeTimeouts, moduleConfigHash, exporter.FetchSharedTotal, exporter.CounterDecreasesTotal)
 	http.Handle(*metricsPath, promhttp.Handler())
+	http.HandleFunc("/-/healthy", healthyHandler)
+	// The config is only loaded once, before serving, so the exporter is ready
+	// as soon as it is healthy
+	http.HandleFunc("/-/ready", healthyHandler)
 	http.HandleFunc("/probe", func(w http.ResponseWriter, req *http.Request) {
 		probeHandler(w, req, logger, config)
 	})
-	if *metricsPath != "/" && *metricsPath != "" {
+	http.HandleFunc("/probe/", func(w http.ResponseWriter, req *http.Request) {
+		probePathHandler(w, req, logger, config)
+	})
+	if *metricsPath != "/" && *metricsPath != "" && !*disableLandingPage {
 		landingConfig := web.LandingConfig{
 			Name:        "JSON Exporter",
 			Description: "Prometheus Exporter for converting json to metrics",
@@ -103,31 +229,101 @@ func Run() {
 	}
 }
 
+func healthyHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "Healthy")
+}
+
+// Returns the smallest of the default probe timeout, the module timeout and
+// the scrape timeout sent by Prometheus, ignoring the unset ones
+func probeTimeout(r *http.Request, module config.Module) time.Duration {
+	timeout := *probeDefaultTimeout
+	lower := func(d time.Duration) {
+		if d > 0 && (timeout <= 0 || d < timeout) {
+			timeout = d
+		}
+	}
+	lower(time.Duration(module.Timeout))
+	if v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); v != "" {
+		if seconds, err := strconv.ParseFloat(v, 64); err == nil {
+			lower(time.Duration(seconds * float64(time.Second)))
+		}
+	}
+	return timeout
+}
+
+// Serves the probes given as /probe/<module>/<url-encoded-target>, for the
+// proxies which do not keep the query string intact. The other query
+// parameters are kept, for the body templates.
+func probePathHandler(w http.ResponseWriter, r *http.Request, logger *slog.Logger, config config.Config) {
+	module, target, ok := strings.Cut(strings.TrimPrefix(r.URL.EscapedPath(), "/probe/"), "/")
+	if !ok || module == "" || target == "" {
+		http.Error(w, "Expected a probe path of the form /probe/<module>/<url-encoded-target>", http.StatusBadRequest)
+		return
+	}
+	var err error
+	if module, err = url.PathUnescape(module); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid module in probe path: %s", err), http.StatusBadRequest)
+		return
+	}
+	if target, err = url.PathUnescape(target); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid target in probe path: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	query.Set("module", module)
+	query.Set("target", target)
+	r = r.Clone(r.Context())
+	r.URL.RawQuery = query.Encode()
+	probeHandler(w, r, logger, config)
+}
+
+// Prometheus turns the __param_<name> labels of a target into the <name> query
+// parameters of its scrape. Parameters still carrying the prefix, e.g. when
+// copied verbatim by a proxy or a hand-written url, are accepted as aliases of
+// the unprefixed ones, which take precedence.
+const paramPrefix = "__param_"
+
+func normalizeParams(query url.Values) url.Values {
+	for key, values := range query {
+		if name, ok := strings.CutPrefix(key, paramPrefix); ok && name != "" && !query.Has(name) {
+			query[name] = values
+		}
+	}
+	return query
+}
+
 func probeHandler(w http.ResponseWriter, r *http.Request, logger *slog.Logger, config config.Config) {
 
 	ctx, cancel := context.WithCancel(r.Context())
 	defer cancel()
-	r = r.WithContext(ctx)
+	r = r.Clone(ctx)
+	r.URL.RawQuery = normalizeParams(r.URL.Query()).Encode()
 
-	module := r.URL.Query().Get("module")
-	if module == "" {
-		module = "default"
+	// Several comma separated modules can be run against a single fetch of
+	// the target, the first one defines how the target is fetched
+	moduleParam := r.URL.Query().Get("module")
+	if moduleParam == "" {
+		moduleParam = "default"
 	}
-	if _, ok := config.Modules[module]; !ok {
-		http.Error(w, fmt.Sprintf("Unknown module %q", module), http.StatusBadRequest)
-		logger.Debug("Unknown module", "module", module)
-		return
+	modules := strings.Split(moduleParam, ",")
+	for _, module := range modules {
+		if _, ok := config.Modules[module]; !ok {
+			http.Error(w, fmt.Sprintf("Unknown module %q", module), http.StatusBadRequest)
+			logger.Debug("Unknown module", "module", module)
+			return
+		}
 	}
+	fetchModule := config.Modules[modules[0]]
 
-	registry := prometheus.NewPedanticRegistry()
-
-	metrics, err := exporter.CreateMetricsList(config.Modules[module])
-	if err != nil {
-		logger.Error("Failed to create metrics list from config", "err", err)
+	if timeout := probeTimeout(r, fetchModule); timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
 	}
 
-	jsonMetricCollector := exporter.JSONMetricCollector{JSONMetrics: metrics}
-	jsonMetricCollector.Logger = logger
+	registry := prometheus.NewPedanticRegistry()
 
 	target := r.URL.Query().Get("target")
 	if target == "" {
@@ -135,17 +331,202 @@ func probeHandler(w http.ResponseWriter, r *http.Request, logger *slog.Logger, c
 		return
 	}
 
-	fetcher := exporter.NewJSONFetcher(ctx, logger, config.Modules[module], r.URL.Query())
-	data, err := fetcher.FetchJSON(target)
+	// The auto modules reading their discriminator from a path of their own
+	// select their module before the target is fetched, which is then only
+	// fetched once a module is selected, with the selected module
+	if err := selectModules(ctx, logger, config, modules, r.URL.Query(), target, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fetchModule = config.Modules[modules[0]]
+
+	fetcher := exporter.NewJSONFetcher(ctx, logger, fetchModule, r.URL.Query())
+	fetcher.ForwardTraceContext(r.Header)
+	data, header, status, err := fetcher.FetchJSON(target)
+	if auditor != nil {
+		auditor.record(logger, moduleParam, target, fetcher.LastFetch(), err)
+	}
 	if err != nil {
+		// A fetch canceled by the probe timeout, or by Prometheus giving up
+		// on the scrape, is not an error of the target
+		timedOut := errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)
+		if timedOut {
+			probeTimeouts.WithLabelValues(modules[0]).Inc()
+		}
+		if failureHandler(w, r, logger, config, modules, target) {
+			logger.Error("Failed to fetch JSON response, serving the fallback values", "target", target, "err", err)
+			return
+		}
+		if timedOut {
+			http.Error(w, "Timed out fetching JSON response. TARGET: "+target+", ERROR: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
 		http.Error(w, "Failed to fetch JSON response. TARGET: "+target+", ERROR: "+err.Error(), http.StatusServiceUnavailable)
 		return
 	}
 
-	jsonMetricCollector.Data = data
+	// An empty response skipped by the module has no metrics to collect
+	if data == nil {
+		modules = nil
+	}
+
+	if err := selectModules(ctx, logger, config, modules, r.URL.Query(), target, data); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	var collectors []exporter.JSONMetricCollector
+	for _, module := range modules {
+		moduleConfig, err := exporter.RenderPaths(config.Modules[module], exporter.PathTemplateValues(target, r.URL.Query()))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to render the paths of module %q: %s", module, err), http.StatusBadRequest)
+			return
+		}
+		// The rendered paths change with the target and the query, caching them
+		// would grow the cache with every new probe
+		paths := jsonPaths
+		if moduleConfig.TemplatizePaths {
+			paths = nil
+		}
+		metrics, err := exporter.CreateMetricsList(moduleConfig, *metricsPrefix, paths)
+		if err != nil {
+			logger.Error("Failed to create metrics list from config", "module", module, "err", err)
+		}
+
+		jsonMetricCollector := exporter.JSONMetricCollector{JSONMetrics: metrics}
+		jsonMetricCollector.Logger = logger
+		jsonMetricCollector.Data = data
+		jsonMetricCollector.StatusCode = status
+		jsonMetricCollector.Cookies = (&http.Response{Header: header}).Cookies()
+		if name := config.Modules[module].TimestampFromHeader; name != "" {
+			if timestamp, err := http.ParseTime(header.Get(name)); err == nil {
+				jsonMetricCollector.Timestamp = timestamp
+			} else {
+				logger.Error("Failed to parse timestamp from response header", "header", name, "value", header.Get(name), "err", err)
+			}
+		}
+		jsonMetricCollector.MetaLabelValues = map[string]string{
+			exporter.ModuleLabel: module,
+			exporter.TargetLabel: target,
+		}
+
+		// The metrics of a batch module are collected from each document of
+		// the response
+		documents := []exporter.JSONMetricCollector{jsonMetricCollector}
+		var collector prometheus.Collector = jsonMetricCollector
+		if batch := moduleConfig.Batch; batch.Path != "" {
+			if documents, err = jsonMetricCollector.SplitBatch(batch); err != nil {
+				if failureHandler(w, r, logger, config, modules, target) {
+					logger.Error("Failed to split batch response, serving the fallback values", "module", module, "target", target, "err", err)
+					return
+				}
+				http.Error(w, fmt.Sprintf("Failed to split batch response of module %q. TARGET: %s, ERROR: %s", module, target, err), http.StatusServiceUnavailable)
+				return
+			}
+			collector = exporter.BatchCollector{JSONMetricCollector: jsonMetricCollector, Documents: documents}
+		}
 
-	registry.MustRegister(jsonMetricCollector)
-	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+		if err := registry.Register(collector); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to register the metrics of module %q, conflicting with another module: %s", module, err), http.StatusBadRequest)
+			return
+		}
+		for _, document := range documents {
+			if document.HasDynamicMetrics() {
+				registry.MustRegister(exporter.DynamicCollector{JSONMetricCollector: document})
+			}
+		}
+		collectors = append(collectors, documents...)
+	}
+
+	var gatherer prometheus.Gatherer = exporter.TimeseriesGatherer{Gatherer: registry, Collectors: collectors}
+	if *cardinalityMetrics {
+		gatherer = exporter.CardinalityGatherer{Gatherer: gatherer}
+	}
+	h := promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{EnableOpenMetrics: *enableOpenMetrics})
 	h.ServeHTTP(w, r)
 
 }
+
+// Replaces the auto modules by the modules selected by their discriminator.
+// Without data, before the target is fetched, only the auto modules reading
+// their discriminator from a path of their own are, the others are once the
+// data of the target is fetched.
+func selectModules(ctx context.Context, logger *slog.Logger, config config.Config, modules []string, query url.Values, target string, data []byte) error {
+	for i, module := range modules {
+		auto := config.Modules[module].AutoModule
+		if auto.Discriminator == "" || data == nil && auto.Path == "" {
+			continue
+		}
+		selected, err := selectModule(ctx, logger, module, config.Modules[module], query, target, data)
+		if err != nil {
+			return fmt.Errorf("Failed to select the module of auto module %q: %s", module, err)
+		}
+		logger.Debug("Selected module of auto module", "module", module, "selected", selected, "target", target)
+		modules[i] = selected
+	}
+	return nil
+}
+
+// Returns the module selected by the discriminator of the auto module, read
+// from the response of the request to the path of the auto module if set, or
+// else from the response of the target. That request is sent without the body
+// of the module.
+func selectModule(ctx context.Context, logger *slog.Logger, name string, module config.Module, query url.Values, target string, data []byte) (string, error) {
+	auto := module.AutoModule
+	if auto.Path != "" {
+		u, err := url.Parse(target)
+		if err != nil {
+			return "", err
+		}
+		if u, err = u.Parse(auto.Path); err != nil {
+			return "", err
+		}
+		module.Body = config.Body{}
+		fetcher := exporter.NewJSONFetcher(ctx, logger, module, query)
+		data, _, _, err = fetcher.FetchJSON(u.String())
+		if auditor != nil {
+			auditor.record(logger, name, u.String(), fetcher.LastFetch(), err)
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to fetch %s: %w", u, err)
+		}
+	}
+	return exporter.SelectModule(logger, auto, data)
+}
+
+// Serves the fallback values of the modules emitting some when the target
+// could not be fetched. Returns false, without serving anything, if none
+// does.
+func failureHandler(w http.ResponseWriter, r *http.Request, logger *slog.Logger, config config.Config, modules []string, target string) bool {
+	registry := prometheus.NewPedanticRegistry()
+	found := false
+	for _, module := range modules {
+		if len(config.Modules[module].EmitOnFailure) == 0 {
+			continue
+		}
+		metrics, err := exporter.CreateMetricsList(config.Modules[module], *metricsPrefix, jsonPaths)
+		if err != nil {
+			logger.Error("Failed to create metrics list from config", "module", module, "err", err)
+		}
+		failureCollector := exporter.FailureCollector{
+			JSONMetrics: metrics,
+			Values:      config.Modules[module].EmitOnFailure,
+			MetaLabelValues: map[string]string{
+				exporter.ModuleLabel: module,
+				exporter.TargetLabel: target,
+			},
+		}
+		if err := registry.Register(failureCollector); err != nil {
+			logger.Error("Failed to register the fallback values of module", "module", module, "err", err)
+			continue
+		}
+		found = true
+	}
+	if !found {
+		return false
+	}
+
+	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: *enableOpenMetrics})
+	h.ServeHTTP(w, r)
+	return true
+}
@@ -14,17 +14,46 @@
 package cmd
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/prometheus-community/json_exporter/config"
+	"github.com/prometheus-community/json_exporter/exporter"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	pconfig "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/promslog"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"gopkg.in/yaml.v2"
 )
 
 func TestFailIfSelfSignedCA(t *testing.T) {
@@ -144,7 +173,7 @@ func TestCorrectResponse(t *testing.T) {
 	defer target.Close()
 
 	for i, test := range tests {
-		c, err := config.LoadConfig(test.ConfigFile)
+		c, err := config.LoadConfig(test.ConfigFile, config.ValueTypeUntyped)
 		if err != nil {
 			t.Fatalf("Failed to load config file %s", test.ConfigFile)
 		}
@@ -297,6 +326,24 @@ func TestBodyPostTemplate(t *testing.T) {
 			Result:        "value should be all",
 			ShouldSucceed: true,
 		},
+		{
+			Body:          config.Body{Content: "environment is not leaked: {{ env `HOME` }}", Templatize: true, SafeFunctions: true},
+			ShouldSucceed: true,
+		},
+		{
+			Body:          config.Body{Content: "safe functions work: {{ upper `hello` }}", Templatize: true, SafeFunctions: true},
+			Result:        "safe functions work: HELLO",
+			ShouldSucceed: true,
+		},
+		{
+			Body:          config.Body{Content: "only allowed functions: {{ upper `hello` }} {{ lower `WORLD` }}", Templatize: true, AllowedFunctions: []string{"upper"}},
+			ShouldSucceed: true,
+		},
+		{
+			Body:          config.Body{Content: "only allowed functions: {{ upper `hello` }} {{ lower `WORLD` }}", Templatize: true, AllowedFunctions: []string{"upper", "lower"}},
+			Result:        "only allowed functions: HELLO world",
+			ShouldSucceed: true,
+		},
 	}
 
 	for _, test := range bodyTests {
@@ -431,3 +478,3541 @@ func TestBodyPostQuery(t *testing.T) {
 		target.Close()
 	}
 }
+
+func TestBodyJSON(t *testing.T) {
+	var body config.Body
+	err := yaml.Unmarshal([]byte(`
+json:
+  query: 'name = "{{ .name | first }}"'
+  limit: 10
+  exact: true
+  filters:
+  - {field: region, value: '{{ .region | first | upper }}'}
+  - null
+  1: one
+templatize: true
+`), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"query":   `name = "db "main""`,
+		"limit":   float64(10),
+		"exact":   true,
+		"filters": []interface{}{map[string]interface{}{"field": "region", "value": "EU"}, nil},
+		"1":       "one",
+	}
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Body json test fails unexpectedly, got method %s and content type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		var got interface{}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("Body json test fails unexpectedly, invalid json body: %s", err)
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("Body json test fails unexpectedly.\nGOT:\n%v\nEXPECTED:\n%v", got, expected)
+		}
+		fmt.Fprint(w, `{}`)
+	}))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+url.QueryEscape(target.URL)+"&name="+url.QueryEscape(`db "main"`)+"&region=eu", nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {Body: body},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	if resp := recorder.Result(); resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		t.Fatalf("Body json test fails unexpectedly, got status %d: %s", resp.StatusCode, respBody)
+	}
+
+	c.Modules["default"] = config.Module{Body: config.Body{Content: "{}", JSON: map[string]interface{}{}}}
+	if errs := exporter.ValidateConfig(c, ""); len(errs) != 1 {
+		t.Fatalf("Body json test fails unexpectedly, expected content and json to be rejected, got %v", errs)
+	}
+}
+
+func TestInjectMetaLabels(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"counter": 5, "name": "custom"}`))
+	}))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL, nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				InjectMetaLabels: true,
+				Metrics: []config.Metric{
+					{Name: "injected", Path: "{.counter}", Type: config.ValueScrape, Help: "injected"},
+					{Name: "overridden", Path: "{.counter}", Type: config.ValueScrape, Help: "overridden", Labels: map[string]string{"target": "{.name}"}},
+				},
+			},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	expected := []string{
+		`injected{module="default",target="` + target.URL + `"} 5`,
+		`overridden{module="default",target="custom"} 5`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e) {
+			t.Fatalf("Meta labels injection test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+}
+
+func TestRejectDuplicateKeys(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"counter": 1, "counter": 2}`))
+	}))
+	defer target.Close()
+
+	for _, reject := range []bool{false, true} {
+		req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL, nil)
+		recorder := httptest.NewRecorder()
+		c := config.Config{
+			Modules: map[string]config.Module{"default": {RejectDuplicateKeys: reject}},
+		}
+
+		probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+		resp := recorder.Result()
+		body, _ := io.ReadAll(resp.Body)
+
+		expected := http.StatusOK
+		if reject {
+			expected = http.StatusServiceUnavailable
+		}
+		if resp.StatusCode != expected {
+			t.Fatalf("Reject duplicate keys (%t) test fails unexpectedly, expected %d, got %d: %s", reject, expected, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestMultiValueScrape(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/multi.json", nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				Metrics: []config.Metric{
+					{Name: "connections", Path: "{.servers[*].connections}", Type: config.ValueScrape, Help: "connections", Multi: true, IndexLabel: "server"},
+				},
+			},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	expected := []string{
+		`connections{server="0"} 3`,
+		`connections{server="1"} 5`,
+		`connections{server="2"} 7`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e) {
+			t.Fatalf("Multi value scrape test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+}
+
+func TestTLSVersionPinnedTarget(t *testing.T) {
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	}))
+	target.TLS = &tls.Config{MinVersion: tls.VersionTLS12, MaxVersion: tls.VersionTLS12}
+	target.StartTLS()
+	defer target.Close()
+
+	tests := []struct {
+		MinVersion    uint16
+		MaxVersion    uint16
+		Renegotiation config.TLSRenegotiation
+		ShouldSucceed bool
+	}{
+		{tls.VersionTLS12, 0, "", true},
+		{tls.VersionTLS12, tls.VersionTLS12, config.TLSRenegotiateOnce, true},
+		{tls.VersionTLS10, tls.VersionTLS12, config.TLSRenegotiateFreely, true},
+		{tls.VersionTLS13, 0, "", false},
+		{0, tls.VersionTLS11, "", false},
+		{tls.VersionTLS12, 0, "sometimes", false},
+	}
+
+	for i, test := range tests {
+		c := config.Config{
+			Modules: map[string]config.Module{
+				"default": {
+					HTTPClientConfig: pconfig.HTTPClientConfig{
+						TLSConfig: pconfig.TLSConfig{
+							InsecureSkipVerify: true,
+							MinVersion:         pconfig.TLSVersion(test.MinVersion),
+							MaxVersion:         pconfig.TLSVersion(test.MaxVersion),
+						},
+					},
+					TLSRenegotiation: test.Renegotiation,
+				},
+			},
+		}
+
+		req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL, nil)
+		recorder := httptest.NewRecorder()
+		probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+		resp := recorder.Result()
+		body, _ := io.ReadAll(resp.Body)
+
+		if test.ShouldSucceed && resp.StatusCode != http.StatusOK {
+			t.Fatalf("TLS version test %d fails unexpectedly, got %s", i, body)
+		}
+		if !test.ShouldSucceed && resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("TLS version test %d succeeds unexpectedly, got %d", i, resp.StatusCode)
+		}
+	}
+}
+
+func TestTimestampFromHeader(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+		w.Write([]byte(`{"counter": 5, "timestamp": 1000}`))
+	}))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL, nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				TimestampFromHeader: "Last-Modified",
+				Metrics: []config.Metric{
+					{Name: "from_header", Path: "{.counter}", Type: config.ValueScrape, Help: "from_header"},
+					{Name: "from_body", Path: "{.counter}", Type: config.ValueScrape, Help: "from_body", EpochTimestamp: "{.timestamp}"},
+				},
+			},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	expected := []string{
+		"from_header 5 1445412480000",
+		"from_body 5 1000",
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e) {
+			t.Fatalf("Timestamp from header test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	healthyHandler(recorder, httptest.NewRequest("GET", "http://example.com/-/healthy", nil))
+	if resp := recorder.Result(); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Healthy endpoint test fails unexpectedly, expected 200, got %d", resp.StatusCode)
+	}
+}
+
+func TestTailBytes(t *testing.T) {
+	content := "2025-01-01 some log line\n2025-01-02 another log line\n" + `{"counter": 7}`
+	tail := int64(len(`{"counter": 7}`))
+
+	tests := []struct {
+		Handler       http.HandlerFunc
+		TailBytes     int64
+		ShouldSucceed bool
+	}{
+		{
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				if got := r.Header.Get("Range"); got != "bytes=-14" {
+					t.Errorf("Range header mismatch, got: %s, expected: bytes=-14", got)
+				}
+				http.ServeContent(w, r, "stats.log", time.Time{}, strings.NewReader(content))
+			},
+			TailBytes:     tail,
+			ShouldSucceed: true,
+		},
+		{
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(content))
+			},
+			TailBytes:     tail,
+			ShouldSucceed: true,
+		},
+		{
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				http.ServeContent(w, r, "stats.log", time.Time{}, strings.NewReader(content))
+			},
+			TailBytes:     tail + 5,
+			ShouldSucceed: false,
+		},
+	}
+
+	for i, test := range tests {
+		target := httptest.NewServer(test.Handler)
+
+		req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL, nil)
+		recorder := httptest.NewRecorder()
+		c := config.Config{
+			Modules: map[string]config.Module{
+				"default": {
+					TailBytes: test.TailBytes,
+					Metrics: []config.Metric{
+						{Name: "counter", Path: "{.counter}", Type: config.ValueScrape, Help: "counter"},
+					},
+				},
+			},
+		}
+
+		probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+		resp := recorder.Result()
+		body, _ := io.ReadAll(resp.Body)
+
+		if test.ShouldSucceed && !strings.Contains(string(body), "counter 7") {
+			t.Fatalf("Tail bytes test %d fails unexpectedly, got %s", i, body)
+		}
+		if !test.ShouldSucceed && resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("Tail bytes test %d succeeds unexpectedly, got %d", i, resp.StatusCode)
+		}
+		target.Close()
+	}
+}
+
+func TestObjectScrapeIndexLabel(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/multi.json", nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				Metrics: []config.Metric{
+					{Name: "server", Path: "{.servers[*]}", Type: config.ObjectScrape, Help: "server", IndexLabel: "position", Values: map[string]string{"connections": "{.connections}"}},
+				},
+			},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	expected := []string{
+		`server_connections{position="0"} 3`,
+		`server_connections{position="1"} 5`,
+		`server_connections{position="2"} 7`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e) {
+			t.Fatalf("Object scrape index label test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+}
+
+// Generates a CA and a client certificate signed by it. The client cert and
+// key are written to dir, and the CA pool is returned.
+func generateClientCert(t *testing.T, dir, name string) (*x509.CertPool, string, string) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name + "-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	return pool, certFile, keyFile
+}
+
+func TestTLSCertRules(t *testing.T) {
+	dir := t.TempDir()
+	var targets []*httptest.Server
+	var rules []config.TLSCertRule
+	for _, name := range []string{"first", "second"} {
+		pool, certFile, keyFile := generateClientCert(t, dir, name)
+		target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		}))
+		target.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+		target.StartTLS()
+		defer target.Close()
+
+		u, _ := url.Parse(target.URL)
+		targets = append(targets, target)
+		rules = append(rules, config.TLSCertRule{Host: u.Host, CertFile: certFile, KeyFile: keyFile})
+	}
+
+	tests := []struct {
+		Rules         []config.TLSCertRule
+		ShouldSucceed bool
+	}{
+		{rules, true},
+		{[]config.TLSCertRule{{Host: "*", CertFile: rules[0].CertFile, KeyFile: rules[0].KeyFile}}, false},
+		{nil, false},
+	}
+
+	for i, test := range tests {
+		c := config.Config{
+			Modules: map[string]config.Module{
+				"default": {
+					HTTPClientConfig: pconfig.HTTPClientConfig{
+						TLSConfig: pconfig.TLSConfig{
+							InsecureSkipVerify: true,
+						},
+					},
+					TLSCertRules: test.Rules,
+				},
+			},
+		}
+
+		// Every target must be reachable for the test case to succeed
+		succeeded := true
+		for _, target := range targets {
+			req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL, nil)
+			recorder := httptest.NewRecorder()
+			probeHandler(recorder, req, promslog.NewNopLogger(), c)
+			if recorder.Result().StatusCode != http.StatusOK {
+				succeeded = false
+			}
+		}
+
+		if succeeded != test.ShouldSucceed {
+			t.Fatalf("TLS cert rules test %d fails unexpectedly, expected success: %t", i, test.ShouldSucceed)
+		}
+	}
+}
+
+func TestTimeseriesScrape(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/timeseries.json", nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				Metrics: []config.Metric{
+					{
+						Name:           "cpu_load",
+						Path:           "{.points[*]}",
+						Type:           config.TimeseriesScrape,
+						Help:           "CPU load history",
+						ValueType:      config.ValueTypeGauge,
+						EpochTimestamp: "{.timestamp}",
+						Labels:         map[string]string{"host": "db-1"},
+						Values:         map[string]string{"value": "{.value}"},
+					},
+					{Name: "points", Path: "{.points[0].value}", Type: config.ValueScrape, Help: "First point"},
+				},
+			},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	expected := `# HELP cpu_load_value CPU load history
+# TYPE cpu_load_value gauge
+cpu_load_value{host="db-1"} 1.5 1700000000000
+cpu_load_value{host="db-1"} 2.5 1700000060000
+cpu_load_value{host="db-1"} 3.5 1700000120000
+# HELP points First point
+# TYPE points untyped
+points 1.5
+`
+	if string(body) != expected {
+		t.Fatalf("Timeseries scrape test fails unexpectedly.\nGOT:\n%s\nEXPECTED:\n%s", body, expected)
+	}
+}
+
+func TestNDJSONStream(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name": "a", "events": 3}` + "\n\n"))
+		w.Write([]byte(`{"name": "b", "events": 5}` + "\n"))
+		w.(http.Flusher).Flush()
+		// Keep the stream open, as a long-poll endpoint would
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL, nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				InputFormat:  config.InputFormatNDJSONStream,
+				ReadDuration: model.Duration(200 * time.Millisecond),
+				Metrics: []config.Metric{
+					{Name: "stream", Path: "{[*]}", Type: config.ObjectScrape, Help: "stream", Labels: map[string]string{"name": "{.name}"}, Values: map[string]string{"events": "{.events}"}},
+				},
+			},
+		},
+	}
+
+	start := time.Now()
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("NDJSON stream test did not stop reading after the read duration, took %s", elapsed)
+	}
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	expected := []string{
+		`stream_events{name="a"} 3`,
+		`stream_events{name="b"} 5`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e) {
+			t.Fatalf("NDJSON stream test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+}
+
+func TestConditionalHeaders(t *testing.T) {
+	handler := func(expected string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if got := r.Header.Get("X-Client-Cert"); got != expected {
+				t.Errorf("Unexpected value of conditional header: expected %q, got %q", expected, got)
+			}
+			if got := r.Header.Get("X-Dummy"); got != "test" {
+				t.Errorf("Unexpected value of static header: expected %q, got %q", "test", got)
+			}
+		}
+	}
+	httpsTarget := httptest.NewTLSServer(handler("present"))
+	defer httpsTarget.Close()
+	httpTarget := httptest.NewServer(handler(""))
+	defer httpTarget.Close()
+
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				HTTPClientConfig: pconfig.HTTPClientConfig{
+					TLSConfig: pconfig.TLSConfig{
+						InsecureSkipVerify: true,
+					},
+				},
+				Headers: map[string]string{"X-Dummy": "test"},
+				ConditionalHeaders: []config.ConditionalHeaders{
+					{Match: config.TargetMatch{Scheme: "https"}, Headers: map[string]string{"X-Client-Cert": "present"}},
+					{Match: config.TargetMatch{Host: "unknown.example.com"}, Headers: map[string]string{"X-Client-Cert": "wrong host"}},
+				},
+			},
+		},
+	}
+
+	for _, target := range []*httptest.Server{httpsTarget, httpTarget} {
+		req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL, nil)
+		recorder := httptest.NewRecorder()
+		probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+		resp := recorder.Result()
+		body, _ := io.ReadAll(resp.Body)
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Conditional headers test fails unexpectedly. Got: %s", body)
+		}
+	}
+}
+
+func TestObjectScrapeKeyLabel(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/keyed.json", nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				Metrics: []config.Metric{
+					{
+						Name:     "service",
+						Path:     "{.services}",
+						Type:     config.ObjectScrape,
+						Help:     "service",
+						KeyLabel: "id",
+						Labels:   map[string]string{"status": "{.status}"},
+						Values:   map[string]string{"latency": "{.latency}"},
+					},
+				},
+			},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	expected := `# HELP service_latency service
+# TYPE service_latency untyped
+service_latency{id="123",status="ok"} 5
+service_latency{id="456",status="degraded"} 12
+`
+	if string(body) != expected {
+		t.Fatalf("Object scrape key label test fails unexpectedly.\nGOT:\n%s\nEXPECTED:\n%s", body, expected)
+	}
+}
+
+func TestProbeTimeout(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer target.Close()
+
+	defaultTimeout := *probeDefaultTimeout
+	defer func() { *probeDefaultTimeout = defaultTimeout }()
+
+	tests := []struct {
+		DefaultTimeout time.Duration
+		ModuleTimeout  time.Duration
+		ScrapeTimeout  string
+	}{
+		{100 * time.Millisecond, 0, ""},
+		{time.Minute, 100 * time.Millisecond, ""},
+		{time.Minute, time.Minute, "0.1"},
+		{0, 0, "0.1"},
+	}
+
+	timeouts := testutil.ToFloat64(probeTimeouts.WithLabelValues("default"))
+	for i, test := range tests {
+		*probeDefaultTimeout = test.DefaultTimeout
+		c := config.Config{
+			Modules: map[string]config.Module{"default": {Timeout: model.Duration(test.ModuleTimeout)}},
+		}
+
+		req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL, nil)
+		if test.ScrapeTimeout != "" {
+			req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", test.ScrapeTimeout)
+		}
+		recorder := httptest.NewRecorder()
+
+		start := time.Now()
+		probeHandler(recorder, req, promslog.NewNopLogger(), c)
+		elapsed := time.Since(start)
+
+		resp := recorder.Result()
+		if resp.StatusCode != http.StatusServiceUnavailable || elapsed > 2*time.Second {
+			t.Fatalf("Probe timeout test %d fails unexpectedly, expected 503 within 2s, got %d after %s", i, resp.StatusCode, elapsed)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if !strings.HasPrefix(string(body), "Timed out fetching JSON response.") {
+			t.Fatalf("Probe timeout test %d fails unexpectedly, expected a timeout message, got %q", i, body)
+		}
+		if got := testutil.ToFloat64(probeTimeouts.WithLabelValues("default")) - timeouts; got != float64(i+1) {
+			t.Fatalf("Probe timeout test %d fails unexpectedly, expected %d timeouts counted, got %v", i, i+1, got)
+		}
+	}
+}
+
+func TestMultiValueScrapeSiblingLabels(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/disks.json", nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				Metrics: []config.Metric{
+					{
+						Name:          "disk_used",
+						Path:          "{.disks[*].used}",
+						Type:          config.ValueScrape,
+						Help:          "disk_used",
+						Multi:         true,
+						IndexLabel:    "index",
+						Labels:        map[string]string{"host": "{.host}"},
+						SiblingLabels: map[string]string{"mount": "{.mount}"},
+					},
+				},
+			},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	expected := `# HELP disk_used disk_used
+# TYPE disk_used untyped
+disk_used{host="h1",index="0",mount="/"} 50
+disk_used{host="h1",index="1",mount="/var"} 20
+`
+	if string(body) != expected {
+		t.Fatalf("Multi value scrape sibling labels test fails unexpectedly.\nGOT:\n%s\nEXPECTED:\n%s", body, expected)
+	}
+}
+
+func TestMultipleModules(t *testing.T) {
+	fetches := 0
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write([]byte(`{"requests": 5, "errors": 2}`))
+	}))
+	defer target.Close()
+
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"requests": {
+				Metrics: []config.Metric{{Name: "requests", Path: "{.requests}", Type: config.ValueScrape, Help: "requests"}},
+			},
+			"errors": {
+				Metrics: []config.Metric{{Name: "errors", Path: "{.errors}", Type: config.ValueScrape, Help: "errors"}},
+			},
+			"conflict": {
+				Metrics: []config.Metric{{Name: "requests", Path: "{.errors}", Type: config.ValueScrape, Help: "conflicting requests"}},
+			},
+		},
+	}
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=requests,errors&target="+target.URL, nil)
+	recorder := httptest.NewRecorder()
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	for _, e := range []string{"requests 5", "errors 2"} {
+		if !strings.Contains(string(body), e) {
+			t.Fatalf("Multiple modules test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+	if fetches != 1 {
+		t.Fatalf("Multiple modules test fails unexpectedly, expected the target to be fetched once, got %d", fetches)
+	}
+
+	for _, modules := range []string{"requests,conflict", "requests,unknown"} {
+		req = httptest.NewRequest("GET", "http://example.com/foo"+"?module="+modules+"&target="+target.URL, nil)
+		recorder = httptest.NewRecorder()
+		probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+		if resp := recorder.Result(); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Multiple modules test fails unexpectedly for %q, expected 400, got %d", modules, resp.StatusCode)
+		}
+	}
+}
+
+func TestZipScrape(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	tests := []struct {
+		Path     string
+		Expected []string
+	}{
+		{"{.values[*]}", []string{
+			`columns{name="a",region="eu"} 1`,
+			`columns{name="b",region="eu"} 2`,
+			`columns{name="c",region="eu"} 3`,
+		}},
+		// Arrays of different lengths cannot be zipped
+		{"{.short[*]}", nil},
+	}
+
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/columns.json", nil)
+		recorder := httptest.NewRecorder()
+		c := config.Config{
+			Modules: map[string]config.Module{
+				"default": {
+					Metrics: []config.Metric{
+						{Name: "columns", Path: test.Path, Type: config.ZipScrape, Help: "columns", Labels: map[string]string{"name": "{.names[*]}", "region": "{.region}"}},
+					},
+				},
+			},
+		}
+
+		probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+		resp := recorder.Result()
+		body, _ := io.ReadAll(resp.Body)
+
+		for _, e := range test.Expected {
+			if !strings.Contains(string(body), e) {
+				t.Fatalf("Zip scrape test %d fails unexpectedly, expected %q in:\n%s", i, e, body)
+			}
+		}
+		if test.Expected == nil && strings.Contains(string(body), "columns{") {
+			t.Fatalf("Zip scrape test %d fails unexpectedly, expected no series in:\n%s", i, body)
+		}
+	}
+}
+
+func TestProxyConnectAuth(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"counter": 1234}`))
+	}))
+	defer target.Close()
+
+	// Tunnels the CONNECT requests carrying the expected credentials
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			t.Errorf("Unexpected proxy request method: %s", r.Method)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		expected := "Basic " + base64.StdEncoding.EncodeToString([]byte("proxyuser:proxypass"))
+		if r.Header.Get("Proxy-Authorization") != expected {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		go func() {
+			io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+	}))
+	defer proxy.Close()
+
+	proxyURL := func(userinfo *url.Userinfo) pconfig.URL {
+		u, _ := url.Parse(proxy.URL)
+		u.User = userinfo
+		return pconfig.URL{URL: u}
+	}
+
+	tests := []struct {
+		ProxyConfig   pconfig.ProxyConfig
+		ShouldSucceed bool
+	}{
+		{pconfig.ProxyConfig{ProxyURL: proxyURL(url.UserPassword("proxyuser", "proxypass"))}, true},
+		{pconfig.ProxyConfig{ProxyURL: proxyURL(nil), ProxyConnectHeader: pconfig.ProxyHeader{
+			"Proxy-Authorization": {pconfig.Secret("Basic " + base64.StdEncoding.EncodeToString([]byte("proxyuser:proxypass")))},
+		}}, true},
+		{pconfig.ProxyConfig{ProxyURL: proxyURL(url.UserPassword("proxyuser", "wrong"))}, false},
+		{pconfig.ProxyConfig{ProxyURL: proxyURL(nil)}, false},
+	}
+
+	for i, test := range tests {
+		c := config.Config{
+			Modules: map[string]config.Module{
+				"default": {
+					HTTPClientConfig: pconfig.HTTPClientConfig{
+						TLSConfig: pconfig.TLSConfig{
+							InsecureSkipVerify: true,
+						},
+						ProxyConfig: test.ProxyConfig,
+					},
+					Metrics: []config.Metric{
+						{Name: "counter", Path: "{.counter}", Type: config.ValueScrape, Help: "counter"},
+					},
+				},
+			},
+		}
+
+		req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL, nil)
+		recorder := httptest.NewRecorder()
+		probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+		resp := recorder.Result()
+		body, _ := io.ReadAll(resp.Body)
+
+		if test.ShouldSucceed && !strings.Contains(string(body), "counter 1234") {
+			t.Fatalf("Proxy test %d fails unexpectedly. Got: %s", i, body)
+		}
+		if !test.ShouldSucceed && resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("Proxy test %d fails unexpectedly, expected status %d, got %d: %s", i, http.StatusServiceUnavailable, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestStaticLabels(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/good.json", nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				InjectMetaLabels: true,
+				Metrics: []config.Metric{
+					{
+						Name:         "counter",
+						Path:         "{.counter}",
+						Type:         config.ValueScrape,
+						Help:         "counter",
+						Labels:       map[string]string{"location": "{.location}"},
+						StaticLabels: map[string]string{"query": "{.location}", "module": "static"},
+					},
+				},
+			},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	expected := `counter{location="mars",module="static",query="{.location}",target="` + target.URL + `/serve/good.json"} 1234`
+	if !strings.Contains(string(body), expected) {
+		t.Fatalf("Static labels test fails unexpectedly, expected %q in:\n%s", expected, body)
+	}
+}
+
+func TestMaxRedirects(t *testing.T) {
+	// Redirects /<n> to /<n-1>, and serves a json document at /0
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		if n > 0 {
+			http.Redirect(w, r, "/"+strconv.Itoa(n-1), http.StatusFound)
+			return
+		}
+		w.Write([]byte(`{"counter": 1234}`))
+	}))
+	defer target.Close()
+
+	tests := []struct {
+		Path          string
+		ShouldSucceed bool
+	}{
+		{"/2", true},
+		{"/3", false},
+	}
+
+	for i, test := range tests {
+		c := config.Config{
+			Modules: map[string]config.Module{
+				"default": {
+					HTTPClientConfig: pconfig.DefaultHTTPClientConfig,
+					MaxRedirects:     2,
+					Metrics: []config.Metric{
+						{Name: "counter", Path: "{.counter}", Type: config.ValueScrape, Help: "counter"},
+					},
+				},
+			},
+		}
+
+		req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+test.Path, nil)
+		recorder := httptest.NewRecorder()
+		probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+		resp := recorder.Result()
+		body, _ := io.ReadAll(resp.Body)
+
+		if test.ShouldSucceed && !strings.Contains(string(body), "counter 1234") {
+			t.Fatalf("Max redirects test %d fails unexpectedly. Got: %s", i, body)
+		}
+		if !test.ShouldSucceed {
+			chain := target.URL + "/3 -> " + target.URL + "/2 -> " + target.URL + "/1 -> " + target.URL + "/0"
+			if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(string(body), chain) {
+				t.Fatalf("Max redirects test %d fails unexpectedly, expected redirect chain %q in: %s", i, chain, body)
+			}
+		}
+	}
+}
+
+func TestSSEStream(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Accept"); got != "text/event-stream" {
+			t.Errorf("Unexpected Accept header: %q", got)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(": keep-alive\n\n"))
+		w.Write([]byte("event: status\nid: 1\ndata: {\"name\": \"a\", \"events\": 3}\n\n"))
+		// Data split over several lines
+		w.Write([]byte("data: {\"name\": \"b\",\r\ndata: \"events\": 5}\r\n\r\n"))
+		w.Write([]byte("data: not json\n\n"))
+		// Cut off by the read duration, never dispatched
+		w.Write([]byte("data: {\"name\": \"c\", \"events\": 7}\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL, nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				InputFormat:  config.InputFormatSSE,
+				ReadDuration: model.Duration(200 * time.Millisecond),
+				Metrics: []config.Metric{
+					{Name: "stream", Path: "{[*]}", Type: config.ObjectScrape, Help: "stream", Labels: map[string]string{"name": "{.name}"}, Values: map[string]string{"events": "{.events}"}},
+				},
+			},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	expected := []string{
+		`stream_events{name="a"} 3`,
+		`stream_events{name="b"} 5`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e) {
+			t.Fatalf("SSE stream test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+	if strings.Contains(string(body), `name="c"`) {
+		t.Fatalf("SSE stream test fails unexpectedly, incomplete event collected in:\n%s", body)
+	}
+}
+
+func TestModulesCredentialsNotShared(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		w.Write([]byte(`{"token": "` + token + `"}`))
+	}))
+	defer target.Close()
+
+	module := func(token string) config.Module {
+		return config.Module{
+			HTTPClientConfig: pconfig.HTTPClientConfig{
+				BearerToken: pconfig.Secret(token),
+			},
+			Metrics: []config.Metric{
+				{Name: "token", Path: "{.token}", Type: config.ValueScrape, Help: "token"},
+			},
+		}
+	}
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"first":  module("1"),
+			"second": module("2"),
+		},
+	}
+
+	// Modules probing the same target must each use their own credentials
+	for i := 0; i < 2; i++ {
+		for name, expected := range map[string]string{"first": "token 1", "second": "token 2"} {
+			req := httptest.NewRequest("GET", "http://example.com/foo"+"?module="+name+"&target="+target.URL, nil)
+			recorder := httptest.NewRecorder()
+			probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+			resp := recorder.Result()
+			body, _ := io.ReadAll(resp.Body)
+
+			if !strings.Contains(string(body), expected) {
+				t.Fatalf("Credentials test fails unexpectedly for module %s, expected %q in:\n%s", name, expected, body)
+			}
+		}
+	}
+}
+
+func TestOpenMetricsNegotiation(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	enabled := *enableOpenMetrics
+	defer func() { *enableOpenMetrics = enabled }()
+
+	c, err := config.LoadConfig("../test/config/good.yml", config.ValueTypeUntyped)
+	if err != nil {
+		t.Fatalf("Failed to load config file %s", err)
+	}
+
+	tests := []struct {
+		EnableOpenMetrics   bool
+		ExpectedContentType string
+	}{
+		{false, "text/plain"},
+		{true, "application/openmetrics-text"},
+	}
+
+	for i, test := range tests {
+		*enableOpenMetrics = test.EnableOpenMetrics
+
+		req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/good.json", nil)
+		req.Header.Set("Accept", "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5")
+		recorder := httptest.NewRecorder()
+		probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+		resp := recorder.Result()
+		body, _ := io.ReadAll(resp.Body)
+
+		if got := resp.Header.Get("Content-Type"); !strings.HasPrefix(got, test.ExpectedContentType) {
+			t.Fatalf("OpenMetrics test %d fails unexpectedly, expected content type %q, got %q", i, test.ExpectedContentType, got)
+		}
+		if test.EnableOpenMetrics && !strings.HasSuffix(string(body), "# EOF\n") {
+			t.Fatalf("OpenMetrics test %d fails unexpectedly, missing EOF marker in:\n%s", i, body)
+		}
+	}
+}
+
+func TestEmptyBody(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "0")
+	}))
+	defer target.Close()
+
+	tests := []struct {
+		Policy         config.EmptyBodyPolicy
+		ExpectedStatus int
+		Expected       string
+	}{
+		{"", http.StatusOK, ""},
+		{config.EmptyBodyError, http.StatusServiceUnavailable, "empty response body"},
+		{config.EmptyBodySkip, http.StatusOK, ""},
+		{config.EmptyBodyEmptyObject, http.StatusOK, "parsed 1"},
+		{"ignore", http.StatusServiceUnavailable, "Unknown empty body policy"},
+	}
+
+	for i, test := range tests {
+		c := config.Config{
+			Modules: map[string]config.Module{
+				"default": {
+					OnEmptyBody: test.Policy,
+					Metrics: []config.Metric{
+						// Emitted as soon as the body is parsed
+						{Name: "parsed", Path: "1", Type: config.ValueScrape, Help: "parsed"},
+					},
+				},
+			},
+		}
+
+		req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL, nil)
+		recorder := httptest.NewRecorder()
+		probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+		resp := recorder.Result()
+		body, _ := io.ReadAll(resp.Body)
+
+		if resp.StatusCode != test.ExpectedStatus {
+			t.Fatalf("Empty body test %d fails unexpectedly, expected status %d, got %d: %s", i, test.ExpectedStatus, resp.StatusCode, body)
+		}
+		if test.Expected == "" && len(body) != 0 {
+			t.Fatalf("Empty body test %d fails unexpectedly, expected no metrics, got:\n%s", i, body)
+		}
+		if !strings.Contains(string(body), test.Expected) {
+			t.Fatalf("Empty body test %d fails unexpectedly, expected %q in:\n%s", i, test.Expected, body)
+		}
+	}
+}
+
+func TestRecursiveDescentMaxMatches(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	tests := []struct {
+		MaxMatches int
+		Expected   []string
+	}{
+		{1, nil},
+		{2, []string{`used{index="0"} 50`, `used{index="1"} 20`}},
+	}
+
+	for i, test := range tests {
+		c := config.Config{
+			Modules: map[string]config.Module{
+				"default": {
+					Metrics: []config.Metric{
+						{Name: "used", Path: "{..used}", Type: config.ValueScrape, Help: "used", Multi: true, IndexLabel: "index", AllowRecursiveDescent: true, MaxMatches: test.MaxMatches},
+					},
+				},
+			},
+		}
+
+		req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/disks.json", nil)
+		recorder := httptest.NewRecorder()
+		probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+		resp := recorder.Result()
+		body, _ := io.ReadAll(resp.Body)
+
+		for _, e := range test.Expected {
+			if !strings.Contains(string(body), e) {
+				t.Fatalf("Recursive descent test %d fails unexpectedly, expected %q in:\n%s", i, e, body)
+			}
+		}
+		if test.Expected == nil && strings.Contains(string(body), "used{") {
+			t.Fatalf("Recursive descent test %d fails unexpectedly, expected no series in:\n%s", i, body)
+		}
+	}
+}
+
+func TestEmitOnFailure(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer target.Close()
+
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				InjectMetaLabels: true,
+				EmitOnFailure:    map[string]float64{"service_up": 0},
+				Metrics: []config.Metric{
+					{Name: "service_up", Path: "{.up}", Type: config.ValueScrape, Help: "service_up", StaticLabels: map[string]string{"env": "prod"}},
+					{Name: "requests", Path: "{.requests}", Type: config.ValueScrape, Help: "requests"},
+				},
+			},
+			"other": {
+				Metrics: []config.Metric{
+					{Name: "requests", Path: "{.requests}", Type: config.ValueScrape, Help: "requests"},
+				},
+			},
+		},
+	}
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL, nil)
+	recorder := httptest.NewRecorder()
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	expected := `service_up{env="prod",module="default",target="` + target.URL + `"} 0`
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), expected) {
+		t.Fatalf("Emit on failure test fails unexpectedly, expected %q in:\n%s", expected, body)
+	}
+	if strings.Contains(string(body), "requests") {
+		t.Fatalf("Emit on failure test fails unexpectedly, metric without fallback value in:\n%s", body)
+	}
+
+	// The batch id label has no value outside of the documents of a batch
+	module := c.Modules["default"]
+	module.Batch = config.Batch{Path: "{.responses[*]}", ID: "{.id}"}
+	c.Modules["default"] = module
+	req = httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL, nil)
+	recorder = httptest.NewRecorder()
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	body, _ = io.ReadAll(recorder.Result().Body)
+	if !strings.Contains(string(body), expected+"\n") {
+		t.Fatalf("Emit on failure test fails unexpectedly, expected %q without batch id label in:\n%s", expected, body)
+	}
+
+	// Modules without fallback values still fail the probe
+	req = httptest.NewRequest("GET", "http://example.com/foo"+"?module=other&target="+target.URL, nil)
+	recorder = httptest.NewRecorder()
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	if resp := recorder.Result(); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Emit on failure test fails unexpectedly, expected status %d, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+}
+
+func TestErrorPath(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/limited" {
+			fmt.Fprint(w, `{"error": "rate limited"}`)
+			return
+		}
+		fmt.Fprint(w, `{"error": null, "requests": 7}`)
+	}))
+	defer target.Close()
+
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				ErrorPath: "{.error}",
+				Metrics: []config.Metric{
+					{Name: "requests", Path: "{.requests}", Type: config.ValueScrape, ValueType: config.ValueTypeGauge, Help: "requests"},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		Path           string
+		ExpectedStatus int
+		Expected       string
+	}{
+		{"/", http.StatusOK, "requests 7\n"},
+		{"/limited", http.StatusServiceUnavailable, "error in response: rate limited"},
+	}
+
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+test.Path, nil)
+		recorder := httptest.NewRecorder()
+		probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+		resp := recorder.Result()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != test.ExpectedStatus || !strings.Contains(string(body), test.Expected) {
+			t.Fatalf("Error path test %d fails unexpectedly, expected status %d and %q, got %d:\n%s", i, test.ExpectedStatus, test.Expected, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestGRPCWeb(t *testing.T) {
+	frame := func(flags byte, payload []byte) []byte {
+		header := []byte{flags, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+		return append(header, payload...)
+	}
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/status.v1.StatusService/GetStatus" {
+			t.Errorf("Unexpected gRPC-Web request: %s %s", r.Method, r.URL.Path)
+		}
+		if got := r.Header.Get("Content-Type"); got != "application/grpc-web+json" {
+			t.Errorf("Unexpected gRPC-Web content type: %q", got)
+		}
+		body, _ := io.ReadAll(r.Body)
+		if expected := frame(0, []byte(`{"service": "api"}`)); string(body) != string(expected) {
+			t.Errorf("Unexpected gRPC-Web request body: %q", body)
+		}
+		w.Header().Set("Content-Type", "application/grpc-web+json")
+		w.Write(frame(0, []byte(`{"connections": 42}`)))
+		w.Write(frame(0x80, []byte("grpc-status: 0\r\n")))
+	}))
+	defer target.Close()
+
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				InputFormat: config.InputFormatGRPCWeb,
+				Body:        config.Body{Content: `{"service": "api"}`},
+				Metrics: []config.Metric{
+					{Name: "connections", Path: "{.connections}", Type: config.ValueScrape, Help: "connections"},
+				},
+			},
+		},
+	}
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/status.v1.StatusService/GetStatus", nil)
+	recorder := httptest.NewRecorder()
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	if !strings.Contains(string(body), "connections 42") {
+		t.Fatalf("gRPC-Web test fails unexpectedly, got:\n%s", body)
+	}
+}
+
+func TestDynamicScrape(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	tests := []struct {
+		MaxMatches int
+		Expected   []string
+		Unexpected []string
+	}{
+		{10, []string{
+			`app_queue_depth{host="h1"} 3`,
+			`app_workers{host="h1"} 5`,
+			"# HELP requests_total Requests served",
+			"# TYPE requests_total counter",
+			`requests_total{route="/a"} 42`,
+			`requests_total{route="/b"} 7`,
+			`static 1`,
+		}, []string{"bad", "app_state", `route="/c"`}},
+		{1, []string{`static 1`}, []string{"app_", "requests_total"}},
+	}
+
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/dynamic.json", nil)
+		recorder := httptest.NewRecorder()
+		c := config.Config{
+			Modules: map[string]config.Module{
+				"default": {
+					Metrics: []config.Metric{
+						{Name: "static", Path: "1", Type: config.ValueScrape, Help: "static"},
+						{Name: "app", Path: "{.gauges}", Type: config.DynamicScrape, Labels: map[string]string{"host": "h1"}, MaxMatches: test.MaxMatches},
+						{
+							Path:       "{.metrics[*]}",
+							Type:       config.DynamicScrape,
+							Labels:     map[string]string{"route": "{.route}"},
+							Dynamic:    config.DynamicMetric{Name: "{.name}", Value: "{.value}", Help: "{.help}", Type: "{.type}"},
+							MaxMatches: test.MaxMatches,
+						},
+					},
+				},
+			},
+		}
+
+		probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+		resp := recorder.Result()
+		body, _ := io.ReadAll(resp.Body)
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Dynamic scrape test %d fails unexpectedly with status %d:\n%s", i, resp.StatusCode, body)
+		}
+		for _, e := range test.Expected {
+			if !strings.Contains(string(body), e) {
+				t.Fatalf("Dynamic scrape test %d fails unexpectedly, expected %q in:\n%s", i, e, body)
+			}
+		}
+		for _, e := range test.Unexpected {
+			if strings.Contains(string(body), e) {
+				t.Fatalf("Dynamic scrape test %d fails unexpectedly, unexpected %q in:\n%s", i, e, body)
+			}
+		}
+	}
+}
+
+func TestTextfile(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	c, err := config.LoadConfig("../test/config/good.yml", config.ValueTypeUntyped)
+	if err != nil {
+		t.Fatalf("Failed to load config file %s", err)
+	}
+
+	if _, err := parseTextfileTargets([]string{"default"}, c); err == nil {
+		t.Fatal("Textfile target without url is accepted unexpectedly")
+	}
+	if _, err := parseTextfileTargets([]string{"unknown=" + target.URL}, c); err == nil {
+		t.Fatal("Textfile target with unknown module is accepted unexpectedly")
+	}
+	if _, err := parseTextfileTargets([]string{"default=" + target.URL, "default=" + target.URL}, c); err == nil {
+		t.Fatal("Textfile targets with the same module are accepted unexpectedly")
+	}
+
+	targets, err := parseTextfileTargets([]string{"default=" + target.URL + "/serve/good.json"}, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := writeTextfile(context.Background(), promslog.NewNopLogger(), c, targets[0], dir); err != nil {
+		t.Fatal(err)
+	}
+
+	expected, _ := os.ReadFile("../test/response/good.txt")
+	written, err := os.ReadFile(filepath.Join(dir, "json_exporter_default.prom"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(written) != string(expected) {
+		t.Fatalf("Textfile test fails unexpectedly.\nGOT:\n%s\nEXPECTED:\n%s", written, expected)
+	}
+
+	// A failed probe keeps the previous file
+	failing := textfileTarget{module: "default", target: target.URL + "/serve/missing.json"}
+	if err := writeTextfile(context.Background(), promslog.NewNopLogger(), c, failing, dir); err == nil {
+		t.Fatal("Textfile test fails unexpectedly, probe of a missing document succeeded")
+	}
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("Textfile test fails unexpectedly, expected a single file in the directory, got %d", len(files))
+	}
+
+	// Until it is stale
+	if err := removeStaleTextfile(promslog.NewNopLogger(), failing, dir, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "json_exporter_default.prom")); err != nil {
+		t.Fatalf("Textfile test fails unexpectedly, recent file removed: %s", err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "json_exporter_default.prom"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeStaleTextfile(promslog.NewNopLogger(), failing, dir, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("Textfile test fails unexpectedly, expected the stale file removed, got %d files", len(files))
+	}
+	if err := removeStaleTextfile(promslog.NewNopLogger(), failing, dir, time.Hour); err != nil {
+		t.Fatalf("Textfile test fails unexpectedly, missing file not ignored: %s", err)
+	}
+
+	// The timestamps, which the textfile collector rejects, are not written,
+	// and only the latest of the samples of a series is
+	timestamped := config.Config{
+		Modules: map[string]config.Module{
+			"timestamped": {
+				Metrics: []config.Metric{
+					{Name: "cpu_load", Path: "{.points[*]}", Type: config.TimeseriesScrape, Help: "CPU load history", ValueType: config.ValueTypeGauge, EpochTimestamp: "{.timestamp}", Values: map[string]string{"value": "{.value}"}},
+					{Name: "first_point", Path: "{.points[0].value}", Type: config.ValueScrape, Help: "First point", ValueType: config.ValueTypeGauge, EpochTimestamp: "{.points[0].timestamp}"},
+				},
+			},
+		},
+	}
+	timestampedTarget := textfileTarget{module: "timestamped", target: target.URL + "/serve/timeseries.json"}
+	if err := writeTextfile(context.Background(), promslog.NewNopLogger(), timestamped, timestampedTarget, dir); err != nil {
+		t.Fatal(err)
+	}
+	written, err = os.ReadFile(filepath.Join(dir, "json_exporter_timestamped.prom"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedTimestamped := `# HELP cpu_load_value CPU load history
+# TYPE cpu_load_value gauge
+cpu_load_value 3.5
+# HELP first_point First point
+# TYPE first_point gauge
+first_point 1.5
+`
+	if string(written) != expectedTimestamped {
+		t.Fatalf("Textfile test fails unexpectedly.\nGOT:\n%s\nEXPECTED:\n%s", written, expectedTimestamped)
+	}
+}
+
+func TestCorrelationHeaders(t *testing.T) {
+	var requestIDs []string
+	var traceparents []string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestIDs = append(requestIDs, r.Header.Get("X-Request-Id"))
+		traceparents = append(traceparents, r.Header.Get("Traceparent"))
+	}))
+	defer target.Close()
+
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				RequestIDHeader:     "X-Request-Id",
+				ForwardTraceContext: true,
+			},
+			"plain": {},
+		},
+	}
+
+	for _, module := range []string{"default", "default", "plain"} {
+		req := httptest.NewRequest("GET", "http://example.com/foo"+"?module="+module+"&target="+target.URL, nil)
+		req.Header.Set("Traceparent", traceparent)
+		recorder := httptest.NewRecorder()
+		probeHandler(recorder, req, promslog.NewNopLogger(), c)
+	}
+
+	if len(requestIDs) != 3 || requestIDs[0] == "" || requestIDs[0] == requestIDs[1] || requestIDs[2] != "" {
+		t.Fatalf("Correlation headers test fails unexpectedly, expected a new request id per probe of the default module, got %q", requestIDs)
+	}
+	if !reflect.DeepEqual(traceparents, []string{traceparent, traceparent, ""}) {
+		t.Fatalf("Correlation headers test fails unexpectedly, expected the trace context to be forwarded by the default module, got %q", traceparents)
+	}
+}
+
+func TestRatioScrape(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/usage.json", nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				Metrics: []config.Metric{
+					{Name: "utilization", Type: config.RatioScrape, Help: "utilization", Ratio: config.Ratio{Numerator: "{.used}", Denominator: "{.total}"}},
+					{Name: "utilization_percent", Type: config.RatioScrape, Help: "utilization_percent", Ratio: config.Ratio{Numerator: "{.used}", Denominator: "{.total}", Percent: true}},
+					{Name: "volume_utilization", Path: "{.volumes[*]}", Type: config.RatioScrape, Help: "volume_utilization", Labels: map[string]string{"name": "{.name}"}, Ratio: config.Ratio{Numerator: "{.used}", Denominator: "{.total}"}},
+				},
+			},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	expected := []string{
+		`utilization 0.25`,
+		`utilization_percent 25`,
+		`volume_utilization{name="a"} 0.5`,
+		`volume_utilization{name="b"} NaN`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e) {
+			t.Fatalf("Ratio scrape test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+}
+
+func TestProbePath(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	c, err := config.LoadConfig("../test/config/good.yml", config.ValueTypeUntyped)
+	if err != nil {
+		t.Fatalf("Failed to load config file %s", err)
+	}
+	expected, _ := os.ReadFile("../test/response/good.txt")
+
+	tests := []struct {
+		Path           string
+		ExpectedStatus int
+	}{
+		{"/probe/default/" + url.PathEscape(target.URL+"/serve/good.json"), http.StatusOK},
+		{"/probe/default/" + url.QueryEscape(target.URL+"/serve/good.json"), http.StatusOK},
+		{"/probe/default", http.StatusBadRequest},
+		{"/probe/unknown/" + url.PathEscape(target.URL+"/serve/good.json"), http.StatusBadRequest},
+	}
+
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "http://example.com"+test.Path, nil)
+		recorder := httptest.NewRecorder()
+		probePathHandler(recorder, req, promslog.NewNopLogger(), c)
+
+		resp := recorder.Result()
+		body, _ := io.ReadAll(resp.Body)
+
+		if resp.StatusCode != test.ExpectedStatus {
+			t.Fatalf("Probe path test %d fails unexpectedly, expected status %d, got %d: %s", i, test.ExpectedStatus, resp.StatusCode, body)
+		}
+		if test.ExpectedStatus == http.StatusOK && string(body) != string(expected) {
+			t.Fatalf("Probe path test %d fails unexpectedly.\nGOT:\n%s\nEXPECTED:\n%s", i, body, expected)
+		}
+	}
+}
+
+func TestTemplatizePaths(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&region=us-east&target="+url.QueryEscape(target.URL+"/serve/hosts.json"), nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				TemplatizePaths: true,
+				Metrics: []config.Metric{
+					{Name: "connections", Path: `{.{{ .target_host | pathkey }}.connections}`, Type: config.ValueScrape, ValueType: config.ValueTypeGauge, Help: "connections"},
+					{Name: "latency", Path: `{.{{ .target_host | pathkey }}.regions['{{ .region }}'].latency}`, Type: config.ValueScrape, ValueType: config.ValueTypeGauge, Help: "latency", Labels: map[string]string{"region": `{{ .region | upper }}`}},
+				},
+			},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	expected := []string{
+		`connections 12`,
+		`latency{region="US-EAST"} 0.5`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e) {
+			t.Fatalf("Templatized paths test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+}
+
+func TestTemplatizePathsNotCached(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	jsonPaths = &exporter.JSONPaths{}
+	defer func() { jsonPaths = nil }()
+
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				TemplatizePaths: true,
+				Metrics: []config.Metric{
+					{Name: "latency", Path: `{.{{ .target_host | pathkey }}.regions['{{ .region }}'].latency}`, Type: config.ValueScrape, ValueType: config.ValueTypeGauge, Help: "latency"},
+				},
+			},
+		},
+	}
+
+	for i := 0; i < 100; i++ {
+		req := httptest.NewRequest("GET", "http://example.com/foo"+fmt.Sprintf("?module=default&region=region-%d&target=", i)+url.QueryEscape(fmt.Sprintf("%s/serve/hosts.json?%d", target.URL, i)), nil)
+		recorder := httptest.NewRecorder()
+		probeHandler(recorder, req, promslog.NewNopLogger(), c)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Templatized paths cache test fails unexpectedly, got status %d", recorder.Code)
+		}
+	}
+
+	if n := jsonPaths.Len(); n != 0 {
+		t.Fatalf("Templatized paths cache test fails unexpectedly, expected no cached paths, got %d", n)
+	}
+}
+
+func TestProbeParamAliases(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	c, err := config.LoadConfig("../test/config/good.yml", config.ValueTypeUntyped)
+	if err != nil {
+		t.Fatalf("Failed to load config file %s", err)
+	}
+	expected, _ := os.ReadFile("../test/response/good.txt")
+	targetURL := url.QueryEscape(target.URL + "/serve/good.json")
+
+	tests := []struct {
+		Query          string
+		ExpectedStatus int
+	}{
+		{"module=default&target=" + targetURL, http.StatusOK},
+		{"__param_module=default&__param_target=" + targetURL, http.StatusOK},
+		{"module=default&__param_target=" + targetURL, http.StatusOK},
+		{"__param_module=unknown&module=default&target=" + targetURL, http.StatusOK},
+		{"__param_module=unknown&__param_target=" + targetURL, http.StatusBadRequest},
+	}
+
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "http://example.com/probe?"+test.Query, nil)
+		recorder := httptest.NewRecorder()
+		probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+		resp := recorder.Result()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != test.ExpectedStatus {
+			t.Fatalf("Param aliases test %d fails unexpectedly, expected status %d, got %d: %s", i, test.ExpectedStatus, resp.StatusCode, body)
+		}
+		if test.ExpectedStatus == http.StatusOK && string(body) != string(expected) {
+			t.Fatalf("Param aliases test %d fails unexpectedly.\nGOT:\n%s\nEXPECTED:\n%s", i, body, expected)
+		}
+	}
+}
+
+func TestCardinalityMetrics(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	enabled := *cardinalityMetrics
+	defer func() { *cardinalityMetrics = enabled }()
+
+	c, err := config.LoadConfig("../test/config/good.yml", config.ValueTypeUntyped)
+	if err != nil {
+		t.Fatalf("Failed to load config file %s", err)
+	}
+	expected, _ := os.ReadFile("../test/response/good.txt")
+
+	for _, enabled := range []bool{false, true} {
+		*cardinalityMetrics = enabled
+		req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/good.json", nil)
+		recorder := httptest.NewRecorder()
+		probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+		resp := recorder.Result()
+		body, _ := io.ReadAll(resp.Body)
+		if !enabled {
+			if string(body) != string(expected) {
+				t.Fatalf("Cardinality metrics test fails unexpectedly while disabled.\nGOT:\n%s\nEXPECTED:\n%s", body, expected)
+			}
+			continue
+		}
+		for _, e := range []string{
+			`json_distinct_label_values{label="environment",metric="example_global_value"} 1`,
+			`json_distinct_label_values{label="id",metric="example_value_active"} 2`,
+			`json_distinct_label_values{label="environment",metric="example_value_count"} 1`,
+			`example_value_count{environment="beta",id="id-C"} 3`,
+		} {
+			if !strings.Contains(string(body), e) {
+				t.Fatalf("Cardinality metrics test fails unexpectedly, expected %q in:\n%s", e, body)
+			}
+		}
+	}
+}
+
+func TestHTTPVersion(t *testing.T) {
+	protoHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"major": %d}`, r.ProtoMajor)
+	})
+
+	h2cTarget := httptest.NewServer(h2c.NewHandler(protoHandler, &http2.Server{}))
+	defer h2cTarget.Close()
+	http1Target := httptest.NewServer(protoHandler)
+	defer http1Target.Close()
+	http1TLSTarget := httptest.NewTLSServer(protoHandler)
+	defer http1TLSTarget.Close()
+	http2TLSTarget := httptest.NewUnstartedServer(protoHandler)
+	http2TLSTarget.EnableHTTP2 = true
+	http2TLSTarget.StartTLS()
+	defer http2TLSTarget.Close()
+
+	tests := []struct {
+		Target         string
+		Version        config.HTTPVersion
+		ExpectedStatus int
+		ExpectedMajor  string
+	}{
+		{h2cTarget.URL, "", http.StatusOK, "1"},
+		{h2cTarget.URL, config.HTTPVersion11, http.StatusOK, "1"},
+		{h2cTarget.URL, config.HTTPVersionAuto, http.StatusOK, "1"},
+		{h2cTarget.URL, config.HTTPVersion2, http.StatusOK, "2"},
+		{http1Target.URL, config.HTTPVersion2, http.StatusServiceUnavailable, ""},
+		{http1TLSTarget.URL, config.HTTPVersionAuto, http.StatusOK, "1"},
+		{http1TLSTarget.URL, config.HTTPVersion2, http.StatusServiceUnavailable, ""},
+		{http2TLSTarget.URL, config.HTTPVersion11, http.StatusOK, "1"},
+		{http2TLSTarget.URL, config.HTTPVersionAuto, http.StatusOK, "2"},
+		{http2TLSTarget.URL, config.HTTPVersion2, http.StatusOK, "2"},
+		{http1Target.URL, "3", http.StatusServiceUnavailable, ""},
+	}
+
+	for i, test := range tests {
+		c := config.Config{
+			Modules: map[string]config.Module{
+				"default": {
+					HTTPVersion: test.Version,
+					HTTPClientConfig: pconfig.HTTPClientConfig{
+						TLSConfig: pconfig.TLSConfig{InsecureSkipVerify: true},
+					},
+					Metrics: []config.Metric{
+						{Name: "major", Path: "{.major}", Type: config.ValueScrape, ValueType: config.ValueTypeGauge, Help: "major"},
+					},
+				},
+			},
+		}
+
+		req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+url.QueryEscape(test.Target), nil)
+		recorder := httptest.NewRecorder()
+		probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+		resp := recorder.Result()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != test.ExpectedStatus {
+			t.Fatalf("HTTP version test %d fails unexpectedly, expected status %d, got %d: %s", i, test.ExpectedStatus, resp.StatusCode, body)
+		}
+		if test.ExpectedMajor != "" && !strings.Contains(string(body), "major "+test.ExpectedMajor+"\n") {
+			t.Fatalf("HTTP version test %d fails unexpectedly, expected HTTP/%s in:\n%s", i, test.ExpectedMajor, body)
+		}
+	}
+}
+
+func TestJoinLabels(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/tags.json", nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				Metrics: []config.Metric{
+					{
+						Name:       "instance",
+						Type:       config.ObjectScrape,
+						Path:       "{.instances[*]}",
+						Help:       "instance",
+						Labels:     map[string]string{"name": "{.name}", "tags": "{.tags[*]}", "zones": "{.zones[*]}"},
+						JoinLabels: map[string]string{"tags": ",", "zones": "|"},
+						Values:     map[string]string{"cpu": "{.cpu}"},
+					},
+					{
+						Name:       "tags",
+						Type:       config.ValueScrape,
+						Path:       "{.instances[0].cpu}",
+						Help:       "tags",
+						Labels:     map[string]string{"all": "{.instances[*].tags[*]}"},
+						JoinLabels: map[string]string{"all": ";"},
+					},
+				},
+			},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	expected := []string{
+		`instance_cpu{name="web-1",tags="blue,canary",zones="{\"id\":1}"} 0.5`,
+		`instance_cpu{name="web-2",tags="",zones="{\"id\":1}|{\"id\":2}"} 0.25`,
+		`tags{all="blue;canary"} 0.5`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e) {
+			t.Fatalf("Join labels test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	var fetches atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		fmt.Fprintf(w, `{"value": 1}`)
+	}))
+	defer target.Close()
+
+	module := func(user string) config.Module {
+		return config.Module{
+			Debounce: model.Duration(time.Second),
+			Headers:  map[string]string{"X-User": user},
+			Metrics: []config.Metric{
+				{Name: "value", Path: "{.value}", Type: config.ValueScrape, ValueType: config.ValueTypeGauge, Help: "value"},
+			},
+		}
+	}
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"alice": module("alice"),
+			"bob":   module("bob"),
+		},
+	}
+
+	probe := func(module string) int {
+		req := httptest.NewRequest("GET", "http://example.com/foo"+"?module="+module+"&target="+target.URL, nil)
+		recorder := httptest.NewRecorder()
+		probeHandler(recorder, req, promslog.NewNopLogger(), c)
+		return recorder.Result().StatusCode
+	}
+
+	shared := testutil.ToFloat64(exporter.FetchSharedTotal)
+	done := make(chan int)
+	for i := 0; i < 5; i++ {
+		go func() { done <- probe("alice") }()
+	}
+	go func() { done <- probe("bob") }()
+	for i := 0; i < 6; i++ {
+		if status := <-done; status != http.StatusOK {
+			t.Fatalf("Debounce test fails unexpectedly, got status %d", status)
+		}
+	}
+	if got := fetches.Load(); got != 2 {
+		t.Fatalf("Debounce test fails unexpectedly, expected 2 fetches for the identical probes in flight, got %d", got)
+	}
+
+	// Within the window, the result of the fetch is still shared
+	probe("alice")
+	if got := fetches.Load(); got != 2 {
+		t.Fatalf("Debounce test fails unexpectedly, expected no fetch within the debounce window, got %d fetches", got)
+	}
+	if got := testutil.ToFloat64(exporter.FetchSharedTotal) - shared; got != 5 {
+		t.Fatalf("Debounce test fails unexpectedly, expected 5 shared fetches, got %v", got)
+	}
+}
+
+func TestDebounceCanceledLeader(t *testing.T) {
+	var fetches atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprintf(w, `{"value": 1}`)
+	}))
+	defer target.Close()
+
+	tests := []struct {
+		Timeout         time.Duration
+		ExpectedFetches int32
+	}{
+		// The fetch goes on for the waiting probe
+		{time.Second, 1},
+		// The fetch is canceled, and fetched again for the waiting probe
+		{0, 2},
+	}
+
+	for i, test := range tests {
+		c := config.Config{
+			Modules: map[string]config.Module{
+				"default": {
+					Debounce: model.Duration(time.Second),
+					Timeout:  model.Duration(test.Timeout),
+					Metrics: []config.Metric{
+						{Name: "value", Path: "{.value}", Type: config.ValueScrape, ValueType: config.ValueTypeGauge, Help: "value"},
+					},
+				},
+			},
+		}
+		probe := func(ctx context.Context) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL, nil).WithContext(ctx)
+			recorder := httptest.NewRecorder()
+			probeHandler(recorder, req, promslog.NewNopLogger(), c)
+			return recorder
+		}
+
+		fetches.Store(0)
+		timeouts := testutil.ToFloat64(probeTimeouts.WithLabelValues("default"))
+		// The first probe gives up while the second one waits for its fetch
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		first := make(chan *httptest.ResponseRecorder)
+		go func() { first <- probe(ctx) }()
+		time.Sleep(20 * time.Millisecond)
+		second := probe(context.Background())
+		cancel()
+
+		if status := (<-first).Result().StatusCode; status == http.StatusOK {
+			t.Fatalf("Debounce test %d fails unexpectedly, expected the canceled probe to fail", i)
+		}
+		if status := second.Result().StatusCode; status != http.StatusOK {
+			t.Fatalf("Debounce test %d fails unexpectedly, got status %d for the probe waiting on a canceled one: %s", i, status, second.Body)
+		}
+		if !strings.Contains(second.Body.String(), "value 1\n") {
+			t.Fatalf("Debounce test %d fails unexpectedly, expected the value in:\n%s", i, second.Body)
+		}
+		if got := fetches.Load(); got != test.ExpectedFetches {
+			t.Fatalf("Debounce test %d fails unexpectedly, expected %d fetches, got %d", i, test.ExpectedFetches, got)
+		}
+		if got := testutil.ToFloat64(probeTimeouts.WithLabelValues("default")) - timeouts; got != 1 {
+			t.Fatalf("Debounce test %d fails unexpectedly, expected only the canceled probe to time out, got %v timeouts", i, got)
+		}
+	}
+}
+
+func TestArrayRoot(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	tests := []struct {
+		File     string
+		Metrics  []config.Metric
+		Expected []string
+	}{
+		{
+			"numbers.json",
+			[]config.Metric{
+				{Name: "first", Path: "{[0]}", Type: config.ValueScrape, Help: "first"},
+				{Name: "second", Path: "{.[1]}", Type: config.ValueScrape, Help: "second"},
+				{Name: "third", Path: "{$.[2]}", Type: config.ValueScrape, Help: "third"},
+				{Name: "last", Path: "{[-1:]}", Type: config.ValueScrape, Help: "last"},
+				{Name: "number", Path: "{[*]}", Type: config.ValueScrape, Help: "number", Multi: true, IndexLabel: "index"},
+			},
+			[]string{
+				"first 10",
+				"second 20",
+				"third 30",
+				"last 30",
+				`number{index="2"} 30`,
+			},
+		},
+		{
+			"array.json",
+			[]config.Metric{
+				{Name: "first", Path: "{[0].value}", Type: config.ValueScrape, Help: "first", Labels: map[string]string{"name": "{.[0].name}"}},
+				{Name: "value", Path: "{[*].value}", Type: config.ValueScrape, Help: "value", Multi: true, IndexLabel: "index", SiblingLabels: map[string]string{"name": "{.name}"}},
+				{Name: "element", Path: "{[*]}", Type: config.ObjectScrape, Help: "element", Labels: map[string]string{"name": "{.name}"}, Values: map[string]string{"value": "{.value}"}},
+			},
+			[]string{
+				`first{name="a"} 1`,
+				`value{index="1",name="b"} 2`,
+				`element_value{name="c"} 3`,
+			},
+		},
+	}
+
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/"+test.File, nil)
+		recorder := httptest.NewRecorder()
+		c := config.Config{Modules: map[string]config.Module{"default": {Metrics: test.Metrics}}}
+
+		probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+		resp := recorder.Result()
+		body, _ := io.ReadAll(resp.Body)
+		for _, e := range test.Expected {
+			if !strings.Contains(string(body), e+"\n") {
+				t.Fatalf("Array root test %d fails unexpectedly, expected %q in:\n%s", i, e, body)
+			}
+		}
+	}
+}
+
+func TestDefaultLabels(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/disks.json", nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				DefaultLabels: map[string]string{"host": "unknown", "team": "storage", "env": "prod"},
+				Metrics: []config.Metric{
+					{Name: "used", Path: "{.disks[0].used}", Type: config.ValueScrape, Help: "used"},
+					{Name: "host_used", Path: "{.disks[0].used}", Type: config.ValueScrape, Help: "host_used", Labels: map[string]string{"host": "{.host}"}},
+					{Name: "disk", Path: "{.disks[*]}", Type: config.ObjectScrape, Help: "disk", Labels: map[string]string{"mount": "{.mount}"}, StaticLabels: map[string]string{"env": "dev"}, Values: map[string]string{"used": "{.used}"}},
+				},
+			},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	expected := []string{
+		`used{env="prod",host="unknown",team="storage"} 50`,
+		`host_used{env="prod",host="h1",team="storage"} 50`,
+		`disk_used{env="dev",host="unknown",mount="/var",team="storage"} 20`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e) {
+			t.Fatalf("Default labels test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+}
+
+func TestStatusCodeMetric(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `{"value": 1}`)
+	}))
+	defer target.Close()
+
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				ValidStatusCodes: []int{200, 404},
+				Metrics: []config.Metric{
+					{Name: "endpoint_status_code", Type: config.ValueScrape, ValueType: config.ValueTypeGauge, Help: "endpoint_status_code", StatusCode: true, StaticLabels: map[string]string{"endpoint": "api"}},
+					{Name: "value", Path: "{.value}", Type: config.ValueScrape, ValueType: config.ValueTypeGauge, Help: "value"},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		Path     string
+		Expected []string
+	}{
+		{"/", []string{`endpoint_status_code{endpoint="api"} 200`, "value 1"}},
+		{"/missing", []string{`endpoint_status_code{endpoint="api"} 404`}},
+	}
+
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+test.Path, nil)
+		recorder := httptest.NewRecorder()
+		probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+		resp := recorder.Result()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Status code metric test %d fails unexpectedly, got status %d: %s", i, resp.StatusCode, body)
+		}
+		for _, e := range test.Expected {
+			if !strings.Contains(string(body), e+"\n") {
+				t.Fatalf("Status code metric test %d fails unexpectedly, expected %q in:\n%s", i, e, body)
+			}
+		}
+	}
+}
+
+func TestCookieMetric(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+		http.SetCookie(w, &http.Cookie{Name: "quota", Value: "42"})
+		http.SetCookie(w, &http.Cookie{Name: "latency", Value: "12ms"})
+		fmt.Fprint(w, `<html>not json</html>`)
+	}))
+	defer target.Close()
+
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				Metrics: []config.Metric{
+					{Name: "quota", Type: config.ValueScrape, ValueType: config.ValueTypeGauge, Help: "quota", Cookie: "quota", StaticLabels: map[string]string{"endpoint": "api"}},
+					{Name: "latency", Type: config.ValueScrape, ValueType: config.ValueTypeGauge, Help: "latency", Cookie: "latency", NumberFormat: &config.NumberFormat{Regex: `(\d+)ms`}},
+					{Name: "session", Type: config.ValueScrape, ValueType: config.ValueTypeGauge, Help: "session", Cookie: "session"},
+					{Name: "missing", Type: config.ValueScrape, ValueType: config.ValueTypeGauge, Help: "missing", Cookie: "missing"},
+				},
+			},
+		},
+	}
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL, nil)
+	recorder := httptest.NewRecorder()
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	for _, e := range []string{`quota{endpoint="api"} 42`, "latency 12"} {
+		if !strings.Contains(string(body), e+"\n") {
+			t.Fatalf("Cookie metric test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+	for _, name := range []string{"session ", "missing "} {
+		if strings.Contains(string(body), "\n"+name) {
+			t.Fatalf("Cookie metric test fails unexpectedly, got a series of %q in:\n%s", name, body)
+		}
+	}
+
+	if _, err := exporter.CreateMetricsList(config.Module{Metrics: []config.Metric{{Name: "quota", Type: config.ValueScrape, Cookie: "quota", Labels: map[string]string{"id": "{.id}"}}}}, "", nil); err == nil {
+		t.Fatal("Cookie metric test fails unexpectedly, labels accepted")
+	}
+}
+
+func TestBatch(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/batch.json", nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				Batch: config.Batch{Path: "{.responses[*]}", ID: "{.id}", IDLabel: "request", Body: "{.body}"},
+				Metrics: []config.Metric{
+					{Name: "counter", Path: "{.counter}", Type: config.ValueScrape, Help: "counter"},
+					{Name: "value", Path: "{.values[*]}", Type: config.ObjectScrape, Help: "value", Labels: map[string]string{"id": "{.id}"}, Values: map[string]string{"count": "{.count}"}},
+					{Name: "metric", Type: config.DynamicScrape, Path: "{.values[0]}", Dynamic: config.DynamicMetric{Name: "{.id}", Value: "{.count}"}, MaxMatches: 10},
+				},
+			},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	expected := []string{
+		`counter{request="1"} 10`,
+		`counter{request="2"} 20`,
+		`value_count{id="b",request="1"} 2`,
+		`value_count{id="a",request="2"} 3`,
+		`metric_a{request="2"} 3`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e+"\n") {
+			t.Fatalf("Batch test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+
+	// A response which cannot be split fails the probe
+	module := c.Modules["default"]
+	module.Batch.Body = "{.missing}"
+	c.Modules["default"] = module
+	recorder = httptest.NewRecorder()
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Batch test fails unexpectedly, expected status %d for an unsplittable response, got %d", http.StatusServiceUnavailable, recorder.Code)
+	}
+}
+
+func TestPreRequest(t *testing.T) {
+	var logins int
+	var token string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		logins++
+		token = fmt.Sprintf("token-%d", logins)
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: token})
+		w.Header().Set("X-Csrf-Token", "csrf-"+token)
+		w.WriteHeader(http.StatusFound)
+	})
+	mux.HandleFunc("/api/status", func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie("session")
+		if err != nil || cookie.Value != token || r.Header.Get("X-Csrf-Token") != "csrf-"+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if tenant, err := r.Cookie("tenant"); err != nil || tenant.Value != "acme" || len(r.Cookies()) != 2 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, `{"logins": %d}`, logins)
+	})
+	target := httptest.NewServer(mux)
+	defer target.Close()
+
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				PreRequest: config.PreRequest{Path: "/login", Body: "user=foo", CaptureHeaders: []string{"X-Csrf-Token"}},
+				Headers:    map[string]string{"Cookie": "tenant=acme"},
+				Metrics: []config.Metric{
+					{Name: "logins", Path: "{.logins}", Type: config.ValueScrape, ValueType: config.ValueTypeGauge, Help: "logins"},
+				},
+			},
+		},
+	}
+
+	probe := func() string {
+		req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/api/status", nil)
+		recorder := httptest.NewRecorder()
+		probeHandler(recorder, req, promslog.NewNopLogger(), c)
+		body, _ := io.ReadAll(recorder.Result().Body)
+		return string(body)
+	}
+
+	for i := 0; i < 3; i++ {
+		if body := probe(); !strings.Contains(body, "logins 1\n") {
+			t.Fatalf("Pre request test fails unexpectedly on probe %d, expected a single login, got:\n%s", i, body)
+		}
+	}
+
+	// The session expires on the side of the target
+	token = ""
+	if body := probe(); !strings.Contains(body, "logins 2\n") {
+		t.Fatalf("Pre request test fails unexpectedly, expected a new login once rejected, got:\n%s", body)
+	}
+}
+
+func TestQuotedSpecialFloats(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/special.json", nil)
+	recorder := httptest.NewRecorder()
+	var metrics []config.Metric
+	for _, name := range []string{"nan", "negative_nan", "inf", "positive_inf", "negative_inf", "infinity", "count"} {
+		metrics = append(metrics, config.Metric{Name: name, Path: "{." + name + "}", Type: config.ValueScrape, ValueType: config.ValueTypeGauge, Help: name})
+	}
+	metrics = append(metrics, config.Metric{Name: "formatted", Path: "{.formatted}", Type: config.ValueScrape, ValueType: config.ValueTypeGauge, Help: "formatted", NumberFormat: &config.NumberFormat{Regex: `[\d.]+`}})
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {Metrics: metrics},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	expected := []string{
+		"nan NaN",
+		"negative_nan NaN",
+		"inf +Inf",
+		"positive_inf +Inf",
+		"negative_inf -Inf",
+		"infinity +Inf",
+		"count 42",
+		"formatted +Inf",
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e+"\n") {
+			t.Fatalf("Quoted special floats test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+}
+
+func TestNonFiniteNumbers(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"nan": NaN, "inf": Infinity, "negative_inf": -Infinity, "count": 42, "name": "NaN"}`)
+	}))
+	defer target.Close()
+
+	var metrics []config.Metric
+	for _, name := range []string{"nan", "inf", "negative_inf", "count"} {
+		metrics = append(metrics, config.Metric{Name: name, Path: "{." + name + "}", Type: config.ValueScrape, ValueType: config.ValueTypeGauge, Help: name})
+	}
+
+	for _, allow := range []bool{false, true} {
+		req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL, nil)
+		recorder := httptest.NewRecorder()
+		c := config.Config{
+			Modules: map[string]config.Module{
+				"default": {Metrics: metrics, NonFiniteLiterals: allow},
+			},
+		}
+
+		probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+		resp := recorder.Result()
+		body, _ := io.ReadAll(resp.Body)
+
+		if !allow {
+			if strings.Contains(string(body), "count 42\n") {
+				t.Fatalf("Non finite numbers test fails unexpectedly, strict json accepted:\n%s", body)
+			}
+			continue
+		}
+		for _, e := range []string{"nan NaN", "inf +Inf", "negative_inf -Inf", "count 42"} {
+			if !strings.Contains(string(body), e+"\n") {
+				t.Fatalf("Non finite numbers test fails unexpectedly, expected %q in:\n%s", e, body)
+			}
+		}
+	}
+}
+
+func TestWhitespaceValues(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/whitespace.json", nil)
+	recorder := httptest.NewRecorder()
+	var metrics []config.Metric
+	for _, name := range []string{"padded", "newline", "crlf", "signed", "up"} {
+		metrics = append(metrics, config.Metric{Name: name, Path: "{." + name + "}", Type: config.ValueScrape, ValueType: config.ValueTypeGauge, Help: name})
+	}
+	metrics = append(metrics, config.Metric{Name: "disk", Path: "{.disks[*]}", Type: config.ObjectScrape, ValueType: config.ValueTypeGauge, Help: "disk", Labels: map[string]string{"name": "{.name}"}, Values: map[string]string{"free": "{.free}"}})
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {Metrics: metrics},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	expected := []string{
+		"padded 5",
+		"newline 7",
+		"crlf -1.5",
+		"signed 3",
+		"up 1",
+		`disk_free{name="sda"} 10`,
+		`disk_free{name="sdb"} 20`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e+"\n") {
+			t.Fatalf("Whitespace values test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+}
+
+func TestNumericTimestamps(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/timestamps.json", nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				Metrics: []config.Metric{
+					{Name: "temperature", Path: "{.temperature}", Type: config.ValueScrape, ValueType: config.ValueTypeGauge, Help: "temperature", EpochTimestamp: "{.updated}"},
+					{Name: "sensor", Path: "{.sensors[*]}", Type: config.ObjectScrape, ValueType: config.ValueTypeGauge, Help: "sensor", EpochTimestamp: "{.updated}", Labels: map[string]string{"name": "{.name}"}, Values: map[string]string{"value": "{.value}"}},
+				},
+			},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	// The timestamps are rendered by the json paths as '1.7e+12'
+	expected := []string{
+		"temperature 21.5 1700000000000",
+		`sensor_value{name="inside"} 21.5 1700000001000`,
+		`sensor_value{name="outside"} 4 1700000002000`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e+"\n") {
+			t.Fatalf("Numeric timestamps test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+}
+
+func TestEmitUpdateTimestamp(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/timestamps.json", nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				Metrics: []config.Metric{
+					{Name: "temperature", Path: "{.temperature}", Type: config.ValueScrape, ValueType: config.ValueTypeGauge, Help: "temperature", EpochTimestamp: "{.updated}", EmitUpdateTimestamp: true},
+					{Name: "sensor", Path: "{.sensors[*]}", Type: config.ObjectScrape, ValueType: config.ValueTypeGauge, Help: "sensor", EpochTimestamp: "{.updated}", EmitUpdateTimestamp: true, Labels: map[string]string{"name": "{.name}"}, Values: map[string]string{"value": "{.value}"}},
+				},
+			},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	// The samples keep the time of the scrape
+	expected := []string{
+		"temperature 21.5",
+		"temperature_last_update_timestamp_seconds 1.7e+09",
+		`sensor_value{name="inside"} 21.5`,
+		`sensor_value{name="outside"} 4`,
+		`sensor_value_last_update_timestamp_seconds{name="inside"} 1.700000001e+09`,
+		`sensor_value_last_update_timestamp_seconds{name="outside"} 1.700000002e+09`,
+		"# TYPE sensor_value_last_update_timestamp_seconds gauge",
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e+"\n") {
+			t.Fatalf("Update timestamp test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+}
+
+func TestInfoMetric(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/build.json", nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				Metrics: []config.Metric{
+					{Name: "build_info", Type: config.InfoScrape, Help: "build", Labels: map[string]string{"version": "{.version}", "commit": "{.build.commit}"}},
+					{Name: "plugin_info", Path: "{.plugins[*]}", Type: config.InfoScrape, Help: "plugins", Labels: map[string]string{"name": "{.name}", "version": "{.version}"}},
+				},
+			},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	expected := []string{
+		"# TYPE build_info gauge",
+		`build_info{commit="3f9c2a1",version="1.4.2"} 1`,
+		`plugin_info{name="auth",version="0.3.0"} 1`,
+		`plugin_info{name="cache",version="2.1.0"} 1`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e+"\n") {
+			t.Fatalf("Info metric test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+}
+
+func TestKeyCount(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/queues.json", nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				Metrics: []config.Metric{
+					{Name: "queues", Type: config.KeyCountScrape, Help: "queues", ValueType: config.ValueTypeGauge, KeyPattern: "^queue_"},
+					{Name: "keys", Type: config.KeyCountScrape, Help: "keys"},
+					{Name: "host_queues", Path: "{.hosts[*].queues}", Type: config.KeyCountScrape, Help: "host queues", KeyPattern: "^queue_", IndexLabel: "host"},
+					{Name: "not_object", Path: "{.workers}", Type: config.KeyCountScrape, Help: "workers"},
+				},
+			},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	expected := []string{
+		"# TYPE queues gauge",
+		"queues 3",
+		"keys 5",
+		`host_queues{host="0"} 2`,
+		`host_queues{host="1"} 1`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e+"\n") {
+			t.Fatalf("Key count test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+	if strings.Contains(string(body), "not_object") {
+		t.Fatalf("Key count test fails unexpectedly, counted the keys of a number:\n%s", body)
+	}
+}
+
+func TestScale(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/temperatures.json", nil)
+	recorder := httptest.NewRecorder()
+	milli := 0.001
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				Metrics: []config.Metric{
+					{Name: "cpu_celsius", Path: "{.cpu}", Type: config.ValueScrape, Help: "cpu", Scale: &milli},
+					{Name: "cpu_kelvin", Path: "{.cpu}", Type: config.ValueScrape, Help: "cpu", Scale: &milli, Offset: 273},
+					{Name: "ambient_celsius", Path: "{.ambient}", Type: config.ValueScrape, Help: "ambient", Scale: &milli, Offset: 273},
+					{Name: "zone", Path: "{.zones[*]}", Type: config.ObjectScrape, Help: "zone", Scale: &milli, Labels: map[string]string{"name": "{.name}"}, Values: map[string]string{"celsius": "{.temperature}"}},
+				},
+			},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	expected := []string{
+		"cpu_celsius 37",
+		"cpu_kelvin 310",
+		"ambient_celsius NaN",
+		`zone_celsius{name="north"} 21.5`,
+		`zone_celsius{name="south"} 18`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e+"\n") {
+			t.Fatalf("Scale test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+}
+
+func TestCEL(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/good.json", nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				Metrics: []config.Metric{
+					{Name: "active_count", Path: `data.values.filter(v, v.state == "ACTIVE").size()`, Type: config.ValueScrape, Help: "active", Engine: config.EngineTypeCEL},
+					{Name: "values", Path: "size(data.values)", Type: config.ValueScrape, Help: "values", Engine: config.EngineTypeCEL, Labels: map[string]string{"location": "data.location", "first": "data.values[0].id"}},
+					{Name: "counter", Path: "data.counter", Type: config.ValueScrape, Help: "counter", Engine: config.EngineTypeCEL},
+				},
+			},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	expected := []string{
+		"active_count 2",
+		`values{first="id-A",location="mars"} 3`,
+		"counter 1234",
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e+"\n") {
+			t.Fatalf("CEL test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+}
+
+func TestHTTP3RequiresHTTPS(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/good.json", nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {HTTP3: true},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	if resp := recorder.Result(); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("HTTP/3 test fails unexpectedly, expected a failed probe for an http target, got %d", resp.StatusCode)
+	}
+}
+
+func TestValueTypePath(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/typed.json", nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				Metrics: []config.Metric{
+					{Name: "requests", Path: "{.requests.value}", Type: config.ValueScrape, ValueType: config.ValueTypeUntyped, ValueTypePath: "{.requests.type}", Help: "requests"},
+					{Name: "queue", Path: "{.queue.value}", Type: config.ValueScrape, ValueType: config.ValueTypeUntyped, ValueTypePath: "{.queue.type}", Help: "queue"},
+					{Name: "other", Path: "{.other.value}", Type: config.ValueScrape, ValueType: config.ValueTypeGauge, ValueTypePath: "{.other.type}", Help: "other"},
+					{Name: "item", Path: "{.items[*]}", Type: config.ObjectScrape, ValueType: config.ValueTypeUntyped, ValueTypePath: "{.type}", Help: "item", Labels: map[string]string{"id": "{.id}"}, Values: map[string]string{"value": "{.value}"}},
+				},
+			},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	expected := []string{
+		"# TYPE requests counter",
+		"requests 10",
+		"# TYPE queue gauge",
+		"queue 3",
+		"# TYPE other gauge",
+		"other 1",
+		"# TYPE item_value counter",
+		`item_value{id="a"} 1`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e+"\n") {
+			t.Fatalf("Value type path test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+	if strings.Contains(string(body), `id="b"`) {
+		t.Fatalf("Value type path test fails unexpectedly, expected the series of conflicting type to be skipped, got:\n%s", body)
+	}
+}
+
+func TestInvalidJSONRetries(t *testing.T) {
+	var fetches atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		// The first two responses are truncated while the cache refreshes
+		if fetches.Add(1)%3 != 0 {
+			fmt.Fprintf(w, `{"value": `)
+			return
+		}
+		fmt.Fprintf(w, `{"value": %d, "body": %q}`, fetches.Load(), body)
+	}))
+	defer target.Close()
+
+	for _, test := range []struct {
+		Retries  int
+		Expected string
+	}{
+		{0, ""},
+		{1, ""},
+		{2, "value 3\n"},
+	} {
+		fetches.Store(0)
+		c := config.Config{
+			Modules: map[string]config.Module{
+				"default": {
+					InvalidJSONRetries: test.Retries,
+					Body:               config.Body{Content: "query"},
+					Metrics: []config.Metric{
+						{Name: "value", Path: "{.value}", Type: config.ValueScrape, ValueType: config.ValueTypeGauge, Help: "value"},
+						{Name: "body_info", Type: config.InfoScrape, Help: "body", Labels: map[string]string{"body": "{.body}"}},
+					},
+				},
+			},
+		}
+		req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL, nil)
+		recorder := httptest.NewRecorder()
+		probeHandler(recorder, req, promslog.NewNopLogger(), c)
+		body, _ := io.ReadAll(recorder.Result().Body)
+
+		if fetches := int(fetches.Load()); fetches != test.Retries+1 {
+			t.Fatalf("Invalid json retries test fails unexpectedly, expected %d fetches with %d retries, got %d", test.Retries+1, test.Retries, fetches)
+		}
+		if test.Expected == "" {
+			if strings.Contains(string(body), "value ") {
+				t.Fatalf("Invalid json retries test fails unexpectedly, expected no value with %d retries, got:\n%s", test.Retries, body)
+			}
+			continue
+		}
+		if !strings.Contains(string(body), test.Expected) || !strings.Contains(string(body), `body_info{body="query"} 1`) {
+			t.Fatalf("Invalid json retries test fails unexpectedly, expected %q and the body sent again with %d retries, got:\n%s", test.Expected, test.Retries, body)
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/readings.json", nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				AllowMissingKeys: true,
+				Metrics: []config.Metric{
+					{Name: "latest", Path: "{.readings[*]}", Type: config.ObjectScrape, ValueType: config.ValueTypeGauge, Help: "latest", Select: config.Select{Max: "{.timestamp}"}, Labels: map[string]string{"sensor": "{.sensor}"}, Values: map[string]string{"value": "{.value}"}},
+					{Name: "earliest", Path: "{.readings[*]}", Type: config.ObjectScrape, ValueType: config.ValueTypeGauge, Help: "earliest", Select: config.Select{Min: "{.timestamp}"}, Labels: map[string]string{"sensor": "{.sensor}"}, Values: map[string]string{"value": "{.value}"}},
+					{Name: "last_event_info", Path: "{.events[*]}", Type: config.InfoScrape, Help: "last event", Select: config.Select{Max: "{.time}"}, Labels: map[string]string{"level": "{.level}"}},
+				},
+			},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	expected := []string{
+		`latest_value{sensor="c"} 5`,
+		`earliest_value{sensor="b"} 3`,
+		`last_event_info{level="warning"} 1`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e+"\n") {
+			t.Fatalf("Select test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+	if n := strings.Count(string(body), "\nlatest_value") + strings.Count(string(body), "\nearliest_value") + strings.Count(string(body), "\nlast_event_info"); n != 3 {
+		t.Fatalf("Select test fails unexpectedly, expected a single series per metric, got:\n%s", body)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"origins": [{"name": "a", "healthy": true, "latency": 10}, {"name": "b", "healthy": false, "latency": 20}, {"name": "c", "latency": 30}, {"name": "d", "healthy": "true", "latency": 40}, {"name": "e", "healthy": "yes", "latency": 50}]}`)
+	}))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL, nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				Metrics: []config.Metric{
+					{Name: "origin", Path: "{.origins[*]}", Type: config.ObjectScrape, ValueType: config.ValueTypeGauge, Help: "origin", IndexLabel: "index", Labels: map[string]string{"name": "{.name}"}, Filter: "{.healthy}", Values: map[string]string{"latency": "{.latency}"}},
+				},
+			},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	for _, e := range []string{`origin_latency{index="0",name="a"} 10`, `origin_latency{index="3",name="d"} 40`} {
+		if !strings.Contains(string(body), e+"\n") {
+			t.Fatalf("Filter test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+	for _, name := range []string{"b", "c", "e"} {
+		if strings.Contains(string(body), `name="`+name+`"`) {
+			t.Fatalf("Filter test fails unexpectedly, got element %q in:\n%s", name, body)
+		}
+	}
+
+	if _, err := exporter.CreateMetricsList(config.Module{Metrics: []config.Metric{{Name: "origin", Path: "{.origins[*].latency}", Type: config.ValueScrape, Multi: true, Filter: "{.healthy}"}}}, "", nil); err == nil {
+		t.Fatal("Filter test fails unexpectedly, filter accepted on a value metric")
+	}
+}
+
+func TestRequireAllPaths(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"version": "1.2", "requests": 7, "errors": 1, "origins": [{"name": "a", "region": "eu", "latency": 10}, {"name": "b", "latency": 20}, {"name": "c", "region": null, "latency": 30}, {"name": "d", "region": "us"}]}`)
+	}))
+	defer target.Close()
+
+	metrics := []config.Metric{
+		{Name: "origin", Path: "{.origins[*]}", Type: config.ObjectScrape, ValueType: config.ValueTypeGauge, Help: "origin", Labels: map[string]string{"name": "{.name}", "region": "{.region}"}, Values: map[string]string{"latency": "{.latency}"}},
+		{Name: "requests", Path: "{.requests}", Type: config.ValueScrape, ValueType: config.ValueTypeGauge, Help: "requests", Labels: map[string]string{"version": "{.version}"}},
+		{Name: "errors", Path: "{.errors}", Type: config.ValueScrape, ValueType: config.ValueTypeGauge, Help: "errors", Labels: map[string]string{"build": "{.build}"}},
+	}
+	for i := range metrics {
+		metrics[i].RequireAllPaths = true
+	}
+
+	for _, allowMissing := range []bool{false, true} {
+		req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL, nil)
+		recorder := httptest.NewRecorder()
+		c := config.Config{
+			Modules: map[string]config.Module{
+				"default": {Metrics: metrics, AllowMissingKeys: allowMissing},
+			},
+		}
+
+		probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+		resp := recorder.Result()
+		body, _ := io.ReadAll(resp.Body)
+
+		for _, e := range []string{`origin_latency{name="a",region="eu"} 10`, `requests{version="1.2"} 7`} {
+			if !strings.Contains(string(body), e+"\n") {
+				t.Fatalf("Require all paths test fails unexpectedly, expected %q in:\n%s", e, body)
+			}
+		}
+		for _, e := range []string{`name="b"`, `name="c"`, `name="d"`, "errors"} {
+			if strings.Contains(string(body), e) {
+				t.Fatalf("Require all paths test fails unexpectedly, got %q in:\n%s", e, body)
+			}
+		}
+	}
+
+	if _, err := exporter.CreateMetricsList(config.Module{Metrics: []config.Metric{{Name: "latency", Path: "{.origins[*].latency}", Type: config.ValueScrape, Multi: true, RequireAllPaths: true}}}, "", nil); err == nil {
+		t.Fatal("Require all paths test fails unexpectedly, multi metric accepted")
+	}
+}
+
+func TestLargeIntegers(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"counters": [{"id": 18446744073709551615, "bytes": 9007199254740993}, {"id": 18446744073709551614, "bytes": 9007199254740992}]}`)
+	}))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL, nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				Metrics: []config.Metric{
+					{Name: "counter", Path: "{.counters[*]}", Type: config.ObjectScrape, ValueType: config.ValueTypeCounter, Help: "counter", Labels: map[string]string{"id": "{.id}"}, Values: map[string]string{"bytes": "{.bytes}"}},
+					{Name: "last", Path: "{.counters[*]}", Type: config.InfoScrape, Help: "last", Labels: map[string]string{"id": "{.id}"}, Select: config.Select{Min: "{.bytes}"}},
+				},
+			},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	// The values are float64, the labels and comparisons exact
+	expected := []string{
+		`counter_bytes{id="18446744073709551615"} 9.007199254740992e+15`,
+		`counter_bytes{id="18446744073709551614"} 9.007199254740992e+15`,
+		`last{id="18446744073709551614"} 1`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e+"\n") {
+			t.Fatalf("Large integers test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+}
+
+func TestHashLabels(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"accounts": [{"id": "acct-1", "region": "eu", "balance": 10}, {"region": "us", "balance": 20}], "ids": ["acct-1", "acct-2"], "balances": [10, 20]}`)
+	}))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL, nil)
+	recorder := httptest.NewRecorder()
+	hash := map[string]config.LabelHash{"account": {Hash: config.LabelHashSHA256, Length: 12}}
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				AllowMissingKeys: true,
+				Metrics: []config.Metric{
+					{Name: "account", Path: "{.accounts[*]}", Type: config.ObjectScrape, ValueType: config.ValueTypeGauge, Help: "account", Labels: map[string]string{"account": "{.id}", "region": "{.region}"}, HashLabels: hash, Values: map[string]string{"balance": "{.balance}"}},
+					{Name: "zipped", Path: "{.balances[*]}", Type: config.ZipScrape, ValueType: config.ValueTypeGauge, Help: "zipped", IndexLabel: "index", Labels: map[string]string{"account": "{.ids[*]}"}, HashLabels: hash},
+				},
+			},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	// The first 12 hex digits of the sha256 of acct-1 and acct-2
+	expected := []string{
+		`account_balance{account="ba36a4edd92d",region="eu"} 10`,
+		`account_balance{account="",region="us"} 20`,
+		`zipped{account="ba36a4edd92d",index="0"} 10`,
+		`zipped{account="e19576827aa4",index="1"} 20`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e+"\n") {
+			t.Fatalf("Hash labels test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+	if strings.Contains(string(body), "acct-") {
+		t.Fatalf("Hash labels test fails unexpectedly, got label values in clear:\n%s", body)
+	}
+}
+
+func TestLabelCase(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"hosts": [{"env": "PROD", "name": "Web-1", "up": 1}, {"env": "prod", "name": "web-2", "up": 0}, {"env": "Staging", "name": "DB-1", "up": 1}], "envs": ["Prod", "STAGING"], "counts": [2, 1]}`)
+	}))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL, nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				Metrics: []config.Metric{
+					{Name: "host", Path: "{.hosts[*]}", Type: config.ObjectScrape, ValueType: config.ValueTypeGauge, Help: "host", Labels: map[string]string{"env": "{.env}", "name": "{.name}"}, LabelCase: map[string]config.LabelCase{"env": config.LabelCaseLower, "name": config.LabelCaseUpper}, Values: map[string]string{"up": "{.up}"}},
+					{Name: "hosts", Path: "{.counts[*]}", Type: config.ZipScrape, ValueType: config.ValueTypeGauge, Help: "hosts", Labels: map[string]string{"env": "{.envs[*]}"}, LabelCase: map[string]config.LabelCase{"env": config.LabelCaseLower}},
+				},
+			},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	expected := []string{
+		`host_up{env="prod",name="WEB-1"} 1`,
+		`host_up{env="prod",name="WEB-2"} 0`,
+		`host_up{env="staging",name="DB-1"} 1`,
+		`hosts{env="prod"} 2`,
+		`hosts{env="staging"} 1`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e+"\n") {
+			t.Fatalf("Label case test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"versions": [{"name": "v1.0 beta", "build": 3}, {"name": "v1.1", "build": 7}], "temperature": 21.5}`)
+	}))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL, nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				Metrics: []config.Metric{
+					{Name: "first_build", Path: "{.versions[*].build}", Type: config.ValueScrape, Help: "first_build", Match: config.MatchFirst, Labels: map[string]string{"name": "{.versions[0].name}"}},
+					{Name: "last_build", Path: "{.versions[*].build}", Type: config.ValueScrape, Help: "last_build", Match: config.MatchLast},
+					{Name: "any_build", Path: "{.versions[*].build}", Type: config.ValueScrape, Help: "any_build"},
+					{Name: "temperature", Path: "{.temperature}", Type: config.ValueScrape, Help: "temperature", Match: config.MatchLast},
+					{Name: "missing", Path: "{.versions[?(@.build > 10.0)].build}", Type: config.ValueScrape, Help: "missing", Match: config.MatchFirst},
+				},
+			},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	expected := []string{
+		`first_build{name="v1.0 beta"} 3`,
+		"last_build 7",
+		"temperature 21.5",
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e+"\n") {
+			t.Fatalf("Match test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+	// Several matches fail without match, and none gives no value
+	for _, name := range []string{"any_build", "missing"} {
+		if strings.Contains(string(body), "\n"+name+" ") {
+			t.Fatalf("Match test fails unexpectedly, unexpected %s in:\n%s", name, body)
+		}
+	}
+}
+
+func TestCheckMonotonic(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"totals": [1, 5, "x", 3, 7, 18446744073709551615, 18446744073709551614], "racks": [{"rack": "a", "total": 10}, {"rack": "b", "total": 9}]}`)
+	}))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL, nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				Metrics: []config.Metric{
+					{Name: "total", Path: "{.totals[*]}", Type: config.ValueScrape, ValueType: config.ValueTypeCounter, Help: "total", Multi: true, IndexLabel: "index", CheckMonotonic: true},
+					{Name: "rack_total", Path: "{.racks[*].total}", Type: config.ValueScrape, ValueType: config.ValueTypeCounter, Help: "rack_total", Multi: true, IndexLabel: "index", SiblingLabels: map[string]string{"rack": "{.rack}"}, CheckMonotonic: true},
+				},
+			},
+		},
+	}
+	decreases := testutil.ToFloat64(exporter.CounterDecreasesTotal.WithLabelValues("total"))
+	rackDecreases := testutil.ToFloat64(exporter.CounterDecreasesTotal.WithLabelValues("rack_total"))
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	// The values are emitted all the same, the invalid one skipped, and the
+	// integers beyond 2^53 compared exactly
+	if !strings.Contains(string(body), `total{index="3"} 3`+"\n") {
+		t.Fatalf("Check monotonic test fails unexpectedly, expected the decreasing value in:\n%s", body)
+	}
+	if got := testutil.ToFloat64(exporter.CounterDecreasesTotal.WithLabelValues("total")) - decreases; got != 2 {
+		t.Fatalf("Check monotonic test fails unexpectedly, expected 2 decreases, got %v", got)
+	}
+	if got := testutil.ToFloat64(exporter.CounterDecreasesTotal.WithLabelValues("rack_total")) - rackDecreases; got != 1 {
+		t.Fatalf("Check monotonic test fails unexpectedly, expected 1 rack decrease, got %v", got)
+	}
+}
+
+func TestCharset(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=ISO-8859-1")
+		// "Zürich" in ISO-8859-1
+		w.Write([]byte("{\"city\": \"Z\xfcrich\", \"temperature\": 12}"))
+	}))
+	defer target.Close()
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL, nil)
+	recorder := httptest.NewRecorder()
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				Metrics: []config.Metric{
+					{Name: "temperature", Path: "{.temperature}", Type: config.ValueScrape, Help: "temperature", Labels: map[string]string{"city": "{.city}"}},
+				},
+			},
+		},
+	}
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	if expected := `temperature{city="Zürich"} 12`; !strings.Contains(string(body), expected+"\n") {
+		t.Fatalf("Charset test fails unexpectedly, expected %q in:\n%s", expected, body)
+	}
+}
+
+func TestAutoModule(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		fetched []string
+	)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/v1":
+			fmt.Fprint(w, `{"version": 1, "count": 5}`)
+		case "/v2":
+			fmt.Fprint(w, `{"version": 2, "stats": {"count": 7}}`)
+		case "/v3":
+			fmt.Fprint(w, `{"version": 3, "stats": {"count": 9}}`)
+		case "/api/version":
+			fmt.Fprint(w, `{"api": "v2"}`)
+		case "/api/stats":
+			// Only answered to the headers of the selected module
+			if r.Header.Get("X-Api") != "v2" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, `{"stats": {"count": 11}}`)
+		}
+	}))
+	defer target.Close()
+
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"v1": {
+				Metrics: []config.Metric{{Name: "count", Path: "{.count}", Help: "count", Type: config.ValueScrape}},
+			},
+			"v2": {
+				Headers: map[string]string{"X-Api": "v2"},
+				Metrics: []config.Metric{{Name: "count", Path: "{.stats.count}", Help: "count", Type: config.ValueScrape}},
+			},
+			"auto": {
+				AutoModule: config.AutoModule{
+					Discriminator: "{.version}",
+					Modules:       map[string]string{"1": "v1", "2": "v2"},
+				},
+			},
+			"auto_path": {
+				AutoModule: config.AutoModule{
+					Discriminator: "{.api}",
+					Path:          "/api/version",
+					Modules:       map[string]string{"v1": "v1"},
+					Default:       "v2",
+				},
+			},
+			"auto_path_v1": {
+				AutoModule: config.AutoModule{
+					Discriminator: "{.api}",
+					Path:          "/api/version",
+					Modules:       map[string]string{"v1": "v1"},
+				},
+			},
+		},
+	}
+	if errs := exporter.ValidateConfig(c, ""); len(errs) != 0 {
+		t.Fatalf("Auto module test fails unexpectedly, invalid config: %v", errs)
+	}
+
+	tests := []struct {
+		Module          string
+		Path            string
+		ExpectedStatus  int
+		Expected        string
+		ExpectedFetches []string
+	}{
+		{"auto", "/v1", http.StatusOK, "count 5", []string{"/v1"}},
+		{"auto", "/v2", http.StatusOK, "count 7", []string{"/v2"}},
+		{"auto", "/v3", http.StatusServiceUnavailable, `no module for discriminator value "3"`, []string{"/v3"}},
+		// The target is fetched once the module is selected, with its headers
+		{"auto_path", "/api/stats", http.StatusOK, "count 11", []string{"/api/version", "/api/stats"}},
+		// and not at all if none is
+		{"auto_path_v1", "/api/stats", http.StatusServiceUnavailable, `no module for discriminator value "v2"`, []string{"/api/version"}},
+	}
+	for i, test := range tests {
+		mu.Lock()
+		fetched = nil
+		mu.Unlock()
+		req := httptest.NewRequest("GET", "http://example.com/foo"+"?module="+test.Module+"&target="+target.URL+test.Path, nil)
+		recorder := httptest.NewRecorder()
+		probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+		resp := recorder.Result()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != test.ExpectedStatus {
+			t.Fatalf("Auto module test %d fails unexpectedly, got status %d: %s", i, resp.StatusCode, body)
+		}
+		if !strings.Contains(string(body), test.Expected) {
+			t.Fatalf("Auto module test %d fails unexpectedly, expected %q in:\n%s", i, test.Expected, body)
+		}
+		mu.Lock()
+		if !reflect.DeepEqual(fetched, test.ExpectedFetches) {
+			t.Fatalf("Auto module test %d fails unexpectedly, fetched %v, expected %v", i, fetched, test.ExpectedFetches)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestSSHTunnel(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPublicKey, err := ssh.NewPublicKey(&clientKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An SSH server only forwarding TCP connections for the client key
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), clientPublicKey.Marshal()) {
+				return nil, fmt.Errorf("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	serverConfig.AddHostKey(hostSigner)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var forwarded atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for newChannel := range chans {
+					var forward struct {
+						Host     string
+						Port     uint32
+						OrigHost string
+						OrigPort uint32
+					}
+					if newChannel.ChannelType() != "direct-tcpip" || ssh.Unmarshal(newChannel.ExtraData(), &forward) != nil {
+						newChannel.Reject(ssh.UnknownChannelType, "unsupported")
+						continue
+					}
+					targetConn, err := net.Dial("tcp", net.JoinHostPort(forward.Host, strconv.Itoa(int(forward.Port))))
+					if err != nil {
+						newChannel.Reject(ssh.ConnectionFailed, err.Error())
+						continue
+					}
+					channel, requests, err := newChannel.Accept()
+					if err != nil {
+						targetConn.Close()
+						continue
+					}
+					forwarded.Add(1)
+					go ssh.DiscardRequests(requests)
+					go func() {
+						io.Copy(channel, targetConn)
+						channel.Close()
+					}()
+					go func() {
+						io.Copy(targetConn, channel)
+						targetConn.Close()
+					}()
+				}
+			}()
+		}
+	}()
+
+	dir := t.TempDir()
+	keyDER, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_ecdsa")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	if err := os.WriteFile(knownHostsFile, []byte(knownhosts.Line([]string{knownhosts.Normalize(listener.Addr().String())}, hostSigner.PublicKey())+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	otherKnownHostsFile := filepath.Join(dir, "other_known_hosts")
+	if err := os.WriteFile(otherKnownHostsFile, []byte(knownhosts.Line([]string{knownhosts.Normalize(listener.Addr().String())}, clientPublicKey)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Tunnel     config.SSHTunnel
+		StatusCode int
+	}{
+		{config.SSHTunnel{Host: listener.Addr().String(), User: "foo", KeyFile: keyFile, KnownHostsFile: knownHostsFile}, http.StatusOK},
+		{config.SSHTunnel{Host: listener.Addr().String(), User: "foo", KeyFile: keyFile, InsecureIgnoreHostKey: true}, http.StatusOK},
+		{config.SSHTunnel{Host: listener.Addr().String(), User: "foo", KeyFile: keyFile, KnownHostsFile: otherKnownHostsFile}, http.StatusServiceUnavailable},
+		{config.SSHTunnel{Host: listener.Addr().String(), User: "foo", KeyFile: keyFile}, http.StatusServiceUnavailable},
+	}
+	for i, test := range tests {
+		forwarded.Store(0)
+		c := config.Config{
+			Modules: map[string]config.Module{
+				"default": {
+					SSHTunnel: test.Tunnel,
+					Metrics: []config.Metric{
+						{Name: "counter", Path: "{.counter}", Type: config.ValueScrape, ValueType: config.ValueTypeGauge, Help: "counter"},
+					},
+				},
+			},
+		}
+		req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/good.json", nil)
+		recorder := httptest.NewRecorder()
+		probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+		resp := recorder.Result()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != test.StatusCode {
+			t.Fatalf("SSH tunnel test %d fails unexpectedly, expected status %d, got %d:\n%s", i, test.StatusCode, resp.StatusCode, body)
+		}
+		if test.StatusCode == http.StatusOK && (forwarded.Load() == 0 || !strings.Contains(string(body), "counter ")) {
+			t.Fatalf("SSH tunnel test %d fails unexpectedly, expected the target fetched through the tunnel, got %d forwarded connections:\n%s", i, forwarded.Load(), body)
+		}
+	}
+}
+
+func TestGenerateConfig(t *testing.T) {
+	target := httptest.NewServer(http.FileServer(http.Dir("../test")))
+	defer target.Close()
+
+	var generated bytes.Buffer
+	if err := writeGeneratedConfig(&generated, "../test/serve/good.json"); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(file, generated.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := config.LoadConfig(file, config.ValueTypeUntyped)
+	if err != nil {
+		t.Fatalf("Generate config test fails unexpectedly, generated config not loaded: %s\n%s", err, generated.String())
+	}
+	if errs := exporter.ValidateConfig(c, ""); len(errs) != 0 {
+		t.Fatalf("Generate config test fails unexpectedly, generated config invalid: %v\n%s", errs, generated.String())
+	}
+
+	req := httptest.NewRequest("GET", "http://example.com/foo"+"?module=default&target="+target.URL+"/serve/good.json", nil)
+	recorder := httptest.NewRecorder()
+
+	probeHandler(recorder, req, promslog.NewNopLogger(), c)
+
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	expected := []string{
+		`counter 1234`,
+		`values_count{id="id-A",state="ACTIVE"} 1`,
+		`values_some_boolean{id="id-C",state="ACTIVE"} 0`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e+"\n") {
+			t.Fatalf("Generate config test fails unexpectedly, expected %q in:\n%s", e, body)
+		}
+	}
+
+	for _, sample := range []string{`{"location": "mars"}`, `[]`, `{`} {
+		if _, err := generateConfig([]byte(sample)); err == nil {
+			t.Fatalf("Generate config test fails unexpectedly, config generated from %s", sample)
+		}
+	}
+	c, err = generateConfig([]byte(`{"disk usage": {"used GB": 3}, "loads": [1, 2], "hosts": [{"name": "a", "up": 1, "os": {"name": "linux", "cores": 4}}, {"name": "b", "up": 0}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := exporter.ValidateConfig(c, ""); len(errs) != 0 {
+		t.Fatalf("Generate config test fails unexpectedly, generated config invalid: %v", errs)
+	}
+	metrics := c.Modules["default"].Metrics
+	if len(metrics) != 3 || metrics[0].Path != "{['disk usage']['used GB']}" || metrics[0].Name != "disk_usage_used_gb" || !metrics[2].Multi || len(metrics[1].Values) != 1 || len(metrics[1].Labels) != 1 {
+		t.Fatalf("Generate config test fails unexpectedly, got metrics %+v", metrics)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"error": "down"}`)
+			return
+		}
+		fmt.Fprint(w, `{"up": 1}`)
+	}))
+	defer target.Close()
+
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"default": {
+				Metrics: []config.Metric{{Name: "up", Path: "{.up}", Help: "up"}},
+			},
+		},
+	}
+	probe := func(path string) {
+		req := httptest.NewRequest("GET", "http://example.com/foo"+"?target="+target.URL+path, nil)
+		probeHandler(httptest.NewRecorder(), req, promslog.NewNopLogger(), c)
+	}
+	readEntries := func(file string) []auditEntry {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Failed to read audit log: %s", err)
+		}
+		var entries []auditEntry
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var entry auditEntry
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("Invalid audit log line %q: %s", line, err)
+			}
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "audit.log")
+	a, err := openAuditLog(file, false)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %s", err)
+	}
+	auditor = a
+	defer func() { auditor = nil }()
+
+	probe("/ok")
+	probe("/fail")
+
+	entries := readEntries(file)
+	if len(entries) != 2 {
+		t.Fatalf("Audit log test fails unexpectedly, expected 2 entries, got %d", len(entries))
+	}
+	if e := entries[0]; e.Module != "default" || e.Target != target.URL+"/ok" || e.Method != http.MethodGet || e.StatusCode != http.StatusOK || e.Bytes != 9 || e.Error != "" || e.Body != nil {
+		t.Fatalf("Audit log test fails unexpectedly, got entry %+v", e)
+	}
+	if e := entries[1]; e.StatusCode != http.StatusInternalServerError || e.Bytes != 0 || e.Error != "500 Internal Server Error" {
+		t.Fatalf("Audit log test fails unexpectedly, got entry %+v", e)
+	}
+
+	// A rotated file is left alone once reopened, the bodies being written if
+	// enabled
+	if err := os.Rename(file, file+".1"); err != nil {
+		t.Fatalf("Failed to rotate audit log: %s", err)
+	}
+	a.bodies = true
+	if err := a.reopen(); err != nil {
+		t.Fatalf("Failed to reopen audit log: %s", err)
+	}
+	probe("/ok")
+
+	if entries := readEntries(file + ".1"); len(entries) != 2 {
+		t.Fatalf("Audit log test fails unexpectedly, expected 2 entries in the rotated file, got %d", len(entries))
+	}
+	entries = readEntries(file)
+	if len(entries) != 1 || entries[0].Body == nil || *entries[0].Body != `{"up": 1}` {
+		t.Fatalf("Audit log test fails unexpectedly, got entries %+v", entries)
+	}
+}
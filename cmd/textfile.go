@@ -0,0 +1,220 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus-community/json_exporter/config"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// A target probed on an interval, whose metrics are written to a file for the
+// textfile collector of the node exporter
+type textfileTarget struct {
+	module string
+	target string
+}
+
+// Parses the '<module>=<url>' textfile targets. Each module, or comma
+// separated list of modules, is written to its own file, so it can only be
+// given once.
+func parseTextfileTargets(specs []string, c config.Config) ([]textfileTarget, error) {
+	var targets []textfileTarget
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		module, target, ok := strings.Cut(spec, "=")
+		if !ok || module == "" || target == "" {
+			return nil, fmt.Errorf("invalid textfile target %q, expected <module>=<url>", spec)
+		}
+		for _, m := range strings.Split(module, ",") {
+			if _, ok := c.Modules[m]; !ok {
+				return nil, fmt.Errorf("unknown module %q in textfile target %q", m, spec)
+			}
+		}
+		if seen[module] {
+			return nil, fmt.Errorf("module %q is given more than one textfile target", module)
+		}
+		seen[module] = true
+		targets = append(targets, textfileTarget{module: module, target: target})
+	}
+	return targets, nil
+}
+
+// Returns the name of the file the metrics of the target are written to
+func (t textfileTarget) fileName() string {
+	return "json_exporter_" + strings.ReplaceAll(t.module, ",", "_") + ".prom"
+}
+
+// Probes the targets every interval, until the context is done, writing their
+// metrics to the directory. The files of the targets failing for longer than
+// staleAfter, if set, are removed.
+func runTextfile(ctx context.Context, logger *slog.Logger, c config.Config, targets []textfileTarget, dir string, interval, staleAfter time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, t := range targets {
+			if err := writeTextfile(ctx, logger, c, t, dir); err != nil {
+				logger.Error("Failed to write textfile", "module", t.module, "target", t.target, "err", err)
+				if staleAfter > 0 {
+					if err := removeStaleTextfile(logger, t, dir, staleAfter); err != nil {
+						logger.Error("Failed to remove stale textfile", "module", t.module, "target", t.target, "err", err)
+					}
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Probes the target and atomically replaces its file with the resulting
+// metrics, so that the node exporter never reads a partial file. The file is
+// left as is when the probe fails.
+func writeTextfile(ctx context.Context, logger *slog.Logger, c config.Config, t textfileTarget, dir string) error {
+	query := url.Values{"module": {t.module}, "target": {t.target}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/probe?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	w := &bufferResponseWriter{header: http.Header{}, status: http.StatusOK}
+	probeHandler(w, req, logger, c)
+	if w.status != http.StatusOK {
+		return fmt.Errorf("probe failed with status %d: %s", w.status, strings.TrimSpace(w.body.String()))
+	}
+
+	metrics, err := stripTimestamps(w.body.Bytes())
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+t.fileName()+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(metrics); err != nil {
+		tmp.Close()
+		return err
+	}
+	// Readable by the node exporter, as the temporary file is private
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, t.fileName()))
+}
+
+// Returns the metrics of a probe without their timestamps, which the textfile
+// collector rejects. Of the samples of a series at several timestamps, such as
+// the historical samples of the timeseries metrics, only the latest is kept.
+func stripTimestamps(data []byte) ([]byte, error) {
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		family := families[name]
+		latest := make(map[string]int)
+		var metrics []*dto.Metric
+		for _, m := range family.Metric {
+			var series strings.Builder
+			for _, label := range m.Label {
+				fmt.Fprintf(&series, "%q=%q,", label.GetName(), label.GetValue())
+			}
+			if i, ok := latest[series.String()]; ok {
+				if m.GetTimestampMs() >= metrics[i].GetTimestampMs() {
+					metrics[i] = m
+				}
+				continue
+			}
+			latest[series.String()] = len(metrics)
+			metrics = append(metrics, m)
+		}
+		for _, m := range metrics {
+			m.TimestampMs = nil
+		}
+		family.Metric = metrics
+		if _, err := expfmt.MetricFamilyToText(&buf, family); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// Removes the file of the target if it was last written more than staleAfter
+// ago. As each file is replaced as a whole, the series missing from the last
+// probe are already dropped: only the file of a target failing to be probed
+// would keep the series of its last successful probe forever.
+func removeStaleTextfile(logger *slog.Logger, t textfileTarget, dir string, staleAfter time.Duration) error {
+	name := filepath.Join(dir, t.fileName())
+	info, err := os.Stat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if time.Since(info.ModTime()) <= staleAfter {
+		return nil
+	}
+	logger.Info("Removing stale textfile", "module", t.module, "target", t.target, "written", info.ModTime())
+	return os.Remove(name)
+}
+
+// Records the response of a probe in memory
+type bufferResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *bufferResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
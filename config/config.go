@@ -14,9 +14,16 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	pconfig "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
 	"gopkg.in/yaml.v2"
 )
 
@@ -24,21 +31,180 @@ import (
 type Metric struct {
 	Name           string
 	Path           string
-	Labels         map[string]string
+	Labels         map[string]string `yaml:",omitempty"`
 	Type           ScrapeType
-	ValueType      ValueType
-	EpochTimestamp string
-	Help           string
-	Values         map[string]string
+	ValueType      ValueType         `yaml:",omitempty"`
+	EpochTimestamp string            `yaml:",omitempty"`
+	Help           string            `yaml:",omitempty"`
+	Values         map[string]string `yaml:",omitempty"`
+	Multi          bool              `yaml:",omitempty"`
+	Invert         bool              `yaml:",omitempty"`
+	IndexLabel     string            `yaml:"index_label,omitempty"`
+	KeyLabel       string            `yaml:"key_label,omitempty"`
+	SiblingLabels  map[string]string `yaml:"sibling_labels,omitempty"`
+	NumberFormat   *NumberFormat     `yaml:"number_format,omitempty"`
+	StaticLabels   map[string]string `yaml:"static_labels,omitempty"`
+	// Scale multiplies the values, 1 by default, before Offset is added to
+	// them, e.g. to convert millidegrees to degrees
+	Scale  *float64 `yaml:"scale,omitempty"`
+	Offset float64  `yaml:"offset,omitempty"`
+	// JoinLabels maps the labels whose path matches several values to the
+	// separator joining all of them
+	JoinLabels map[string]string `yaml:"join_labels,omitempty"`
+	// HashLabels maps the labels whose values are hashed to their hash
+	HashLabels map[string]LabelHash `yaml:"hash_labels,omitempty"`
+	// LabelCase maps the labels whose values are converted to lower or upper
+	// case to the case
+	LabelCase map[string]LabelCase `yaml:"label_case,omitempty"`
+	// StatusCode makes a value metric of the status code of the response,
+	// instead of a value of the data
+	StatusCode bool `yaml:"status_code,omitempty"`
+	// Cookie makes a value metric of the value of the cookie of this name
+	// set by the response, instead of a value of the data
+	Cookie string `yaml:"cookie,omitempty"`
+	// Select keeps a single element of those matched by the path
+	Select Select `yaml:"select,omitempty"`
+	// CheckMonotonic reports the matches of a multi value counter lower than
+	// the value matched before them
+	CheckMonotonic bool `yaml:"check_monotonic,omitempty"`
+	// EmitUpdateTimestamp sends the timestamp of EpochTimestamp as a
+	// companion gauge instead of the sample timestamp of the metric
+	EmitUpdateTimestamp bool `yaml:"emit_update_timestamp,omitempty"`
+	// Match keeps the first or last of the values matched by the path of a
+	// value metric, which otherwise fails on several matches
+	Match Match `yaml:"match,omitempty"`
+	// RequireAllPaths skips the series for which the value or a label path
+	// matches nothing, or null, instead of emitting them with empty labels
+	RequireAllPaths bool `yaml:"require_all_paths,omitempty"`
+	// KeyPattern is the regular expression of the keys counted by a key_count
+	// metric, which counts all of them without one
+	KeyPattern string `yaml:"key_pattern,omitempty"`
+	// Filter keeps only the elements of an object metric for which the value
+	// at this path is true
+	Filter string `yaml:"filter,omitempty"`
+	// ValueTypePath reads the value type of each series from the data,
+	// falling back to ValueType
+	ValueTypePath string `yaml:"value_type_path,omitempty"`
+	// Engine evaluates the path and the labels of the metric, as json paths
+	// by default
+	Engine EngineType `yaml:"engine,omitempty"`
+	// AllowRecursiveDescent allows the '..' operator in the paths of the
+	// metric, whose matches are then capped by MaxMatches
+	AllowRecursiveDescent bool          `yaml:"allow_recursive_descent,omitempty"`
+	MaxMatches            int           `yaml:"max_matches,omitempty"`
+	Dynamic               DynamicMetric `yaml:"dynamic,omitempty"`
+	Ratio                 Ratio         `yaml:"ratio,omitempty"`
+}
+
+// LabelHash hashes the values of a label, e.g. to keep personal data out of
+// Prometheus. Length truncates the hex digest, if set.
+type LabelHash struct {
+	Hash   string `yaml:"hash"`
+	Length int    `yaml:"length,omitempty"`
+}
+
+// LabelHashSHA256 is the only hash of the label values supported
+const LabelHashSHA256 = "sha256"
+
+// LabelCase is the case the values of a label are converted to
+type LabelCase string
+
+const (
+	LabelCaseLower LabelCase = "lower"
+	LabelCaseUpper LabelCase = "upper"
+)
+
+// EngineType is the language of the path and the labels of a metric
+type EngineType string
+
+const (
+	EngineTypeJSONPath EngineType = "jsonpath"
+	// EngineTypeCEL evaluates the path and the labels as CEL expressions on
+	// the whole document, bound to the variable data.
+	EngineTypeCEL EngineType = "cel"
+)
+
+// Match is the value a value metric keeps when its path matches several
+type Match string
+
+const (
+	MatchFirst Match = "first"
+	MatchLast  Match = "last"
+)
+
+// Ratio holds the json paths of the numerator and denominator of a ratio
+// metric, evaluated against each matched element. Percent scales the ratio
+// from 0..1 to 0..100.
+type Ratio struct {
+	Numerator   string `yaml:"numerator,omitempty"`
+	Denominator string `yaml:"denominator,omitempty"`
+	Percent     bool   `yaml:"percent,omitempty"`
+}
+
+// Select keeps the element with the greatest value at the Max path, or the
+// least value at the Min path, e.g. the latest of timestamped elements. The
+// values are compared as numbers if they all are, or else as strings.
+type Select struct {
+	Max string `yaml:"max,omitempty"`
+	Min string `yaml:"min,omitempty"`
+}
+
+// DynamicMetric holds the json paths of the name, value, help and type of
+// the series of a dynamic metric, evaluated against each matched element.
+// Without a name path, the matched elements are maps of names to values.
+type DynamicMetric struct {
+	Name  string `yaml:"name,omitempty"`
+	Value string `yaml:"value,omitempty"`
+	Help  string `yaml:"help,omitempty"`
+	Type  string `yaml:"type,omitempty"`
+}
+
+// NumberFormat describes how the numbers of a metric are written, when they
+// are not plain numbers
+type NumberFormat struct {
+	// Regex extracts the number from the value, using its first capture
+	// group if any, or else the whole match
+	Regex              string `yaml:"regex,omitempty"`
+	ThousandsSeparator string `yaml:"thousands_separator,omitempty"`
+	DecimalSeparator   string `yaml:"decimal_separator,omitempty"`
+	// Units maps the unit suffixes of the number to their multiplier
+	Units map[string]float64 `yaml:"units,omitempty"`
 }
 
 type ScrapeType string
 
 const (
-	ValueScrape  ScrapeType = "value" // default
-	ObjectScrape ScrapeType = "object"
+	ValueScrape      ScrapeType = "value" // default
+	ObjectScrape     ScrapeType = "object"
+	TimeseriesScrape ScrapeType = "timeseries"
+	// ZipScrape pairs the values matched by the path with the label values
+	// matched by the label paths, by position.
+	ZipScrape ScrapeType = "zip"
+	// DynamicScrape reads the names of the metrics from the data.
+	DynamicScrape ScrapeType = "dynamic"
+	// RatioScrape divides a numerator by a denominator, for each element
+	// matched by the path, or for the whole document without a path.
+	RatioScrape ScrapeType = "ratio"
+	// InfoScrape exposes the strings of each element matched by the path, or
+	// of the whole document without a path, in labels of a series of value 1.
+	InfoScrape ScrapeType = "info"
+	// KeyCountScrape counts the keys of each object matched by the path, or
+	// of the whole document without a path, matching the KeyPattern.
+	KeyCountScrape ScrapeType = "key_count"
 )
 
+// DefaultRecursiveDescentMaxMatches caps the matches of the metrics allowing
+// recursive descent, unless overridden by max_matches.
+const DefaultRecursiveDescentMaxMatches = 1000
+
+// DefaultDynamicMaxMatches caps the series of the dynamic metrics, unless
+// overridden by max_matches.
+const DefaultDynamicMaxMatches = 1000
+
+// DefaultIndexLabel is the label holding the position of each match of a
+// multi value scrape, unless overridden by index_label.
+const DefaultIndexLabel = "index"
+
 type ValueType string
 
 const (
@@ -47,6 +213,57 @@ const (
 	ValueTypeUntyped ValueType = "untyped"
 )
 
+type TLSRenegotiation string
+
+const (
+	TLSRenegotiateNever  TLSRenegotiation = "never" // default
+	TLSRenegotiateOnce   TLSRenegotiation = "once"
+	TLSRenegotiateFreely TLSRenegotiation = "freely"
+)
+
+// HTTPVersion selects the HTTP version used to fetch the targets
+type HTTPVersion string
+
+const (
+	HTTPVersion11 HTTPVersion = "1.1" // default
+	// HTTPVersion2 requires HTTP/2, negotiated through TLS, or with prior
+	// knowledge (h2c) for the targets without TLS.
+	HTTPVersion2 HTTPVersion = "2"
+	// HTTPVersionAuto negotiates HTTP/2 through TLS when the target supports
+	// it, and falls back to HTTP/1.1 otherwise.
+	HTTPVersionAuto HTTPVersion = "auto"
+)
+
+type InputFormat string
+
+const (
+	InputFormatJSON InputFormat = "json" // default
+	// InputFormatNDJSONStream reads newline delimited json objects from a
+	// streaming response, for at most the read duration of the module.
+	InputFormatNDJSONStream InputFormat = "ndjson_stream"
+	// InputFormatSSE reads the json data of server-sent events from a
+	// streaming response, for at most the read duration of the module.
+	InputFormatSSE InputFormat = "sse"
+	// InputFormatURLEncoded reads a form encoded response, such as
+	// 'status=ok&count=42', as a flat json object.
+	InputFormatURLEncoded InputFormat = "urlencoded"
+	// InputFormatGRPCWeb sends the body as a gRPC-Web request with the json
+	// codec, and reads the json messages from the framed response.
+	InputFormatGRPCWeb InputFormat = "grpc_web"
+)
+
+// EmptyBodyPolicy tells how a response with an empty body is handled
+type EmptyBodyPolicy string
+
+const (
+	// EmptyBodyError fails the probe
+	EmptyBodyError EmptyBodyPolicy = "error"
+	// EmptyBodySkip succeeds without any metric
+	EmptyBodySkip EmptyBodyPolicy = "skip"
+	// EmptyBodyEmptyObject scrapes the response as '{}'
+	EmptyBodyEmptyObject EmptyBodyPolicy = "empty_object"
+)
+
 // Config contains multiple modules.
 type Config struct {
 	Modules map[string]Module `yaml:"modules"`
@@ -54,43 +271,268 @@ type Config struct {
 
 // Module contains metrics and headers defining a configuration
 type Module struct {
-	Headers          map[string]string        `yaml:"headers,omitempty"`
-	Metrics          []Metric                 `yaml:"metrics"`
-	HTTPClientConfig pconfig.HTTPClientConfig `yaml:"http_client_config,omitempty"`
-	Body             Body                     `yaml:"body,omitempty"`
-	ValidStatusCodes []int                    `yaml:"valid_status_codes,omitempty"`
+	Headers             map[string]string        `yaml:"headers,omitempty"`
+	Metrics             []Metric                 `yaml:"metrics"`
+	BasePath            string                   `yaml:"base_path,omitempty"`
+	DefaultLabels       map[string]string        `yaml:"default_labels,omitempty"`
+	HTTPClientConfig    pconfig.HTTPClientConfig `yaml:"http_client_config,omitempty"`
+	Body                Body                     `yaml:"body,omitempty"`
+	ValidStatusCodes    []int                    `yaml:"valid_status_codes,omitempty"`
+	InjectMetaLabels    bool                     `yaml:"inject_meta_labels,omitempty"`
+	RejectDuplicateKeys bool                     `yaml:"reject_duplicate_keys,omitempty"`
+	TLSRenegotiation    TLSRenegotiation         `yaml:"tls_renegotiation,omitempty"`
+	TimestampFromHeader string                   `yaml:"timestamp_from_header,omitempty"`
+	TailBytes           int64                    `yaml:"tail_bytes,omitempty"`
+	TLSCertRules        []TLSCertRule            `yaml:"tls_cert_rules,omitempty"`
+	InputFormat         InputFormat              `yaml:"input_format,omitempty"`
+	ReadDuration        model.Duration           `yaml:"read_duration,omitempty"`
+	MetricNamePrefix    string                   `yaml:"metric_name_prefix,omitempty"`
+	Namespace           string                   `yaml:"namespace,omitempty"`
+	Subsystem           string                   `yaml:"subsystem,omitempty"`
+	ConditionalHeaders  []ConditionalHeaders     `yaml:"conditional_headers,omitempty"`
+	Timeout             model.Duration           `yaml:"timeout,omitempty"`
+	RequireContentType  string                   `yaml:"require_content_type,omitempty"`
+	ErrorPath           string                   `yaml:"error_path,omitempty"`
+	MaxRedirects        int                      `yaml:"max_redirects,omitempty"`
+	OnEmptyBody         EmptyBodyPolicy          `yaml:"on_empty_body,omitempty"`
+	EmitOnFailure       map[string]float64       `yaml:"emit_on_failure,omitempty"`
+	RequestIDHeader     string                   `yaml:"request_id_header,omitempty"`
+	ForwardTraceContext bool                     `yaml:"forward_trace_context,omitempty"`
+	StripJSONP          bool                     `yaml:"strip_jsonp,omitempty"`
+	NonFiniteLiterals   bool                     `yaml:"non_finite_literals,omitempty"`
+	Charset             string                   `yaml:"charset,omitempty"`
+	TemplatizePaths     bool                     `yaml:"templatize_paths,omitempty"`
+	HTTPVersion         HTTPVersion              `yaml:"http_version,omitempty"`
+	HTTP3               bool                     `yaml:"http3,omitempty"`
+	Debounce            model.Duration           `yaml:"debounce,omitempty"`
+	InvalidJSONRetries  int                      `yaml:"invalid_json_retries,omitempty"`
+	AllowMissingKeys    bool                     `yaml:"allow_missing_keys,omitempty"`
+	Batch               Batch                    `yaml:"batch,omitempty"`
+	PreRequest          PreRequest               `yaml:"pre_request,omitempty"`
+	SSHTunnel           SSHTunnel                `yaml:"ssh_tunnel,omitempty"`
+	AutoModule          AutoModule               `yaml:"auto_module,omitempty"`
+}
+
+// AutoModule collects the metrics of the module mapped to the value at the
+// Discriminator path, e.g. the API version of the target, instead of metrics
+// of its own. The value is read from the response of the request to Path,
+// resolved against the target, if set, or else from the response of the
+// target. The values not in Modules get the Default module, if any.
+type AutoModule struct {
+	Discriminator string            `yaml:"discriminator,omitempty"`
+	Path          string            `yaml:"path,omitempty"`
+	Modules       map[string]string `yaml:"modules,omitempty"`
+	Default       string            `yaml:"default,omitempty"`
+}
+
+// SSHTunnel dials the targets through an SSH bastion Host, 'host:port' or
+// port 22 by default, as User authenticated by the private key in KeyFile.
+// The host key of the bastion is checked against KnownHostsFile, unless
+// InsecureIgnoreHostKey is set.
+type SSHTunnel struct {
+	Host                  string `yaml:"host,omitempty"`
+	User                  string `yaml:"user,omitempty"`
+	KeyFile               string `yaml:"key_file,omitempty"`
+	KnownHostsFile        string `yaml:"known_hosts_file,omitempty"`
+	InsecureIgnoreHostKey bool   `yaml:"insecure_ignore_host_key,omitempty"`
+}
+
+// PreRequest is sent before the fetches of a module to open a session, e.g. to
+// log in. The cookies set by its response, and its CaptureHeaders, are sent
+// along the fetches until SessionTTL expires or the target answers 401.
+type PreRequest struct {
+	Method         string            `yaml:"method,omitempty"`
+	Path           string            `yaml:"path,omitempty"`
+	Body           string            `yaml:"body,omitempty"`
+	Headers        map[string]string `yaml:"headers,omitempty"`
+	CaptureHeaders []string          `yaml:"capture_headers,omitempty"`
+	SessionTTL     model.Duration    `yaml:"session_ttl,omitempty"`
+}
+
+// Batch splits a batch response into independent documents, against which
+// the metrics of the module are evaluated. Path matches the elements of the
+// batch, ID and Body are evaluated against each element: the ID is exposed in
+// the IDLabel of the metrics, and the Body, the whole element if unset, is the
+// document.
+type Batch struct {
+	Path    string `yaml:"path,omitempty"`
+	ID      string `yaml:"id,omitempty"`
+	IDLabel string `yaml:"id_label,omitempty"`
+	Body    string `yaml:"body,omitempty"`
+}
+
+// DefaultBatchIDLabel is the label holding the ID of the documents of a batch,
+// unless overridden by id_label.
+const DefaultBatchIDLabel = "id"
+
+// ConditionalHeaders are only sent to the targets matching Match
+type ConditionalHeaders struct {
+	Match   TargetMatch       `yaml:"match"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+// TargetMatch matches a target by its scheme and by a glob pattern on its
+// host. Empty fields match any target.
+type TargetMatch struct {
+	Scheme string `yaml:"scheme,omitempty"`
+	Host   string `yaml:"host,omitempty"`
+}
+
+// TLSCertRule selects the TLS client certificate used for the targets whose
+// host matches a pattern
+type TLSCertRule struct {
+	Host     string `yaml:"host"`
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
 }
 
 type Body struct {
-	Content    string `yaml:"content"`
-	Templatize bool   `yaml:"templatize,omitempty"`
+	Content string `yaml:"content"`
+	// JSON is serialized to the content instead, as json, with its strings
+	// rendered as templates if Templatize is set
+	JSON             interface{} `yaml:"json,omitempty"`
+	Templatize       bool        `yaml:"templatize,omitempty"`
+	SafeFunctions    bool        `yaml:"safe_functions,omitempty"`
+	AllowedFunctions []string    `yaml:"allowed_functions,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (b *Body) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Body
+	if err := unmarshal((*plain)(b)); err != nil {
+		return err
+	}
+	b.JSON = stringKeys(b.JSON)
+	return nil
 }
 
-func LoadConfig(configPath string) (Config, error) {
-	var config Config
-	data, err := os.ReadFile(configPath)
+// Returns the value decoded from yaml with the keys of its maps made strings,
+// as yaml decodes maps with keys of any type, which cannot be marshaled to
+// json
+func stringKeys(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = stringKeys(value)
+		}
+		return m
+	case []interface{}:
+		for i, value := range v {
+			v[i] = stringKeys(value)
+		}
+	}
+	return value
+}
+
+// LoadConfig loads the config file, using defaultValueType as the value type
+// of the metrics which do not set one. The path can also be a directory, whose
+// .yml and .yaml files are loaded, or a glob pattern. The modules of all the
+// files are merged, and a module defined in several files is an error.
+func LoadConfig(configPath string, defaultValueType ValueType) (Config, error) {
+	config := Config{Modules: map[string]Module{}}
+	files, err := configFiles(configPath)
 	if err != nil {
 		return config, err
 	}
 
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		return config, err
+	definedIn := make(map[string]string)
+	for _, file := range files {
+		var c Config
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return config, err
+		}
+		if err := yaml.Unmarshal(data, &c); err != nil {
+			return config, fmt.Errorf("%s: %w", file, err)
+		}
+		for name, module := range c.Modules {
+			if other, ok := definedIn[name]; ok {
+				return config, fmt.Errorf("module %q is defined in both %s and %s", name, other, file)
+			}
+			definedIn[name] = file
+			config.Modules[name] = module
+		}
 	}
 
 	// Complete Defaults
-	for _, module := range config.Modules {
+	for name, module := range config.Modules {
+		if module.Batch.Path != "" && module.Batch.IDLabel == "" {
+			module.Batch.IDLabel = DefaultBatchIDLabel
+			config.Modules[name] = module
+		}
 		for i := 0; i < len(module.Metrics); i++ {
 			if module.Metrics[i].Type == "" {
 				module.Metrics[i].Type = ValueScrape
 			}
-			if module.Metrics[i].Help == "" {
+			// The help of the series of dynamic metrics defaults to their name
+			if module.Metrics[i].Help == "" && module.Metrics[i].Type != DynamicScrape {
 				module.Metrics[i].Help = module.Metrics[i].Name
 			}
 			if module.Metrics[i].ValueType == "" {
-				module.Metrics[i].ValueType = ValueTypeUntyped
+				module.Metrics[i].ValueType = defaultValueType
+			}
+			if module.Metrics[i].Multi && module.Metrics[i].IndexLabel == "" {
+				module.Metrics[i].IndexLabel = DefaultIndexLabel
+			}
+			if module.Metrics[i].AllowRecursiveDescent && module.Metrics[i].MaxMatches == 0 {
+				module.Metrics[i].MaxMatches = DefaultRecursiveDescentMaxMatches
+			}
+			if module.Metrics[i].Type == DynamicScrape && module.Metrics[i].MaxMatches == 0 {
+				module.Metrics[i].MaxMatches = DefaultDynamicMaxMatches
 			}
 		}
 	}
 
 	return config, nil
 }
+
+// Hash returns a hash of the module, stable across restarts, so that the
+// config version live can be told apart. It is made of the first 48 bits of
+// the sha256 of the module in yaml, which a float64 holds exactly. Secrets are
+// masked when marshaled, so that changing only a secret keeps the hash.
+func (m Module) Hash() (float64, error) {
+	data, err := yaml.Marshal(m)
+	if err != nil {
+		return 0, err
+	}
+	sum := sha256.Sum256(data)
+	return float64(binary.BigEndian.Uint64(sum[:8]) >> 16), nil
+}
+
+// Returns the config files at the given path, sorted. A path which is not a
+// directory nor an existing file is used as a glob pattern, if it is one.
+func configFiles(configPath string) ([]string, error) {
+	info, err := os.Stat(configPath)
+	switch {
+	case err != nil && !strings.ContainsAny(configPath, "*?["):
+		return nil, err
+	case err == nil && !info.IsDir():
+		return []string{configPath}, nil
+	case err == nil:
+		var files []string
+		for _, pattern := range []string{"*.yml", "*.yaml"} {
+			matches, err := filepath.Glob(filepath.Join(configPath, pattern))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, matches...)
+		}
+		sort.Strings(files)
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no config file in directory %s", configPath)
+		}
+		return files, nil
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+
+	files, err := filepath.Glob(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no config file matching %s", configPath)
+	}
+	return files, nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestDefaultValueType(t *testing.T) {
+	tests := []struct {
+		DefaultValueType ValueType
+		ExpectedOutput   []ValueType
+	}{
+		{ValueTypeUntyped, []ValueType{ValueTypeUntyped, ValueTypeCounter}},
+		{ValueTypeGauge, []ValueType{ValueTypeGauge, ValueTypeCounter}},
+	}
+
+	for i, test := range tests {
+		c, err := LoadConfig("../test/config/default-value-type.yml", test.DefaultValueType)
+		if err != nil {
+			t.Fatalf("Default value type test %d failed with an unexpected error: %s", i, err)
+		}
+		for j, metric := range c.Modules["default"].Metrics {
+			if metric.ValueType != test.ExpectedOutput[j] {
+				t.Fatalf("Default value type test %d fails unexpectedly for metric %s.\nGOT:\n%s\nEXPECTED:\n%s", i, metric.Name, metric.ValueType, test.ExpectedOutput[j])
+			}
+		}
+	}
+}
+
+func TestLoadConfigFiles(t *testing.T) {
+	tests := []struct {
+		Path            string
+		ExpectedModules []string
+		ShouldSucceed   bool
+	}{
+		{"../test/config/good.yml", []string{"default"}, true},
+		{"../test/config/split", []string{"animals", "default"}, true},
+		{"../test/config/split/*.yml", []string{"animals"}, true},
+		// Both files define the default module
+		{"../test/config/*.yml", nil, false},
+		{"../test/config/missing.yml", nil, false},
+		{"../test/config/split/*.json", nil, false},
+	}
+
+	for i, test := range tests {
+		c, err := LoadConfig(test.Path, ValueTypeUntyped)
+		if err != nil && test.ShouldSucceed {
+			t.Fatalf("Config files test %d failed with an unexpected error: %s", i, err)
+		}
+		if err == nil && !test.ShouldSucceed {
+			t.Fatalf("Config files test %d succeeded unexpectedly", i)
+		}
+		var modules []string
+		for name := range c.Modules {
+			modules = append(modules, name)
+		}
+		sort.Strings(modules)
+		if test.ShouldSucceed && !reflect.DeepEqual(modules, test.ExpectedModules) {
+			t.Fatalf("Config files test %d fails unexpectedly.\nGOT:\n%v\nEXPECTED:\n%v", i, modules, test.ExpectedModules)
+		}
+	}
+
+	// A missing file which is not a glob pattern keeps the error of the file
+	if _, err := LoadConfig("../test/config/missing.yml", ValueTypeUntyped); !errors.Is(err, os.ErrNotExist) || !strings.Contains(err.Error(), "../test/config/missing.yml") {
+		t.Fatalf("Config files test fails unexpectedly, expected the error of the missing file, got %v", err)
+	}
+}
+
+func TestModuleHash(t *testing.T) {
+	c, err := LoadConfig("../test/config/good.yml", ValueTypeUntyped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	module := c.Modules["default"]
+	hash, err := module.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash <= 0 || hash >= 1<<48 || hash != float64(uint64(hash)) {
+		t.Fatalf("Module hash test fails unexpectedly, got %v", hash)
+	}
+
+	c, _ = LoadConfig("../test/config/good.yml", ValueTypeUntyped)
+	if again, _ := c.Modules["default"].Hash(); again != hash {
+		t.Fatalf("Module hash test fails unexpectedly, hash not stable: %v != %v", again, hash)
+	}
+
+	module.Metrics = append(module.Metrics[:len(module.Metrics):len(module.Metrics)], Metric{Name: "other", Path: "{.other}"})
+	if changed, _ := module.Hash(); changed == hash {
+		t.Fatal("Module hash test fails unexpectedly, hash unchanged by a new metric")
+	}
+}
+
+func TestBodyJSON(t *testing.T) {
+	c, err := LoadConfig("../test/config/body-json.yml", ValueTypeUntyped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		t.Fatalf("Body json test fails unexpectedly, config not marshaled to json: %s", err)
+	}
+	expected := `"JSON":{"limit":10,"query":{"filters":[{"field":"status","values":["ok","degraded"]}]},"true":"status","weights":{"1":0.5,"2":0.25}}`
+	if !strings.Contains(string(data), expected) {
+		t.Fatalf("Body json test fails unexpectedly, expected %s in:\n%s", expected, data)
+	}
+}
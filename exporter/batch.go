@@ -0,0 +1,89 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/prometheus-community/json_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// BatchCollector collects the metrics of the documents of a batch response.
+// The metrics are described once, by the collector of the whole response.
+type BatchCollector struct {
+	JSONMetricCollector
+	Documents []JSONMetricCollector
+}
+
+func (bc BatchCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, d := range bc.Documents {
+		d.Collect(ch)
+	}
+}
+
+// SplitBatch returns a collector for each document of the batch response of
+// the collector, with the ID of the document in the batch id label.
+func (mc JSONMetricCollector) SplitBatch(batch config.Batch) ([]JSONMetricCollector, error) {
+	var jsonData interface{}
+	if err := unmarshalData(mc.Data, &jsonData); err != nil {
+		return nil, err
+	}
+	elements, err := extractObjects(nil, mc.Logger, jsonData, batch.Path, false)
+	if err != nil {
+		return nil, err
+	}
+
+	label := batchIDLabel(batch)
+	documents := make([]JSONMetricCollector, 0, len(elements))
+	for i, element := range elements {
+		var id string
+		if batch.ID != "" {
+			if id, err = extractValue(nil, mc.Logger, element, batch.ID, false); err != nil {
+				return nil, fmt.Errorf("failed to extract the id of batch element %d: %w", i, err)
+			}
+		}
+		body := element
+		if batch.Body != "" {
+			bodies, err := extractObjects(nil, mc.Logger, element, batch.Body, false)
+			if err != nil {
+				return nil, fmt.Errorf("failed to extract the body of batch element %d: %w", i, err)
+			}
+			if len(bodies) != 1 {
+				return nil, fmt.Errorf("body path %s matched %d nodes in batch element %d, expected one", batch.Body, len(bodies), i)
+			}
+			body = bodies[0]
+		}
+
+		d := mc
+		if d.Data, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+		d.MetaLabelValues = make(map[string]string, len(mc.MetaLabelValues)+1)
+		for k, v := range mc.MetaLabelValues {
+			d.MetaLabelValues[k] = v
+		}
+		d.MetaLabelValues[label] = id
+		documents = append(documents, d)
+	}
+	return documents, nil
+}
+
+func batchIDLabel(batch config.Batch) string {
+	if batch.IDLabel == "" {
+		return config.DefaultBatchIDLabel
+	}
+	return batch.IDLabel
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// DistinctLabelValuesMetric counts the distinct values of each label of each
+// metric of a probe.
+const DistinctLabelValuesMetric = "json_distinct_label_values"
+
+var (
+	labelLabel  = "label"
+	metricLabel = "metric"
+)
+
+// CardinalityGatherer gathers the metrics of Gatherer along with the number
+// of distinct values of each of their labels, to catch the fields which are
+// accidentally of high cardinality before they reach Prometheus.
+//
+// The count is computed on the gathered families, once the metrics of all the
+// modules of the probe, including the timeseries ones, are known.
+type CardinalityGatherer struct {
+	Gatherer prometheus.Gatherer
+}
+
+func (g CardinalityGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	if err != nil {
+		return mfs, err
+	}
+
+	name, help := DistinctLabelValuesMetric, "Number of distinct values of a label of a metric in this probe."
+	mf := &dto.MetricFamily{
+		Name: &name,
+		Help: &help,
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	for _, family := range mfs {
+		if family.GetName() == DistinctLabelValuesMetric {
+			return mfs, fmt.Errorf("metric %s conflicts with the cardinality metrics", DistinctLabelValuesMetric)
+		}
+		values := make(map[string]map[string]struct{})
+		for _, m := range family.Metric {
+			for _, lp := range m.Label {
+				if values[lp.GetName()] == nil {
+					values[lp.GetName()] = make(map[string]struct{})
+				}
+				values[lp.GetName()][lp.GetValue()] = struct{}{}
+			}
+		}
+		labels := make([]string, 0, len(values))
+		for label := range values {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		for _, label := range labels {
+			label, count := label, float64(len(values[label]))
+			mf.Metric = append(mf.Metric, &dto.Metric{
+				Label: []*dto.LabelPair{
+					{Name: &labelLabel, Value: &label},
+					{Name: &metricLabel, Value: family.Name},
+				},
+				Gauge: &dto.Gauge{Value: &count},
+			})
+		}
+	}
+	if len(mf.Metric) == 0 {
+		return mfs, nil
+	}
+
+	mfs = append(mfs, mf)
+	sort.Slice(mfs, func(i, j int) bool {
+		return mfs[i].GetName() < mfs[j].GetName()
+	})
+	return mfs, nil
+}
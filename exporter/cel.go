@@ -0,0 +1,104 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+// The environment of the CEL expressions, with the decoded document bound to
+// the variable data
+var celEnv = sync.OnceValues(func() (*cel.Env, error) {
+	return cel.NewEnv(cel.Variable("data", cel.DynType))
+})
+
+// Returns the compiled program of the CEL expression, from the cache if any.
+// The programs are safe for concurrent use and shared by all the scrapes.
+func (c *JSONPaths) program(expr string) (cel.Program, error) {
+	if c != nil {
+		if prg, ok := c.programs.Load(expr); ok {
+			return prg.(cel.Program), nil
+		}
+	}
+
+	env, err := celEnv()
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := env.Compile(expr)
+	if issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	prg, err := env.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+	if c != nil {
+		c.programs.Store(expr, prg)
+	}
+	return prg, nil
+}
+
+// Evaluates the program on the data, which is the decoded json document
+func evalCEL(prg cel.Program, data interface{}) (ref.Val, error) {
+	out, _, err := prg.Eval(map[string]interface{}{"data": data})
+	return out, err
+}
+
+// Returns the numeric result of the program, booleans counting as 1 and 0
+// as they do in json paths
+func extractCELValue(prg cel.Program, data interface{}) (float64, error) {
+	out, err := evalCEL(prg, data)
+	if err != nil {
+		return 0, err
+	}
+	switch v := out.(type) {
+	case types.Double:
+		return float64(v), nil
+	case types.Int:
+		return float64(v), nil
+	case types.Uint:
+		return float64(v), nil
+	case types.Bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("CEL result of type %s is not a number", out.Type().TypeName())
+}
+
+// Returns the results of the label programs as strings, empty for those
+// which fail as for missing json paths
+func extractCELLabels(logger *slog.Logger, data interface{}, programs []cel.Program, exprs []string) []string {
+	labels := make([]string, len(programs))
+	for i, prg := range programs {
+		out, err := evalCEL(prg, data)
+		if err == nil {
+			if s, ok := out.ConvertToType(types.StringType).(types.String); ok {
+				labels[i] = string(s)
+				continue
+			}
+			err = fmt.Errorf("CEL result of type %s is not a string", out.Type().TypeName())
+		}
+		logger.Error("Failed to evaluate CEL label", "err", err, "expr", exprs[i])
+	}
+	return labels
+}
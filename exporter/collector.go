@@ -16,125 +16,759 @@ package exporter
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"log/slog"
+	"math"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/google/cel-go/cel"
 	"github.com/prometheus-community/json_exporter/config"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"k8s.io/client-go/util/jsonpath"
 )
 
+// CounterDecreasesTotal counts the matches of the multi value counters checked
+// for monotonicity which are lower than the value matched before them.
+var CounterDecreasesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "json_counter_decreases_total",
+	Help: "Number of matches of multi value counters lower than the value matched before them, by metric.",
+}, []string{"metric"})
+
 type JSONMetricCollector struct {
-	JSONMetrics []JSONMetric
-	Data        []byte
-	Logger      *slog.Logger
+	JSONMetrics     []JSONMetric
+	Data            []byte
+	StatusCode      int
+	Cookies         []*http.Cookie
+	MetaLabelValues map[string]string
+	Timestamp       time.Time
+	Logger          *slog.Logger
+	// The value types read from the data during a collection, by metric
+	valueTypes map[*prometheus.Desc]prometheus.ValueType
 }
 
 type JSONMetric struct {
-	Desc                   *prometheus.Desc
-	Type                   config.ScrapeType
-	KeyJSONPath            string
-	ValueJSONPath          string
-	LabelsJSONPaths        []string
+	Desc            *prometheus.Desc
+	Name            string
+	Help            string
+	Type            config.ScrapeType
+	KeyJSONPath     string
+	ValueJSONPath   string
+	LabelsJSONPaths []string
+	// The separators of the labels joining all their matches, by position
+	// in LabelsJSONPaths
+	LabelSeparators map[int]string
+	// The hashes of the hashed labels, by position in LabelsJSONPaths
+	LabelHashes            map[int]config.LabelHash
+	LabelCases             map[int]config.LabelCase
+	MetaLabels             []string
 	ValueType              prometheus.ValueType
 	EpochTimestampJSONPath string
+	Multi                  bool
+	IndexLabel             string
+	KeyLabel               string
+	ParentJSONPath         string
+	ValueField             string
+	SiblingLabelsJSONPaths []string
+	NumberFormat           *NumberFormat
+	Invert                 bool
+	MaxMatches             int
+	StaticLabels           map[string]string
+	// The label names of a dynamic metric, which has no Desc until collected
+	LabelNames []string
+	Dynamic    config.DynamicMetric
+	Ratio      config.Ratio
+	// The keys counted by a key_count metric
+	KeyPattern *regexp.Regexp
+	StatusCode bool
+	Cookie     string
+	// Reads the value type of each series from the data, if set
+	ValueTypeJSONPath string
+	Select            config.Select
+	// The values are multiplied by Scale, unless zero, and added Offset
+	Scale  float64
+	Offset float64
+	// The cache of the parsed json paths, shared by the metrics of a config
+	Paths *JSONPaths
+	// The compiled path and labels of a metric whose engine is CEL
+	EngineType       config.EngineType
+	CELProgram       cel.Program
+	CELLabelPrograms []cel.Program
+	// Keeps only the elements for which the value at this path is true
+	FilterJSONPath string
+	// Skips the series for which a value or label path matches nothing
+	RequireAllPaths bool
+	// Missing keys give empty labels and NaN values instead of errors
+	AllowMissingKeys bool
+	// Keeps the first or last of several values matched by a value metric
+	Match config.Match
+	// Reports the matches of a multi value counter lower than the previous
+	CheckMonotonic bool
+	// The gauge the timestamp of the data is sent as, instead of the sample
+	// timestamp, if set
+	UpdateTimestampDesc *prometheus.Desc
+	// The number of metrics, from this one on, which are the values of the
+	// same object metric, collected in a single pass over its elements. Only
+	// set on the first of them.
+	SharedValues int
 }
 
 func (mc JSONMetricCollector) Describe(ch chan<- *prometheus.Desc) {
 	for _, m := range mc.JSONMetrics {
+		// Described as they are collected, see DynamicCollector
+		if m.Type == config.DynamicScrape {
+			continue
+		}
 		ch <- m.Desc
+		if m.UpdateTimestampDesc != nil {
+			ch <- m.UpdateTimestampDesc
+		}
 	}
 }
 
 func (mc JSONMetricCollector) Collect(ch chan<- prometheus.Metric) {
+	// The status code and the cookies are collected even when the data is
+	// not valid json
 	for _, m := range mc.JSONMetrics {
+		if m.StatusCode {
+			metric := prometheus.MustNewConstMetric(m.Desc, m.ValueType, float64(mc.StatusCode), mc.labelValues(m, nil, "", 0)...)
+			mc.sendMetric(ch, m, nil, metric)
+		}
+		if m.Cookie != "" {
+			mc.collectCookie(ch, m)
+		}
+	}
+
+	// Parse the data once, all the json paths are evaluated on the parsed value
+	var jsonData interface{}
+	if err := unmarshalData(mc.Data, &jsonData); err != nil {
+		mc.Logger.Error("Failed to unmarshal data to json", "err", err, "data", mc.Data)
+		return
+	}
+
+	mc.valueTypes = make(map[*prometheus.Desc]prometheus.ValueType)
+	for i := 0; i < len(mc.JSONMetrics); i++ {
+		m := mc.JSONMetrics[i]
 		switch m.Type {
 		case config.ValueScrape:
-			value, err := extractValue(mc.Logger, mc.Data, m.KeyJSONPath, false)
+			if m.StatusCode || m.Cookie != "" {
+				continue
+			}
+			if m.Multi {
+				mc.collectMultiValue(ch, m, jsonData)
+				continue
+			}
+			if m.EngineType == config.EngineTypeCEL {
+				mc.collectCEL(ch, m, jsonData)
+				continue
+			}
+			if !mc.resolvesAllPaths(m, jsonData, m.KeyJSONPath) {
+				continue
+			}
+			value, err := extractMatch(m.Paths, mc.Logger, jsonData, m.KeyJSONPath, m.AllowMissingKeys, m.Match)
 			if err != nil {
 				mc.Logger.Error("Failed to extract value for metric", "path", m.KeyJSONPath, "err", err, "metric", m.Desc)
 				continue
 			}
 
-			if floatValue, err := SanitizeValue(value); err == nil {
+			if floatValue, err := m.parseValue(value); err == nil {
+				valueType, ok := mc.valueType(m, jsonData)
+				if !ok {
+					continue
+				}
 				metric := prometheus.MustNewConstMetric(
 					m.Desc,
-					m.ValueType,
+					valueType,
 					floatValue,
-					extractLabels(mc.Logger, mc.Data, m.LabelsJSONPaths)...,
+					mc.labelValues(m, jsonData, "", 0)...,
 				)
-				ch <- timestampMetric(mc.Logger, m, mc.Data, metric)
+				mc.sendMetric(ch, m, jsonData, metric)
 			} else {
 				mc.Logger.Error("Failed to convert extracted value to float64", "path", m.KeyJSONPath, "value", value, "err", err, "metric", m.Desc)
 				continue
 			}
 
 		case config.ObjectScrape:
-			values, err := extractValue(mc.Logger, mc.Data, m.KeyJSONPath, true)
+			values := mc.JSONMetrics[i:min(i+max(m.SharedValues, 1), len(mc.JSONMetrics))]
+			mc.collectObjects(ch, values, jsonData)
+			i += len(values) - 1
+		case config.ZipScrape:
+			mc.collectZip(ch, m, jsonData)
+		case config.RatioScrape:
+			mc.collectRatio(ch, m, jsonData)
+		case config.InfoScrape:
+			mc.collectInfo(ch, m, jsonData)
+		case config.KeyCountScrape:
+			mc.collectKeyCount(ch, m, jsonData)
+		case config.TimeseriesScrape:
+			// Gathered separately, see TimeseriesGatherer
+			continue
+		case config.DynamicScrape:
+			// Collected separately, see DynamicCollector
+			continue
+		default:
+			mc.Logger.Error("Unknown scrape config type", "type", m.Type, "metric", m.Desc)
+			continue
+		}
+	}
+}
+
+// Emits one series per object matching the json path of an object scrape, for
+// each of its values. The objects, and their labels, are extracted once for
+// all the values, which share the path and labels of the first one.
+func (mc JSONMetricCollector) collectObjects(ch chan<- prometheus.Metric, values []JSONMetric, jsonData interface{}) {
+	m := values[0]
+	objects, err := m.extractMatches(mc.Logger, jsonData, m.KeyJSONPath)
+	if err != nil {
+		mc.Logger.Error("Failed to extract json objects for metric", "err", err, "metric", m.Desc)
+		return
+	}
+
+	var keys []string
+	if m.KeyLabel != "" {
+		keys, objects = mc.expandKeyedObjects(m, objects)
+	}
+	// The filtered elements keep their position in the index label, so that
+	// their series do not change as other elements are filtered out
+	var positions []int
+	if m.FilterJSONPath != "" {
+		positions, objects, keys = mc.filterElements(m, objects, keys)
+	}
+	if m.Select != (config.Select{}) {
+		i, ok := m.selectElement(mc.Logger, objects)
+		if !ok {
+			return
+		}
+		objects = objects[i : i+1]
+		if keys != nil {
+			keys = keys[i : i+1]
+		}
+		positions = nil
+	}
+
+	for i, data := range objects {
+		var key string
+		if keys != nil {
+			key = keys[i]
+		}
+		index := i
+		if positions != nil {
+			index = positions[i]
+		}
+		var labels []string
+		for _, v := range values {
+			if !mc.resolvesAllPaths(v, data, v.ValueJSONPath) {
+				continue
+			}
+			value, err := extractValue(v.Paths, mc.Logger, data, v.ValueJSONPath, v.AllowMissingKeys)
 			if err != nil {
-				mc.Logger.Error("Failed to extract json objects for metric", "err", err, "metric", m.Desc)
+				mc.Logger.Error("Failed to extract value for metric", "path", v.ValueJSONPath, "err", err, "metric", v.Desc)
 				continue
 			}
 
-			var jsonData []interface{}
-			if err := json.Unmarshal([]byte(values), &jsonData); err == nil {
-				for _, data := range jsonData {
-					jdata, err := json.Marshal(data)
-					if err != nil {
-						mc.Logger.Error("Failed to marshal data to json", "path", m.ValueJSONPath, "err", err, "metric", m.Desc, "data", data)
-						continue
-					}
-					value, err := extractValue(mc.Logger, jdata, m.ValueJSONPath, false)
-					if err != nil {
-						mc.Logger.Error("Failed to extract value for metric", "path", m.ValueJSONPath, "err", err, "metric", m.Desc)
-						continue
-					}
-
-					if floatValue, err := SanitizeValue(value); err == nil {
-						metric := prometheus.MustNewConstMetric(
-							m.Desc,
-							m.ValueType,
-							floatValue,
-							extractLabels(mc.Logger, jdata, m.LabelsJSONPaths)...,
-						)
-						ch <- timestampMetric(mc.Logger, m, jdata, metric)
-					} else {
-						mc.Logger.Error("Failed to convert extracted value to float64", "path", m.ValueJSONPath, "value", value, "err", err, "metric", m.Desc)
-						continue
-					}
-				}
-			} else {
-				mc.Logger.Error("Failed to convert extracted objects to json", "err", err, "metric", m.Desc)
+			floatValue, err := v.parseValue(value)
+			if err != nil {
+				mc.Logger.Error("Failed to convert extracted value to float64", "path", v.ValueJSONPath, "value", value, "err", err, "metric", v.Desc)
+				continue
+			}
+			valueType, ok := mc.valueType(v, data)
+			if !ok {
 				continue
 			}
+			if labels == nil {
+				labels = mc.labelValues(m, data, key, index)
+			}
+			metric := prometheus.MustNewConstMetric(
+				v.Desc,
+				valueType,
+				floatValue,
+				labels...,
+			)
+			mc.sendMetric(ch, v, data, metric)
+		}
+	}
+}
+
+// Returns the elements for which the value at the filter path of the metric is
+// true, along with their keys if any, and their positions among all the
+// elements. Elements without the value are filtered out.
+func (mc JSONMetricCollector) filterElements(m JSONMetric, elements []interface{}, keys []string) ([]int, []interface{}, []string) {
+	positions := []int{}
+	var kept []interface{}
+	var keptKeys []string
+	for i, element := range elements {
+		value, err := extractValue(m.Paths, mc.Logger, element, m.FilterJSONPath, true)
+		if err != nil || value == "" {
+			continue
+		}
+		ok, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			mc.Logger.Error("Failed to parse filter value as a boolean", "path", m.FilterJSONPath, "value", value, "metric", m.Desc)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		positions = append(positions, i)
+		kept = append(kept, element)
+		if keys != nil {
+			keptKeys = append(keptKeys, keys[i])
+		}
+	}
+	return positions, kept, keptKeys
+}
+
+// Replaces each matched map by its entries, sorted by key, and returns the keys
+// along with the inner values
+func (mc JSONMetricCollector) expandKeyedObjects(m JSONMetric, objects []interface{}) ([]string, []interface{}) {
+	keys := []string{}
+	var values []interface{}
+	for _, object := range objects {
+		entries, ok := object.(map[string]interface{})
+		if !ok {
+			mc.Logger.Error("Failed to iterate keyed objects, matched value is not a json object", "path", m.KeyJSONPath, "metric", m.Desc)
+			continue
+		}
+		sorted := make([]string, 0, len(entries))
+		for key := range entries {
+			sorted = append(sorted, key)
+		}
+		sort.Strings(sorted)
+		for _, key := range sorted {
+			keys = append(keys, key)
+			values = append(values, entries[key])
+		}
+	}
+	return keys, values
+}
+
+// Emits the result of the CEL program of a value metric, evaluated on the
+// whole document
+func (mc JSONMetricCollector) collectCEL(ch chan<- prometheus.Metric, m JSONMetric, data interface{}) {
+	value, err := extractCELValue(m.CELProgram, data)
+	if err != nil {
+		mc.Logger.Error("Failed to evaluate CEL expression for metric", "expr", m.KeyJSONPath, "err", err, "metric", m.Desc)
+		return
+	}
+	metric := prometheus.MustNewConstMetric(m.Desc, m.ValueType, m.scale(value), mc.labelValues(m, data, "", 0)...)
+	mc.sendMetric(ch, m, data, metric)
+}
+
+// Emits the value of the cookie of the metric set by the response. A missing
+// cookie is NaN if missing keys are allowed, as for a missing key.
+func (mc JSONMetricCollector) collectCookie(ch chan<- prometheus.Metric, m JSONMetric) {
+	var value string
+	for _, cookie := range mc.Cookies {
+		if cookie.Name == m.Cookie {
+			value = cookie.Value
+			break
+		}
+	}
+	// The error would hold the value, which may be a secret if the cookie
+	// is not the expected one
+	floatValue, err := m.parseValue(value)
+	if err != nil {
+		mc.Logger.Error("Failed to convert cookie value to float64", "cookie", m.Cookie, "metric", m.Desc)
+		return
+	}
+	metric := prometheus.MustNewConstMetric(m.Desc, m.ValueType, floatValue, mc.labelValues(m, nil, "", 0)...)
+	mc.sendMetric(ch, m, nil, metric)
+}
+
+// Emits one series per value matching the json path of a multi value scrape,
+// labeled with the position of the match
+func (mc JSONMetricCollector) collectMultiValue(ch chan<- prometheus.Metric, m JSONMetric, jsonData interface{}) {
+	if len(m.SiblingLabelsJSONPaths) != 0 {
+		mc.collectSiblingValues(ch, m, jsonData)
+		return
+	}
+	values, err := m.extractMatches(mc.Logger, jsonData, m.KeyJSONPath)
+	if err != nil {
+		mc.Logger.Error("Failed to extract values for metric", "path", m.KeyJSONPath, "err", err, "metric", m.Desc)
+		return
+	}
+
+	var last lastMatch
+	for i, data := range values {
+		value := fmt.Sprint(data)
+		floatValue, err := m.parseValue(value)
+		if err != nil {
+			mc.Logger.Error("Failed to convert extracted value to float64", "path", m.KeyJSONPath, "value", value, "err", err, "metric", m.Desc)
+			continue
+		}
+		if m.CheckMonotonic {
+			mc.checkMonotonic(m, &last, i, value, floatValue)
+		}
+		valueType, ok := mc.valueType(m, jsonData)
+		if !ok {
+			continue
+		}
+		metric := prometheus.MustNewConstMetric(
+			m.Desc,
+			valueType,
+			floatValue,
+			mc.labelValues(m, jsonData, "", i)...,
+		)
+		mc.sendMetric(ch, m, jsonData, metric)
+	}
+}
+
+// Emits one series per value matching the json path of a multi value scrape,
+// with sibling labels evaluated against the element holding each value.
+// The elements are matched by the parent path, and the value is read from
+// the last field of the path.
+func (mc JSONMetricCollector) collectSiblingValues(ch chan<- prometheus.Metric, m JSONMetric, jsonData interface{}) {
+	parents, err := m.extractMatches(mc.Logger, jsonData, m.ParentJSONPath)
+	if err != nil {
+		mc.Logger.Error("Failed to extract values for metric", "path", m.KeyJSONPath, "err", err, "metric", m.Desc)
+		return
+	}
+
+	var last lastMatch
+	i := 0
+	for _, parent := range parents {
+		element, ok := parent.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		data, ok := element[m.ValueField]
+		if !ok {
+			continue
+		}
+		value := fmt.Sprint(data)
+		floatValue, err := m.parseValue(value)
+		if err != nil {
+			mc.Logger.Error("Failed to convert extracted value to float64", "path", m.KeyJSONPath, "value", value, "err", err, "metric", m.Desc)
+			i++
+			continue
+		}
+		if m.CheckMonotonic {
+			mc.checkMonotonic(m, &last, i, value, floatValue)
+		}
+		valueType, ok := mc.valueType(m, element)
+		if !ok {
+			i++
+			continue
+		}
+		metric := prometheus.MustNewConstMetric(
+			m.Desc,
+			valueType,
+			floatValue,
+			append(mc.labelValues(m, jsonData, "", i), extractLabels(m.Paths, mc.Logger, element, m.SiblingLabelsJSONPaths, m.AllowMissingKeys)...)...,
+		)
+		mc.sendMetric(ch, m, jsonData, metric)
+		i++
+	}
+}
+
+// The last value matched by a multi value counter checked for monotonicity
+type lastMatch struct {
+	value string
+	float float64
+	ok    bool
+}
+
+// Reports the value matched at the index if it is lower than the last one,
+// which a counter never is, before making it the last one
+func (mc JSONMetricCollector) checkMonotonic(m JSONMetric, last *lastMatch, index int, value string, floatValue float64) {
+	if last.ok && compareNumbers(last.value, value, last.float, floatValue) > 0 {
+		CounterDecreasesTotal.WithLabelValues(m.Name).Inc()
+		mc.Logger.Warn("Counter value lower than the value matched before it", "path", m.KeyJSONPath, "index", index, "value", value, "previous", last.value, "metric", m.Desc)
+	}
+	*last = lastMatch{value: value, float: floatValue, ok: true}
+}
+
+// Emits one series per value matching the json path of a zip scrape, labeled
+// with the label values at the same position. Label paths matching a single
+// value, such as static labels, apply to every series.
+func (mc JSONMetricCollector) collectZip(ch chan<- prometheus.Metric, m JSONMetric, jsonData interface{}) {
+	values, err := m.extractMatches(mc.Logger, jsonData, m.KeyJSONPath)
+	if err != nil {
+		mc.Logger.Error("Failed to extract values for metric", "path", m.KeyJSONPath, "err", err, "metric", m.Desc)
+		return
+	}
+
+	labels := make([][]interface{}, len(m.LabelsJSONPaths))
+	for i, path := range m.LabelsJSONPaths {
+		if labels[i], err = m.extractMatches(mc.Logger, jsonData, path); err != nil {
+			mc.Logger.Error("Failed to extract label values for metric", "path", path, "err", err, "metric", m.Desc)
+			return
+		}
+		if len(labels[i]) != 1 && len(labels[i]) != len(values) {
+			mc.Logger.Error("Failed to zip label values with values of different length", "path", path, "labels", len(labels[i]), "values", len(values), "metric", m.Desc)
+			return
+		}
+	}
+
+	for i, data := range values {
+		value := fmt.Sprint(data)
+		floatValue, err := m.parseValue(value)
+		if err != nil {
+			mc.Logger.Error("Failed to convert extracted value to float64", "path", m.KeyJSONPath, "value", value, "err", err, "metric", m.Desc)
+			continue
+		}
+		labelValues := make([]string, 0, len(labels)+len(m.MetaLabels)+1)
+		for _, l := range labels {
+			if len(l) == 1 {
+				labelValues = append(labelValues, fmt.Sprint(l[0]))
+			} else {
+				labelValues = append(labelValues, fmt.Sprint(l[i]))
+			}
+		}
+		for j, c := range m.LabelCases {
+			labelValues[j] = caseLabel(labelValues[j], c)
+		}
+		for j, hash := range m.LabelHashes {
+			labelValues[j] = hashLabel(labelValues[j], hash)
+		}
+		if m.IndexLabel != "" {
+			labelValues = append(labelValues, strconv.Itoa(i))
+		}
+		for _, name := range m.MetaLabels {
+			labelValues = append(labelValues, mc.MetaLabelValues[name])
+		}
+		valueType, ok := mc.valueType(m, jsonData)
+		if !ok {
+			continue
+		}
+		metric := prometheus.MustNewConstMetric(
+			m.Desc,
+			valueType,
+			floatValue,
+			labelValues...,
+		)
+		mc.sendMetric(ch, m, jsonData, metric)
+	}
+}
+
+// Returns the value type of a series of the metric, read from data with its
+// value type path if any, or else its configured one. As for dynamic metrics,
+// the series of a metric must agree on their type, or else the whole probe
+// would fail to be gathered: a series conflicting with the type of the first
+// one is skipped.
+func (mc JSONMetricCollector) valueType(m JSONMetric, data interface{}) (prometheus.ValueType, bool) {
+	if m.ValueTypeJSONPath == "" {
+		return m.ValueType, true
+	}
+	valueType := m.ValueType
+	if t, err := extractValue(m.Paths, mc.Logger, data, m.ValueTypeJSONPath, m.AllowMissingKeys); err == nil && t != "" {
+		switch config.ValueType(strings.ToLower(t)) {
+		case config.ValueTypeGauge, config.ValueTypeCounter, config.ValueTypeUntyped:
+			valueType = dynamicValueType(t, m.ValueType)
 		default:
-			mc.Logger.Error("Unknown scrape config type", "type", m.Type, "metric", m.Desc)
+			mc.Logger.Error("Unknown value type, using the configured one", "path", m.ValueTypeJSONPath, "type", t, "metric", m.Desc)
+		}
+	}
+	if mc.valueTypes == nil {
+		return valueType, true
+	}
+	if first, ok := mc.valueTypes[m.Desc]; !ok {
+		mc.valueTypes[m.Desc] = valueType
+	} else if first != valueType {
+		mc.Logger.Error("Skipping series with conflicting value type", "path", m.ValueTypeJSONPath, "metric", m.Desc)
+		return 0, false
+	}
+	return valueType, true
+}
+
+// Returns the elements matched by the json path of the metric, or the whole
+// document without a path
+func (mc JSONMetricCollector) elements(m JSONMetric, jsonData interface{}) ([]interface{}, bool) {
+	if m.KeyJSONPath == "" {
+		return []interface{}{jsonData}, true
+	}
+	elements, err := m.extractMatches(mc.Logger, jsonData, m.KeyJSONPath)
+	if err != nil {
+		mc.Logger.Error("Failed to extract json objects for metric", "err", err, "metric", m.Desc)
+		return nil, false
+	}
+	if m.Select != (config.Select{}) {
+		i, ok := m.selectElement(mc.Logger, elements)
+		if !ok {
+			return nil, false
+		}
+		elements = elements[i : i+1]
+	}
+	return elements, true
+}
+
+// Emits a series of value 1 labeled with the strings of each element matched
+// by the json path of an info metric, or of the whole document without a path
+func (mc JSONMetricCollector) collectInfo(ch chan<- prometheus.Metric, m JSONMetric, jsonData interface{}) {
+	elements, ok := mc.elements(m, jsonData)
+	if !ok {
+		return
+	}
+
+	for i, data := range elements {
+		if !mc.resolvesAllPaths(m, data) {
 			continue
 		}
+		metric := prometheus.MustNewConstMetric(
+			m.Desc,
+			m.ValueType,
+			1,
+			mc.labelValues(m, data, "", i)...,
+		)
+		mc.sendMetric(ch, m, data, metric)
 	}
 }
 
-// Returns the last matching value at the given json path
-func extractValue(logger *slog.Logger, data []byte, path string, enableJSONOutput bool) (string, error) {
-	var jsonData interface{}
-	buf := new(bytes.Buffer)
+// Emits one series per object matching the json path of a key count scrape,
+// or a single one for the whole document without a path, holding the number
+// of its keys matching the key pattern. Elements which are not objects are
+// skipped.
+func (mc JSONMetricCollector) collectKeyCount(ch chan<- prometheus.Metric, m JSONMetric, jsonData interface{}) {
+	elements, ok := mc.elements(m, jsonData)
+	if !ok {
+		return
+	}
 
-	j := jsonpath.New("jp")
-	if enableJSONOutput {
-		j.EnableJSONOutput(true)
+	for i, data := range elements {
+		object, ok := data.(map[string]interface{})
+		if !ok {
+			mc.Logger.Error("Failed to count the keys of a value which is not an object", "path", m.KeyJSONPath, "metric", m.Desc)
+			continue
+		}
+		if !mc.resolvesAllPaths(m, data) {
+			continue
+		}
+		count := 0
+		for key := range object {
+			if m.KeyPattern.MatchString(key) {
+				count++
+			}
+		}
+		valueType, ok := mc.valueType(m, data)
+		if !ok {
+			continue
+		}
+		metric := prometheus.MustNewConstMetric(
+			m.Desc,
+			valueType,
+			float64(count),
+			mc.labelValues(m, data, "", i)...,
+		)
+		mc.sendMetric(ch, m, data, metric)
 	}
+}
 
-	if err := json.Unmarshal(data, &jsonData); err != nil {
-		logger.Error("Failed to unmarshal data to json", "err", err, "data", data)
-		return "", err
+// Emits one series per element matching the json path of a ratio scrape, or
+// a single one for the whole document without a path, holding the numerator
+// divided by the denominator. A zero denominator gives NaN.
+func (mc JSONMetricCollector) collectRatio(ch chan<- prometheus.Metric, m JSONMetric, jsonData interface{}) {
+	elements, ok := mc.elements(m, jsonData)
+	if !ok {
+		return
 	}
 
-	if err := j.Parse(path); err != nil {
+	for i, data := range elements {
+		if !mc.resolvesAllPaths(m, data, m.Ratio.Numerator, m.Ratio.Denominator) {
+			continue
+		}
+		var operands [2]float64
+		failed := false
+		for j, path := range []string{m.Ratio.Numerator, m.Ratio.Denominator} {
+			value, err := extractValue(m.Paths, mc.Logger, data, path, m.AllowMissingKeys)
+			if err != nil {
+				mc.Logger.Error("Failed to extract value for metric", "path", path, "err", err, "metric", m.Desc)
+				failed = true
+				break
+			}
+			if operands[j], err = m.parseValue(value); err != nil {
+				mc.Logger.Error("Failed to convert extracted value to float64", "path", path, "value", value, "err", err, "metric", m.Desc)
+				failed = true
+				break
+			}
+		}
+		if failed {
+			continue
+		}
+
+		ratio := math.NaN()
+		if operands[1] != 0 {
+			ratio = operands[0] / operands[1]
+			if m.Ratio.Percent {
+				ratio *= 100
+			}
+		}
+		valueType, ok := mc.valueType(m, data)
+		if !ok {
+			continue
+		}
+		metric := prometheus.MustNewConstMetric(
+			m.Desc,
+			valueType,
+			ratio,
+			mc.labelValues(m, data, "", i)...,
+		)
+		mc.sendMetric(ch, m, data, metric)
+	}
+}
+
+// Converts the extracted value to float64, using the number format of the
+// metric if any, and scales it. NaN values are kept as is.
+func (m JSONMetric) parseValue(value string) (float64, error) {
+	v, err := m.parseNumber(value)
+	if err != nil {
+		return v, err
+	}
+	return m.scale(v), nil
+}
+
+// Applies the scale and the offset of the metric to the value, NaN kept as is
+func (m JSONMetric) scale(v float64) float64 {
+	if math.IsNaN(v) {
+		return v
+	}
+	if m.Scale != 0 {
+		v *= m.Scale
+	}
+	return v + m.Offset
+}
+
+// Converts the extracted value to float64, using the number format of the
+// metric if any. Inverted metrics only accept booleans, and flip them.
+func (m JSONMetric) parseNumber(value string) (float64, error) {
+	if value == "" && m.AllowMissingKeys {
+		return math.NaN(), nil
+	}
+	if m.Invert {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return 0, fmt.Errorf("invert requires a boolean value: %w", err)
+		}
+		if b {
+			return 0, nil
+		}
+		return 1, nil
+	}
+	if m.NumberFormat != nil {
+		return m.NumberFormat.Parse(value)
+	}
+	return SanitizeValue(value)
+}
+
+// Returns the value matching the given json path, evaluated on the already
+// parsed json data. Several matches are returned separated by spaces.
+func extractValue(paths *JSONPaths, logger *slog.Logger, data interface{}, path string, allowMissing bool) (string, error) {
+	buf := new(bytes.Buffer)
+
+	j, err := paths.get(path)
+	if err != nil {
 		logger.Error("Failed to parse jsonpath", "err", err, "path", path, "data", data)
 		return "", err
 	}
+	defer paths.put(path, j)
+	j.AllowMissingKeys(allowMissing)
 
-	if err := j.Execute(buf, jsonData); err != nil {
+	if err := j.Execute(buf, data); err != nil {
 		logger.Error("Failed to execute jsonpath", "err", err, "path", path, "data", data)
 		return "", err
 	}
@@ -147,11 +781,192 @@ func extractValue(logger *slog.Logger, data []byte, path string, enableJSONOutpu
 	return buf.String(), nil
 }
 
+// Returns the first or last value matching the given json path, or all of them
+// as extractValue does if no match is set. Nothing matching gives an empty
+// value.
+func extractMatch(paths *JSONPaths, logger *slog.Logger, data interface{}, path string, allowMissing bool, match config.Match) (string, error) {
+	if match == "" {
+		return extractValue(paths, logger, data, path, allowMissing)
+	}
+
+	j, err := paths.get(path)
+	if err != nil {
+		logger.Error("Failed to parse jsonpath", "err", err, "path", path, "data", data)
+		return "", err
+	}
+	defer paths.put(path, j)
+	j.AllowMissingKeys(allowMissing)
+
+	results, err := j.FindResults(data)
+	if err != nil {
+		logger.Error("Failed to execute jsonpath", "err", err, "path", path, "data", data)
+		return "", err
+	}
+	var matches []reflect.Value
+	for _, result := range results {
+		matches = append(matches, result...)
+	}
+	if len(matches) == 0 {
+		return "", nil
+	}
+	value := matches[0]
+	if match == config.MatchLast {
+		value = matches[len(matches)-1]
+	}
+
+	buf := new(bytes.Buffer)
+	if err := j.PrintResults(buf, []reflect.Value{value}); err != nil {
+		return "", err
+	}
+	if res, err := jsonpath.UnquoteExtend(buf.String()); err == nil {
+		return res, nil
+	}
+	return buf.String(), nil
+}
+
+// Returns all the values matching the given json path, evaluated on the
+// already parsed json data. The values are returned as is, without going
+// through a json round trip.
+func extractObjects(paths *JSONPaths, logger *slog.Logger, data interface{}, path string, allowMissing bool) ([]interface{}, error) {
+	j, err := paths.get(path)
+	if err != nil {
+		logger.Error("Failed to parse jsonpath", "err", err, "path", path, "data", data)
+		return nil, err
+	}
+	defer paths.put(path, j)
+	j.AllowMissingKeys(allowMissing)
+
+	results, err := j.FindResults(data)
+	if err != nil {
+		logger.Error("Failed to execute jsonpath", "err", err, "path", path, "data", data)
+		return nil, err
+	}
+
+	var objects []interface{}
+	for _, result := range results {
+		for _, r := range result {
+			objects = append(objects, r.Interface())
+		}
+	}
+	return objects, nil
+}
+
+// Reports whether the given value paths and the label paths of the metric all
+// match something other than null in the data, if the metric requires all its
+// paths. A series missing some is skipped rather than emitted with empty
+// labels or a NaN value.
+func (mc JSONMetricCollector) resolvesAllPaths(m JSONMetric, data interface{}, valuePaths ...string) bool {
+	if !m.RequireAllPaths {
+		return true
+	}
+	for _, path := range append(valuePaths, m.LabelsJSONPaths...) {
+		if !resolves(m.Paths, data, path) {
+			mc.Logger.Debug("Skipping series with missing path", "path", path, "metric", m.Desc)
+			return false
+		}
+	}
+	return true
+}
+
+// Reports whether every expression of the json path matches something other
+// than null in the data
+func resolves(paths *JSONPaths, data interface{}, path string) bool {
+	j, err := paths.get(path)
+	if err != nil {
+		return false
+	}
+	defer paths.put(path, j)
+	j.AllowMissingKeys(true)
+
+	results, err := j.FindResults(data)
+	if err != nil {
+		return false
+	}
+	for _, result := range results {
+		if len(result) == 0 {
+			return false
+		}
+		for _, r := range result {
+			if !r.IsValid() || r.Interface() == nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Returns all the values matching the given json path, failing when there
+// are more than the maximum matches of the metric, if set
+func (m JSONMetric) extractMatches(logger *slog.Logger, data interface{}, path string) ([]interface{}, error) {
+	objects, err := extractObjects(m.Paths, logger, data, path, m.AllowMissingKeys)
+	if err != nil {
+		return nil, err
+	}
+	if m.MaxMatches > 0 && len(objects) > m.MaxMatches {
+		return nil, fmt.Errorf("path %s matched %d nodes, more than max_matches %d", path, len(objects), m.MaxMatches)
+	}
+	return objects, nil
+}
+
+// Returns the position of the element selected by the greatest, or least,
+// value at the select path of the metric. The values are compared as numbers
+// if they all are, or else as strings. Elements without a value are ignored,
+// and the first of equal elements is selected.
+func (m JSONMetric) selectElement(logger *slog.Logger, elements []interface{}) (int, bool) {
+	path, greatest := m.Select.Max, true
+	if path == "" {
+		path, greatest = m.Select.Min, false
+	}
+
+	var positions []int
+	var keys []string
+	var numbers []float64
+	numeric := true
+	for i, element := range elements {
+		key, err := extractValue(m.Paths, logger, element, path, m.AllowMissingKeys)
+		if err != nil || key == "" {
+			continue
+		}
+		positions = append(positions, i)
+		keys = append(keys, key)
+		if numeric {
+			number, err := SanitizeValue(key)
+			numeric = err == nil && !math.IsNaN(number)
+			numbers = append(numbers, number)
+		}
+	}
+	if len(positions) == 0 {
+		logger.Error("Failed to select an element, no element has a value", "path", path, "metric", m.Desc)
+		return 0, false
+	}
+
+	selected := 0
+	for j := 1; j < len(positions); j++ {
+		var after bool
+		if numeric {
+			c := compareNumbers(keys[j], keys[selected], numbers[j], numbers[selected])
+			after = c > 0
+			if !greatest {
+				after = c < 0
+			}
+		} else {
+			after = keys[j] > keys[selected]
+			if !greatest {
+				after = keys[j] < keys[selected]
+			}
+		}
+		if after {
+			selected = j
+		}
+	}
+	return positions[selected], true
+}
+
 // Returns the list of labels created from the list of provided json paths
-func extractLabels(logger *slog.Logger, data []byte, paths []string) []string {
-	labels := make([]string, len(paths))
-	for i, path := range paths {
-		if result, err := extractValue(logger, data, path, false); err == nil {
+func extractLabels(paths *JSONPaths, logger *slog.Logger, data interface{}, labelPaths []string, allowMissing bool) []string {
+	labels := make([]string, len(labelPaths))
+	for i, path := range labelPaths {
+		if result, err := extractValue(paths, logger, data, path, allowMissing); err == nil {
 			labels[i] = result
 		} else {
 			logger.Error("Failed to extract label value", "err", err, "path", path, "data", data)
@@ -160,20 +975,135 @@ func extractLabels(logger *slog.Logger, data []byte, paths []string) []string {
 	return labels
 }
 
-func timestampMetric(logger *slog.Logger, m JSONMetric, data []byte, pm prometheus.Metric) prometheus.Metric {
+// Returns all the values matching the json path of a label joined by sep,
+// the objects and arrays written as json
+func extractJoinedLabel(paths *JSONPaths, logger *slog.Logger, data interface{}, path, sep string, allowMissing bool) (string, error) {
+	objects, err := extractObjects(paths, logger, data, path, allowMissing)
+	if err != nil {
+		return "", err
+	}
+	values := make([]string, len(objects))
+	for i, object := range objects {
+		if s, ok := object.(string); ok {
+			values[i] = s
+			continue
+		}
+		b, err := json.Marshal(object)
+		if err != nil {
+			logger.Error("Failed to marshal label value", "err", err, "path", path)
+			return "", err
+		}
+		values[i] = string(b)
+	}
+	return strings.Join(values, sep), nil
+}
+
+// Returns the values of all the labels of the given metric, in the order of
+// its Desc: the labels extracted from the data, the key and index labels if
+// any, and the injected meta labels
+func (mc JSONMetricCollector) labelValues(m JSONMetric, data interface{}, key string, index int) []string {
+	var values []string
+	if m.EngineType == config.EngineTypeCEL {
+		values = extractCELLabels(mc.Logger, data, m.CELLabelPrograms, m.LabelsJSONPaths)
+	} else {
+		values = extractLabels(m.Paths, mc.Logger, data, m.LabelsJSONPaths, m.AllowMissingKeys)
+	}
+	for i, sep := range m.LabelSeparators {
+		if joined, err := extractJoinedLabel(m.Paths, mc.Logger, data, m.LabelsJSONPaths[i], sep, m.AllowMissingKeys); err == nil {
+			values[i] = joined
+		}
+	}
+	for i, c := range m.LabelCases {
+		values[i] = caseLabel(values[i], c)
+	}
+	for i, hash := range m.LabelHashes {
+		values[i] = hashLabel(values[i], hash)
+	}
+	if m.KeyLabel != "" {
+		values = append(values, key)
+	}
+	if m.IndexLabel != "" {
+		values = append(values, strconv.Itoa(index))
+	}
+	for _, name := range m.MetaLabels {
+		values = append(values, mc.MetaLabelValues[name])
+	}
+	return values
+}
+
+// Sends the metric with its timestamp. A metric emitting an update timestamp
+// keeps the timestamp of the collector, if any, and is followed by the gauge
+// of the timestamp extracted from the data.
+func (mc JSONMetricCollector) sendMetric(ch chan<- prometheus.Metric, m JSONMetric, data interface{}, pm prometheus.Metric) {
+	if m.UpdateTimestampDesc == nil {
+		ch <- mc.timestampMetric(m, data, pm)
+		return
+	}
+	if mc.Timestamp.IsZero() {
+		ch <- pm
+	} else {
+		ch <- prometheus.NewMetricWithTimestamp(mc.Timestamp, pm)
+	}
+	if timestamp, ok := mc.extractTimestamp(m, data); ok {
+		ch <- updateTimestampMetric{metric: pm, desc: m.UpdateTimestampDesc, timestamp: timestamp}
+	}
+}
+
+// Applies the timestamp extracted from the data to the metric, or else the
+// timestamp of the collector if any
+func (mc JSONMetricCollector) timestampMetric(m JSONMetric, data interface{}, pm prometheus.Metric) prometheus.Metric {
 	if m.EpochTimestampJSONPath == "" {
+		if mc.Timestamp.IsZero() {
+			return pm
+		}
+		return prometheus.NewMetricWithTimestamp(mc.Timestamp, pm)
+	}
+	timestamp, ok := mc.extractTimestamp(m, data)
+	if !ok {
 		return pm
 	}
-	ts, err := extractValue(logger, data, m.EpochTimestampJSONPath, false)
+	return prometheus.NewMetricWithTimestamp(timestamp, pm)
+}
+
+// Returns the epoch timestamp, in milliseconds, at the timestamp path of the
+// metric. Errors are logged.
+func (mc JSONMetricCollector) extractTimestamp(m JSONMetric, data interface{}) (time.Time, bool) {
+	logger := mc.Logger
+	ts, err := extractValue(m.Paths, logger, data, m.EpochTimestampJSONPath, m.AllowMissingKeys)
 	if err != nil {
 		logger.Error("Failed to extract timestamp for metric", "path", m.KeyJSONPath, "err", err, "metric", m.Desc)
-		return pm
+		return time.Time{}, false
+	}
+	if ts == "" && m.AllowMissingKeys {
+		return time.Time{}, false
 	}
 	epochTime, err := SanitizeIntValue(ts)
 	if err != nil {
 		logger.Error("Failed to parse timestamp for metric", "path", m.KeyJSONPath, "err", err, "metric", m.Desc)
-		return pm
+		return time.Time{}, false
 	}
-	timestamp := time.UnixMilli(epochTime)
-	return prometheus.NewMetricWithTimestamp(timestamp, pm)
+	return time.UnixMilli(epochTime), true
+}
+
+// The gauge holding the timestamp of the data of a metric, in seconds, with
+// the labels of the metric
+type updateTimestampMetric struct {
+	metric    prometheus.Metric
+	desc      *prometheus.Desc
+	timestamp time.Time
+}
+
+func (u updateTimestampMetric) Desc() *prometheus.Desc {
+	return u.desc
+}
+
+func (u updateTimestampMetric) Write(out *dto.Metric) error {
+	var m dto.Metric
+	if err := u.metric.Write(&m); err != nil {
+		return err
+	}
+	value := float64(u.timestamp.UnixMilli()) / 1000
+	out.Label = m.Label
+	out.Gauge = &dto.Gauge{Value: &value}
+	return nil
 }
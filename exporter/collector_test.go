@@ -0,0 +1,231 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus-community/json_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/promslog"
+)
+
+// Builds a document with the given number of elements in its values array
+func benchmarkData(elements int) []byte {
+	values := make([]string, elements)
+	for i := range values {
+		values[i] = fmt.Sprintf(`{"id": "id-%d", "state": "ACTIVE", "count": %d, "some_boolean": true}`, i, i)
+	}
+	return []byte(`{"counter": 1234, "location": "mars", "values": [` + strings.Join(values, ",") + `]}`)
+}
+
+func BenchmarkCollect(b *testing.B) {
+	module := config.Module{
+		Metrics: []config.Metric{
+			{
+				Name:   "global_value",
+				Path:   "{ .counter }",
+				Type:   config.ValueScrape,
+				Labels: map[string]string{"location": "planet-{.location}"},
+			},
+			{
+				Name:   "value",
+				Path:   "{ .values[*] }",
+				Type:   config.ObjectScrape,
+				Labels: map[string]string{"id": "{.id}"},
+				Values: map[string]string{"count": "{.count}", "boolean": "{.some_boolean}"},
+			},
+		},
+	}
+	metrics, err := CreateMetricsList(module, "", &JSONPaths{})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, elements := range []int{10, 100} {
+		b.Run(fmt.Sprintf("elements=%d", elements), func(b *testing.B) {
+			mc := JSONMetricCollector{
+				JSONMetrics: metrics,
+				Data:        benchmarkData(elements),
+				Logger:      promslog.NewNopLogger(),
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ch := make(chan prometheus.Metric)
+				go func() {
+					mc.Collect(ch)
+					close(ch)
+				}()
+				for range ch {
+				}
+			}
+		})
+	}
+}
+
+// Benchmarks an object metric with many values over a large array, whose
+// elements and labels are extracted once for all the values
+func BenchmarkCollectObjectValues(b *testing.B) {
+	const values = 8
+	elements := make([]string, 1000)
+	for i := range elements {
+		fields := []string{fmt.Sprintf(`"id": "id-%d", "zone": "zone-%d", "state": "ACTIVE"`, i, i%4)}
+		for j := 0; j < values; j++ {
+			fields = append(fields, fmt.Sprintf(`"v%d": %d`, j, i*j))
+		}
+		elements[i] = "{" + strings.Join(fields, ", ") + "}"
+	}
+	data := []byte(`{"values": [` + strings.Join(elements, ",") + `]}`)
+
+	metric := config.Metric{
+		Name:   "value",
+		Path:   "{ .values[*] }",
+		Type:   config.ObjectScrape,
+		Labels: map[string]string{"id": "{.id}", "zone": "{.zone}", "state": "{.state}"},
+		Values: map[string]string{},
+	}
+	for j := 0; j < values; j++ {
+		metric.Values[fmt.Sprintf("v%d", j)] = fmt.Sprintf("{.v%d}", j)
+	}
+	metrics, err := CreateMetricsList(config.Module{Metrics: []config.Metric{metric}}, "", &JSONPaths{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	mc := JSONMetricCollector{
+		JSONMetrics: metrics,
+		Data:        data,
+		Logger:      promslog.NewNopLogger(),
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ch := make(chan prometheus.Metric)
+		go func() {
+			mc.Collect(ch)
+			close(ch)
+		}()
+		for range ch {
+		}
+	}
+}
+
+func TestCollectConcurrent(t *testing.T) {
+	module := config.Module{
+		Metrics: []config.Metric{
+			{
+				Name:   "value",
+				Path:   "{ .values[*] }",
+				Type:   config.ObjectScrape,
+				Labels: map[string]string{"id": "{.id}"},
+				Values: map[string]string{"count": "{.count}"},
+			},
+		},
+	}
+	metrics, err := CreateMetricsList(module, "", &JSONPaths{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc := JSONMetricCollector{
+		JSONMetrics: metrics,
+		Data:        benchmarkData(10),
+		Logger:      promslog.NewNopLogger(),
+	}
+
+	// The parsed json paths are shared across scrapes, and must not be
+	// executed by several of them at once
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				reg := prometheus.NewPedanticRegistry()
+				reg.MustRegister(mc)
+				mfs, err := reg.Gather()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if len(mfs) != 1 || len(mfs[0].GetMetric()) != 10 {
+					t.Errorf("unexpected metrics: %v", mfs)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestAllowMissingKeys(t *testing.T) {
+	metrics := []config.Metric{
+		{
+			Name:   "value",
+			Path:   "{ .values[*] }",
+			Type:   config.ObjectScrape,
+			Labels: map[string]string{"id": "{.id}", "zone": "{.zone}"},
+			Values: map[string]string{"count": "{.count}"},
+		},
+	}
+	data := []byte(`{"values": [{"id": "a", "zone": "eu", "count": 1}, {"id": "b"}]}`)
+
+	for _, allow := range []bool{false, true} {
+		jsonMetrics, err := CreateMetricsList(config.Module{AllowMissingKeys: allow, Metrics: metrics}, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var logs bytes.Buffer
+		mc := JSONMetricCollector{
+			JSONMetrics: jsonMetrics,
+			Data:        data,
+			Logger:      promslog.New(&promslog.Config{Writer: &logs}),
+		}
+		reg := prometheus.NewPedanticRegistry()
+		reg.MustRegister(mc)
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var series []string
+		for _, mf := range mfs {
+			for _, m := range mf.GetMetric() {
+				var labels []string
+				for _, l := range m.GetLabel() {
+					labels = append(labels, l.GetName()+"="+strconv.Quote(l.GetValue()))
+				}
+				series = append(series, fmt.Sprintf("%s %v", strings.Join(labels, ","), m.GetUntyped().GetValue()))
+			}
+		}
+		if !allow {
+			// The missing labels fail, the missing value skips the series
+			if len(series) != 1 || !strings.Contains(logs.String(), "is not found") {
+				t.Fatalf("Missing keys test fails unexpectedly while disallowed, got %v and logs:\n%s", series, logs.String())
+			}
+			continue
+		}
+		if len(series) != 2 || !strings.Contains(series[1], `zone=""`) || !strings.HasSuffix(series[1], "NaN") {
+			t.Fatalf("Missing keys test fails unexpectedly, got %v", series)
+		}
+		if logs.Len() != 0 {
+			t.Fatalf("Missing keys test fails unexpectedly, expected no error logged, got:\n%s", logs.String())
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus-community/json_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+	pconfig "github.com/prometheus/common/config"
+	"golang.org/x/sync/singleflight"
+	"gopkg.in/yaml.v2"
+)
+
+// FetchSharedTotal counts the fetches served by an identical fetch of another
+// probe, within the debounce window of their module.
+var FetchSharedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "json_fetch_shared_total",
+	Help: "Number of fetches served by an identical fetch in flight or within the debounce window.",
+})
+
+var (
+	fetchGroup singleflight.Group
+	// The results of the successful fetches, until the end of the debounce
+	// window started with them
+	recentFetches sync.Map
+)
+
+type fetchResult struct {
+	data   []byte
+	header http.Header
+	status int
+	record FetchRecord
+	// Whether the fetch failed as its context was canceled
+	canceled bool
+}
+
+type recentFetch struct {
+	result  fetchResult
+	expires time.Time
+}
+
+// Fetches the endpoint, sharing the fetch with the identical fetches of other
+// probes, e.g. from several Prometheus replicas scraping at the same time.
+// A fetch is shared while in flight, and its result for the rest of the
+// debounce window started with it. Errors are only shared while in flight.
+func (f *JSONFetcher) fetchShared(endpoint string) ([]byte, http.Header, int, error) {
+	key, err := f.fetchKey(endpoint)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	if v, ok := recentFetches.Load(key); ok {
+		recent := v.(*recentFetch)
+		if time.Now().Before(recent.expires) {
+			FetchSharedTotal.Inc()
+			f.last = recent.result.record
+			f.last.Shared = true
+			return recent.result.data, recent.result.header.Clone(), recent.result.status, nil
+		}
+		recentFetches.CompareAndDelete(key, recent)
+	}
+
+	// The fetch runs on a copy of the fetcher, as it goes on if this probe
+	// gives up, for the other probes waiting for it. With a module timeout, it
+	// is not canceled with this probe, but times out on its own.
+	fetched := false
+	ch := fetchGroup.DoChan(key, func() (interface{}, error) {
+		fetched = true
+		start := time.Now()
+		leader := *f
+		var cancel context.CancelFunc
+		leader.ctx, cancel = f.sharedContext()
+		defer cancel()
+		data, header, status, err := leader.fetchJSON(endpoint)
+		if err != nil {
+			return fetchResult{record: leader.last, canceled: leader.ctx.Err() != nil}, err
+		}
+		result := fetchResult{data: data, header: header, status: status, record: leader.last}
+		if expires := start.Add(time.Duration(f.module.Debounce)); time.Now().Before(expires) {
+			recent := &recentFetch{result: result, expires: expires}
+			recentFetches.Store(key, recent)
+			time.AfterFunc(time.Until(expires), func() {
+				recentFetches.CompareAndDelete(key, recent)
+			})
+		}
+		return result, nil
+	})
+
+	select {
+	case res := <-ch:
+		result := res.Val.(fetchResult)
+		// The fetch was canceled with the probe which started it, not this
+		// one: it is fetched again
+		if !fetched && result.canceled && f.ctx.Err() == nil {
+			return f.fetchShared(endpoint)
+		}
+		f.last = result.record
+		if !fetched {
+			FetchSharedTotal.Inc()
+			f.last.Shared = true
+		}
+		if res.Err != nil {
+			return nil, nil, 0, res.Err
+		}
+		return result.data, result.header.Clone(), result.status, nil
+	case <-f.ctx.Done():
+		return nil, nil, 0, f.ctx.Err()
+	}
+}
+
+// Returns the context of a shared fetch. With a module timeout, it is not
+// canceled with the probe starting the fetch, but times out after the module
+// timeout. Otherwise the fetch is bound to the probe, as nothing else would
+// keep it from waiting forever on a target which does not answer.
+func (f *JSONFetcher) sharedContext() (context.Context, context.CancelFunc) {
+	if timeout := time.Duration(f.module.Timeout); timeout > 0 {
+		return context.WithTimeout(context.WithoutCancel(f.ctx), timeout)
+	}
+	return context.WithCancel(f.ctx)
+}
+
+// Returns the key identifying the fetches of the endpoint which can be
+// shared: the method, the body and the whole module, including its
+// credentials, so that a fetch is never shared across credentials. The key is
+// hashed not to keep them around.
+func (f *JSONFetcher) fetchKey(endpoint string) (string, error) {
+	var body []byte
+	if f.body != nil {
+		var err error
+		if body, err = io.ReadAll(f.body); err != nil {
+			return "", err
+		}
+		f.body = strings.NewReader(string(body))
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%q\n%q\n%q\n", endpoint, f.method, body)
+	if err := writeModule(h, f.module); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+var secretType = reflect.TypeOf(pconfig.Secret(""))
+
+// Writes the module in yaml, followed by its secrets, which are masked in the
+// yaml, so that modules differing only by their credentials are told apart
+func writeModule(w io.Writer, m config.Module) error {
+	data, err := yaml.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	writeSecrets(w, reflect.ValueOf(m))
+	return nil
+}
+
+// Writes the secrets found in the value, in a stable order
+func writeSecrets(w io.Writer, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if !v.IsNil() {
+			writeSecrets(w, v.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			writeSecrets(w, v.Field(i))
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			writeSecrets(w, v.Index(i))
+		}
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+		})
+		for _, key := range keys {
+			writeSecrets(w, v.MapIndex(key))
+		}
+	case reflect.String:
+		if v.Type() == secretType {
+			fmt.Fprintf(w, "%q\n", v.String())
+		}
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus-community/json_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// DynamicCollector collects the dynamic metrics of a JSONMetricCollector,
+// whose names are read from the data. Their descriptors are only known once
+// collected, so it is registered as an unchecked collector.
+type DynamicCollector struct {
+	JSONMetricCollector
+}
+
+// HasDynamicMetrics reports whether any metric of the collector is dynamic
+func (mc JSONMetricCollector) HasDynamicMetrics() bool {
+	for _, m := range mc.JSONMetrics {
+		if m.Type == config.DynamicScrape {
+			return true
+		}
+	}
+	return false
+}
+
+func (dc DynamicCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+// A series of a dynamic metric, before its descriptor is built
+type dynamicSeries struct {
+	name      string
+	help      string
+	valueType prometheus.ValueType
+	value     float64
+	labels    []string
+	data      interface{}
+}
+
+func (dc DynamicCollector) Collect(ch chan<- prometheus.Metric) {
+	var jsonData interface{}
+	if err := unmarshalData(dc.Data, &jsonData); err != nil {
+		dc.Logger.Error("Failed to unmarshal data to json", "err", err, "data", dc.Data)
+		return
+	}
+
+	// The series of a name must agree on their help and type, and be unique,
+	// or else the whole probe would fail to be gathered
+	descs := make(map[string]*prometheus.Desc)
+	types := make(map[string]prometheus.ValueType)
+	seen := make(map[string]bool)
+	for _, m := range dc.JSONMetrics {
+		if m.Type != config.DynamicScrape {
+			continue
+		}
+		series, err := dc.dynamicSeries(m, jsonData)
+		if err != nil {
+			dc.Logger.Error("Failed to extract dynamic metric", "path", m.KeyJSONPath, "err", err, "metric", m.Name)
+			continue
+		}
+		for _, s := range series {
+			desc, ok := descs[s.name]
+			if !ok {
+				desc = prometheus.NewDesc(s.name, s.help, append(append([]string{}, m.LabelNames...), m.MetaLabels...), m.StaticLabels)
+				descs[s.name] = desc
+				types[s.name] = s.valueType
+			} else if types[s.name] != s.valueType {
+				dc.Logger.Error("Skipping dynamic series with conflicting type", "name", s.name, "metric", m.Name)
+				continue
+			}
+			key := s.name + "\xff" + strings.Join(s.labels, "\xff")
+			if seen[key] {
+				dc.Logger.Error("Skipping duplicate dynamic series", "name", s.name, "labels", s.labels, "metric", m.Name)
+				continue
+			}
+			seen[key] = true
+			metric, err := prometheus.NewConstMetric(desc, s.valueType, s.value, s.labels...)
+			if err != nil {
+				dc.Logger.Error("Failed to create dynamic series", "name", s.name, "err", err, "metric", m.Name)
+				continue
+			}
+			dc.sendMetric(ch, m, s.data, metric)
+		}
+	}
+}
+
+// Returns the series of a dynamic metric, failing when there are more than
+// its maximum matches. Series with an illegal name or a value which is not a
+// number are skipped.
+func (dc DynamicCollector) dynamicSeries(m JSONMetric, jsonData interface{}) ([]dynamicSeries, error) {
+	elements, err := extractObjects(m.Paths, dc.Logger, jsonData, m.KeyJSONPath, m.AllowMissingKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	var series []dynamicSeries
+	add := func(element interface{}, name, value string) {
+		if m.Name != "" {
+			name = MakeMetricName(m.Name, name)
+		}
+		if !model.IsValidLegacyMetricName(name) {
+			dc.Logger.Error("Skipping dynamic series with an invalid name", "name", name, "metric", m.Name)
+			return
+		}
+		floatValue, err := m.parseValue(value)
+		if err != nil {
+			dc.Logger.Error("Failed to convert extracted value to float64", "name", name, "value", value, "err", err, "metric", m.Name)
+			return
+		}
+		s := dynamicSeries{
+			name:      name,
+			help:      m.Help,
+			valueType: m.ValueType,
+			value:     floatValue,
+			labels:    dc.labelValues(m, element, "", 0),
+			data:      element,
+		}
+		if m.Dynamic.Help != "" {
+			if help, err := extractValue(m.Paths, dc.Logger, element, m.Dynamic.Help, m.AllowMissingKeys); err == nil && help != "" {
+				s.help = help
+			}
+		}
+		if s.help == "" {
+			s.help = name
+		}
+		if m.Dynamic.Type != "" {
+			if t, err := extractValue(m.Paths, dc.Logger, element, m.Dynamic.Type, m.AllowMissingKeys); err == nil {
+				s.valueType = dynamicValueType(t, m.ValueType)
+			}
+		}
+		series = append(series, s)
+	}
+
+	for _, element := range elements {
+		if m.Dynamic.Name != "" {
+			name, err := extractValue(m.Paths, dc.Logger, element, m.Dynamic.Name, m.AllowMissingKeys)
+			if err != nil || name == "" && m.AllowMissingKeys {
+				continue
+			}
+			value, err := extractValue(m.Paths, dc.Logger, element, m.Dynamic.Value, m.AllowMissingKeys)
+			if err != nil {
+				continue
+			}
+			add(element, name, value)
+			continue
+		}
+
+		entries, ok := element.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("matched value is not a json object of names to values")
+		}
+		names := make([]string, 0, len(entries))
+		for name := range entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			add(element, name, fmt.Sprint(entries[name]))
+		}
+	}
+
+	if m.MaxMatches > 0 && len(series) > m.MaxMatches {
+		return nil, fmt.Errorf("path %s derived %d series, more than max_matches %d", m.KeyJSONPath, len(series), m.MaxMatches)
+	}
+	return series, nil
+}
+
+// Returns the value type named by the data, or else the default one
+func dynamicValueType(name string, defaultType prometheus.ValueType) prometheus.ValueType {
+	switch config.ValueType(strings.ToLower(name)) {
+	case config.ValueTypeGauge:
+		return prometheus.GaugeValue
+	case config.ValueTypeCounter:
+		return prometheus.CounterValue
+	case config.ValueTypeUntyped:
+		return prometheus.UntypedValue
+	default:
+		return defaultType
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// FailureCollector emits the fallback values of the metrics of a module,
+// when its target could not be fetched. The series only carry the static
+// and meta labels of the metrics, as there is no data to extract the other
+// labels from. The meta labels without a value, such as the batch id label
+// when the whole response failed, are left out.
+type FailureCollector struct {
+	JSONMetrics     []JSONMetric
+	Values          map[string]float64
+	MetaLabelValues map[string]string
+}
+
+func (fc FailureCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, m := range fc.failureMetrics() {
+		names, _ := fc.metaLabels(m)
+		ch <- failureDesc(m, names)
+	}
+}
+
+func (fc FailureCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range fc.failureMetrics() {
+		names, values := fc.metaLabels(m)
+		ch <- prometheus.MustNewConstMetric(failureDesc(m, names), m.ValueType, fc.Values[m.Name], values...)
+	}
+}
+
+// Returns the names and values of the meta labels of the metric which have a
+// value
+func (fc FailureCollector) metaLabels(m JSONMetric) ([]string, []string) {
+	names := make([]string, 0, len(m.MetaLabels))
+	values := make([]string, 0, len(m.MetaLabels))
+	for _, name := range m.MetaLabels {
+		if value, ok := fc.MetaLabelValues[name]; ok {
+			names = append(names, name)
+			values = append(values, value)
+		}
+	}
+	return names, values
+}
+
+// Returns the metrics having a fallback value, once per name
+func (fc FailureCollector) failureMetrics() []JSONMetric {
+	var metrics []JSONMetric
+	seen := make(map[string]bool)
+	for _, m := range fc.JSONMetrics {
+		if _, ok := fc.Values[m.Name]; ok && !seen[m.Name] {
+			seen[m.Name] = true
+			metrics = append(metrics, m)
+		}
+	}
+	return metrics
+}
+
+func failureDesc(m JSONMetric, metaLabels []string) *prometheus.Desc {
+	return prometheus.NewDesc(m.Name, m.Help, metaLabels, m.StaticLabels)
+}
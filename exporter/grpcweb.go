@@ -0,0 +1,119 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+const (
+	grpcWebContentType     = "application/grpc-web+json"
+	grpcWebTextContentType = "application/grpc-web-text"
+
+	// Flags of the frames of a gRPC-Web message
+	grpcWebCompressedFlag = 0x01
+	grpcWebTrailerFlag    = 0x80
+)
+
+// Wraps the request message, '{}' if empty, into a gRPC-Web data frame
+func grpcWebRequestBody(body io.Reader) (io.Reader, error) {
+	var message []byte
+	if body != nil {
+		var err error
+		if message, err = io.ReadAll(body); err != nil {
+			return nil, err
+		}
+	}
+	if len(bytes.TrimSpace(message)) == 0 {
+		message = []byte("{}")
+	}
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return bytes.NewReader(append(frame, message...)), nil
+}
+
+// Reads the json messages of a gRPC-Web response, in binary or base64 text
+// encoding. A single message is returned as is, several messages, as from
+// a server stream, are collected into a json array. A non zero grpc-status,
+// from the headers or from the trailer frame, fails the response.
+func readGRPCWeb(body io.Reader, header http.Header) ([]byte, error) {
+	if err := grpcStatus(header.Get("Grpc-Status"), header.Get("Grpc-Message")); err != nil {
+		return nil, err
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type")); strings.HasPrefix(mediaType, grpcWebTextContentType) {
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []json.RawMessage
+	for len(content) > 0 {
+		if len(content) < 5 {
+			return nil, errors.New("truncated gRPC-Web frame header")
+		}
+		flags, length := content[0], binary.BigEndian.Uint32(content[1:5])
+		if uint64(len(content)-5) < uint64(length) {
+			return nil, errors.New("truncated gRPC-Web frame")
+		}
+		frame := content[5 : 5+length]
+		content = content[5+length:]
+
+		if flags&grpcWebCompressedFlag != 0 {
+			return nil, errors.New("compressed gRPC-Web frames are not supported")
+		}
+		if flags&grpcWebTrailerFlag != 0 {
+			// The trailers are header lines, not always ending with a blank line
+			reader := bufio.NewReader(io.MultiReader(bytes.NewReader(frame), strings.NewReader("\r\n")))
+			trailer, err := textproto.NewReader(reader).ReadMIMEHeader()
+			if err != nil && err != io.EOF {
+				return nil, fmt.Errorf("invalid gRPC-Web trailer: %w", err)
+			}
+			if err := grpcStatus(trailer.Get("Grpc-Status"), trailer.Get("Grpc-Message")); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		messages = append(messages, json.RawMessage(frame))
+	}
+
+	switch len(messages) {
+	case 0:
+		return nil, errors.New("no message in gRPC-Web response")
+	case 1:
+		return messages[0], nil
+	default:
+		return json.Marshal(messages)
+	}
+}
+
+func grpcStatus(status, message string) error {
+	if status == "" || status == "0" {
+		return nil
+	}
+	return fmt.Errorf("grpc-status %s: %s", status, message)
+}
@@ -0,0 +1,69 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Builds a gRPC-Web frame with the given flags
+func grpcWebFrame(flags byte, payload string) string {
+	header := make([]byte, 5)
+	header[0] = flags
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	return string(header) + payload
+}
+
+func TestReadGRPCWeb(t *testing.T) {
+	ok := grpcWebFrame(grpcWebTrailerFlag, "grpc-status: 0\r\ngrpc-message: \r\n")
+	tests := []struct {
+		Body           string
+		Header         http.Header
+		ExpectedOutput string
+		ShouldSucceed  bool
+	}{
+		{grpcWebFrame(0, `{"count": 1}`) + ok, http.Header{}, `{"count": 1}`, true},
+		// Server stream
+		{grpcWebFrame(0, `{"count": 1}`) + grpcWebFrame(0, `{"count": 2}`) + ok, http.Header{}, `[{"count":1},{"count":2}]`, true},
+		// Trailer without a final blank line
+		{grpcWebFrame(0, `{"count": 1}`) + grpcWebFrame(grpcWebTrailerFlag, "grpc-status:0"), http.Header{}, `{"count": 1}`, true},
+		{
+			base64.StdEncoding.EncodeToString([]byte(grpcWebFrame(0, `{"count": 1}`) + ok)),
+			http.Header{"Content-Type": {"application/grpc-web-text+json"}},
+			`{"count": 1}`, true,
+		},
+		{grpcWebFrame(grpcWebTrailerFlag, "grpc-status: 5\r\ngrpc-message: not found\r\n"), http.Header{}, "", false},
+		{"", http.Header{"Grpc-Status": {"14"}, "Grpc-Message": {"unavailable"}}, "", false},
+		{grpcWebFrame(grpcWebCompressedFlag, "gzipped") + ok, http.Header{}, "", false},
+		{grpcWebFrame(0, `{"count": 1}`)[:8], http.Header{}, "", false},
+		{ok, http.Header{}, "", false},
+	}
+
+	for i, test := range tests {
+		data, err := readGRPCWeb(strings.NewReader(test.Body), test.Header)
+		if err != nil && test.ShouldSucceed {
+			t.Fatalf("gRPC-Web test %d failed with an unexpected error: %s", i, err)
+		}
+		if err == nil && !test.ShouldSucceed {
+			t.Fatalf("gRPC-Web test %d succeeded unexpectedly", i)
+		}
+		if test.ShouldSucceed && string(data) != test.ExpectedOutput {
+			t.Fatalf("gRPC-Web test %d fails unexpectedly.\nGOT:\n%s\nEXPECTED:\n%s", i, data, test.ExpectedOutput)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/prometheus-community/json_exporter/config"
+	pconfig "github.com/prometheus/common/config"
+	"golang.org/x/net/http2"
+)
+
+// Returns the client options selecting the HTTP version of the fetch of the
+// endpoint, enabling HTTP/2 in the client config if needed. The connections
+// are dialed with dial if set.
+func httpVersionOptions(v config.HTTPVersion, endpoint string, httpClientConfig *pconfig.HTTPClientConfig, dial pconfig.DialContextFunc) ([]pconfig.HTTPClientOption, error) {
+	var options []pconfig.HTTPClientOption
+	switch v {
+	case "", config.HTTPVersion11:
+		options = append(options, pconfig.WithHTTP2Disabled())
+	case config.HTTPVersionAuto:
+		httpClientConfig.EnableHTTP2 = true
+	case config.HTTPVersion2:
+		httpClientConfig.EnableHTTP2 = true
+		if u, err := url.Parse(endpoint); err == nil && u.Scheme == "http" {
+			return []pconfig.HTTPClientOption{pconfig.WithDialContextFunc(h2cDialer(dial))}, nil
+		}
+	default:
+		return nil, fmt.Errorf("Unknown HTTP version: '%s'", v)
+	}
+	if dial != nil {
+		options = append(options, pconfig.WithDialContextFunc(dial))
+	}
+	return options, nil
+}
+
+// Returns a function dialing a target without TLS for HTTP/2 with prior
+// knowledge (h2c), with dial if set.
+//
+// The transport of the client only speaks HTTP/1.1 without TLS, so the
+// returned connections are bridged to an HTTP/2 connection to the target: the
+// requests written by the transport are sent over it, and their responses
+// written back. The round trippers of the client, e.g. authentication, are
+// kept this way.
+func h2cDialer(dial pconfig.DialContextFunc) pconfig.DialContextFunc {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		cc, err := (&http2.Transport{AllowHTTP: true}).NewClientConn(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		client, server := net.Pipe()
+		go func() {
+			bridge(server, cc, "http", "HTTP/2")
+			cc.Close()
+		}()
+		return client, nil
+	}
+}
+
+// Reads the HTTP/1.1 requests written on conn, sends them with rt to their
+// host using scheme, and writes their responses back, until conn is closed.
+// proto names the protocol of rt in the errors.
+func bridge(conn net.Conn, rt http.RoundTripper, scheme, proto string) {
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		req.RequestURI = ""
+		req.URL.Scheme = scheme
+		req.URL.Host = req.Host
+
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			// Reported through the status of the response, as the error of
+			// the transport would only tell that the connection was closed
+			resp = &http.Response{
+				Status:     "502 " + proto + " request failed: " + strings.ReplaceAll(err.Error(), "\n", " "),
+				StatusCode: http.StatusBadGateway,
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				Body:       io.NopCloser(strings.NewReader("")),
+				Close:      true,
+			}
+		}
+		err = resp.Write(conn)
+		resp.Body.Close()
+		if err != nil || resp.Close {
+			return
+		}
+	}
+}
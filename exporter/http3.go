@@ -0,0 +1,78 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	pconfig "github.com/prometheus/common/config"
+)
+
+// An HTTP/3 transport, closing its QUIC connections once done
+type http3Transport interface {
+	http.RoundTripper
+	io.Closer
+}
+
+// Returns the client options fetching the endpoint over HTTP/3, with the TLS
+// config of the module, and the HTTP/3 transport to close once fetched.
+//
+// As for h2c, the transport of the client writes HTTP/1.1 requests to
+// connections bridged to the HTTP/3 transport, keeping the round trippers of
+// the client. The https requests are sent as http to the client transport by
+// http3Downgrade for this, and upgraded back by the bridge.
+func (f *JSONFetcher) http3Options(endpoint string, newTLSConfig pconfig.NewTLSConfigFunc) ([]pconfig.HTTPClientOption, io.Closer, error) {
+	if f.module.HTTPVersion != "" {
+		return nil, nil, errors.New("http3 and http_version are mutually exclusive")
+	}
+	if f.module.SSHTunnel.Host != "" {
+		return nil, nil, errors.New("http3 is not supported through an SSH tunnel, which only forwards TCP")
+	}
+	if u, err := url.Parse(endpoint); err != nil || u.Scheme != "https" {
+		return nil, nil, errors.New("http3 requires an https target")
+	}
+	tlsConfig, err := newTLSConfig(f.ctx, &f.module.HTTPClientConfig.TLSConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	transport, err := newHTTP3Transport(tlsConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	dial := func(context.Context, string, string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go bridge(server, transport, "https", "HTTP/3")
+		return client, nil
+	}
+	return []pconfig.HTTPClientOption{pconfig.WithHTTP2Disabled(), pconfig.WithDialContextFunc(dial)}, transport, nil
+}
+
+// Sends the https requests of the client as http, to the connections bridged
+// to HTTP/3
+type http3Downgrade struct {
+	next http.RoundTripper
+}
+
+func (rt http3Downgrade) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "https" {
+		req = req.Clone(req.Context())
+		req.URL.Scheme = "http"
+	}
+	return rt.next.RoundTrip(req)
+}
@@ -0,0 +1,25 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !http3
+
+package exporter
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+func newHTTP3Transport(*tls.Config) (http3Transport, error) {
+	return nil, errors.New("http3 is not supported by this build of the exporter, built without the http3 tag")
+}
@@ -0,0 +1,155 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"strings"
+	"sync"
+
+	"k8s.io/client-go/util/jsonpath"
+)
+
+// JSONPaths caches the parsed json paths of the metrics of a config, by path,
+// so that they are parsed once rather than on every scrape. The metrics list
+// is rebuilt on every probe, so the cache is made along with the config and
+// handed to CreateMetricsList. A nil cache parses the paths on every use, as
+// for the paths rendered for each probe.
+//
+// A jsonpath.JSONPath keeps state while it is executed and cannot be used by
+// concurrent scrapes, hence each path holds a pool of parsed copies. The CEL
+// expressions of the metrics are cached along with them, compiled.
+type JSONPaths struct {
+	pools    sync.Map
+	programs sync.Map
+}
+
+// Returns a parsed json path for the given path, to be handed back with put
+// once executed
+func (c *JSONPaths) get(path string) (*jsonpath.JSONPath, error) {
+	if c != nil {
+		if pool, ok := c.pools.Load(path); ok {
+			if j, ok := pool.(*sync.Pool).Get().(*jsonpath.JSONPath); ok {
+				return j, nil
+			}
+		}
+	}
+
+	j := jsonpath.New("jp")
+	if err := j.Parse(normalizeSubscripts(path)); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Rewrites the subscripts written after a dot, such as '{.[0]}' or
+// '{$.[0].name}' for the documents whose root is an array, into the
+// '{[0]}' form understood by the parser, which otherwise reads them as an
+// empty field name and finds nothing. The recursive descent '..[0]' and the
+// quoted strings are kept as is.
+func normalizeSubscripts(path string) string {
+	if !strings.Contains(path, ".[") {
+		return path
+	}
+	var b strings.Builder
+	var quote byte
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && i+1 < len(path) {
+				b.WriteByte(c)
+				i++
+				c = path[i]
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '.' && i+1 < len(path) && path[i+1] == '[' && (i == 0 || path[i-1] != '.'):
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func (c *JSONPaths) put(path string, j *jsonpath.JSONPath) {
+	if c == nil {
+		return
+	}
+	pool, _ := c.pools.LoadOrStore(path, &sync.Pool{})
+	pool.(*sync.Pool).Put(j)
+}
+
+// Len returns the number of paths in the cache.
+func (c *JSONPaths) Len() int {
+	n := 0
+	if c != nil {
+		c.pools.Range(func(_, _ any) bool {
+			n++
+			return true
+		})
+	}
+	return n
+}
+
+// Parses the given paths ahead of the scrapes, invalid paths are reported
+// when they are evaluated
+func (c *JSONPaths) precompile(paths ...string) {
+	if c == nil {
+		return
+	}
+	for _, path := range paths {
+		if j, err := c.get(path); err == nil {
+			c.put(path, j)
+		}
+	}
+}
+
+// Reports whether the path uses the '..' recursive descent operator. Invalid
+// paths are reported when they are parsed.
+func hasRecursiveDescent(path string) bool {
+	parser, err := jsonpath.Parse("jp", path)
+	if err != nil {
+		return false
+	}
+	return listHasRecursiveDescent(parser.Root)
+}
+
+func listHasRecursiveDescent(list *jsonpath.ListNode) bool {
+	if list == nil {
+		return false
+	}
+	for _, node := range list.Nodes {
+		switch n := node.(type) {
+		case *jsonpath.RecursiveNode:
+			return true
+		case *jsonpath.ListNode:
+			if listHasRecursiveDescent(n) {
+				return true
+			}
+		case *jsonpath.FilterNode:
+			if listHasRecursiveDescent(n.Left) || listHasRecursiveDescent(n.Right) {
+				return true
+			}
+		case *jsonpath.UnionNode:
+			for _, l := range n.Nodes {
+				if listHasRecursiveDescent(l) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
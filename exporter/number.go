@@ -0,0 +1,104 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus-community/json_exporter/config"
+)
+
+// NumberFormat is the compiled form of a config.NumberFormat
+type NumberFormat struct {
+	regex              *regexp.Regexp
+	thousandsSeparator string
+	decimalSeparator   string
+	// Unit suffixes, longest first so that e.g. "ms" is tried before "s"
+	units       []string
+	multipliers map[string]float64
+}
+
+func NewNumberFormat(f config.NumberFormat) (*NumberFormat, error) {
+	nf := &NumberFormat{
+		thousandsSeparator: f.ThousandsSeparator,
+		decimalSeparator:   f.DecimalSeparator,
+		multipliers:        f.Units,
+	}
+	if f.Regex != "" {
+		re, err := regexp.Compile(f.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number format regex %q: %w", f.Regex, err)
+		}
+		nf.regex = re
+	}
+	if f.ThousandsSeparator != "" && f.ThousandsSeparator == f.DecimalSeparator {
+		return nil, fmt.Errorf("number format thousands and decimal separators are both %q", f.ThousandsSeparator)
+	}
+	for unit := range f.Units {
+		nf.units = append(nf.units, unit)
+	}
+	sort.Slice(nf.units, func(i, j int) bool {
+		if len(nf.units[i]) != len(nf.units[j]) {
+			return len(nf.units[i]) > len(nf.units[j])
+		}
+		return nf.units[i] < nf.units[j]
+	})
+	return nf, nil
+}
+
+// Parse extracts the number from s with the regex, strips its unit and
+// separators, and returns it sanitized and multiplied by its unit
+func (nf *NumberFormat) Parse(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	// Special floats are not formatted, and would not match the regex
+	if value, ok := specialFloat(s); ok {
+		return value, nil
+	}
+	if nf.regex != nil {
+		match := nf.regex.FindStringSubmatch(s)
+		if match == nil {
+			return 0, fmt.Errorf("value %q does not match number format regex %q", s, nf.regex)
+		}
+		s = match[0]
+		if len(match) > 1 {
+			s = match[1]
+		}
+		s = strings.TrimSpace(s)
+	}
+
+	multiplier := 1.0
+	for _, unit := range nf.units {
+		if strings.HasSuffix(s, unit) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit))
+			multiplier = nf.multipliers[unit]
+			break
+		}
+	}
+
+	if nf.thousandsSeparator != "" {
+		s = strings.ReplaceAll(s, nf.thousandsSeparator, "")
+	}
+	if nf.decimalSeparator != "" && nf.decimalSeparator != "." {
+		s = strings.Replace(s, nf.decimalSeparator, ".", 1)
+	}
+
+	value, err := SanitizeValue(s)
+	if err != nil {
+		return 0, err
+	}
+	return value * multiplier, nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"testing"
+
+	"github.com/prometheus-community/json_exporter/config"
+)
+
+func TestNumberFormat(t *testing.T) {
+	durations := map[string]float64{"ms": 0.001, "s": 1, "m": 60}
+	sizes := map[string]float64{"KB": 1e3, "MB": 1e6, "GB": 1e9}
+
+	tests := []struct {
+		Format         config.NumberFormat
+		Input          string
+		ExpectedOutput float64
+		ShouldSucceed  bool
+	}{
+		{config.NumberFormat{}, "1.2e3", 1200, true},
+		{config.NumberFormat{Units: durations}, "1.2e3 ms", 1.2, true},
+		{config.NumberFormat{Units: durations}, "1.5s", 1.5, true},
+		{config.NumberFormat{Units: durations}, "2 m", 120, true},
+		{config.NumberFormat{Units: durations}, "2 h", 0, false},
+		{config.NumberFormat{ThousandsSeparator: ","}, "1,200", 1200, true},
+		{config.NumberFormat{ThousandsSeparator: ","}, "1,234,567.5", 1234567.5, true},
+		{config.NumberFormat{ThousandsSeparator: ".", DecimalSeparator: ","}, "1.234.567,5", 1234567.5, true},
+		{config.NumberFormat{ThousandsSeparator: " ", DecimalSeparator: ","}, "1 234,5", 1234.5, true},
+		{config.NumberFormat{ThousandsSeparator: "'"}, "1'200", 1200, true},
+		{config.NumberFormat{ThousandsSeparator: ",", Units: sizes}, "1,024 MB", 1.024e9, true},
+		{config.NumberFormat{DecimalSeparator: ",", Units: sizes}, "1,5GB", 1.5e9, true},
+		{config.NumberFormat{Regex: `used: (\S+)`, Units: sizes}, "disk used: 12KB of 1GB", 12000, true},
+		{config.NumberFormat{Regex: `[0-9.]+`}, "v12.5 units", 12.5, true},
+		{config.NumberFormat{Regex: `used: (\S+)`}, "free: 12", 0, false},
+		{config.NumberFormat{}, "true", 1, true},
+		{config.NumberFormat{}, "1,200", 0, false},
+	}
+
+	for i, test := range tests {
+		nf, err := NewNumberFormat(test.Format)
+		if err != nil {
+			t.Fatalf("Number format test %d failed with an unexpected error: %s", i, err)
+		}
+		actualOutput, err := nf.Parse(test.Input)
+		if err != nil && test.ShouldSucceed {
+			t.Fatalf("Number format test %d failed with an unexpected error.\nINPUT:\n%q\nERR:\n%s", i, test.Input, err)
+		}
+		if err == nil && !test.ShouldSucceed {
+			t.Fatalf("Number format test %d succeeded unexpectedly.\nINPUT:\n%q", i, test.Input)
+		}
+		if test.ShouldSucceed && actualOutput != test.ExpectedOutput {
+			t.Fatalf("Number format test %d fails unexpectedly.\nGOT:\n%f\nEXPECTED:\n%f", i, actualOutput, test.ExpectedOutput)
+		}
+	}
+}
+
+func TestNumberFormatInvalid(t *testing.T) {
+	for i, f := range []config.NumberFormat{
+		{Regex: "("},
+		{ThousandsSeparator: ",", DecimalSeparator: ","},
+	} {
+		if _, err := NewNumberFormat(f); err == nil {
+			t.Fatalf("Invalid number format test %d succeeded unexpectedly", i)
+		}
+	}
+}
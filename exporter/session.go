@@ -0,0 +1,184 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The sessions opened by the pre requests of the modules, by login url and
+// module, reused across probes until they expire or are rejected, and then
+// deleted
+var sessions sync.Map
+
+type session struct {
+	cookies []*http.Cookie
+	header  http.Header
+	// Zero when the session is only renewed once rejected
+	expires time.Time
+}
+
+// Adds the cookies and headers of the session to the request. The cookies the
+// module sets itself are kept, unless the session sets one of the same name.
+func (s *session) apply(req *http.Request) {
+	if len(s.cookies) != 0 {
+		names := make(map[string]bool, len(s.cookies))
+		for _, cookie := range s.cookies {
+			names[cookie.Name] = true
+		}
+		configured := req.Cookies()
+		req.Header.Del("Cookie")
+		for _, cookie := range configured {
+			if !names[cookie.Name] {
+				req.AddCookie(cookie)
+			}
+		}
+		for _, cookie := range s.cookies {
+			req.AddCookie(cookie)
+		}
+	}
+	for name, values := range s.header {
+		req.Header[name] = values
+	}
+}
+
+// Sends the request, within the session opened by the pre request of the
+// module if any. A request rejected with 401 Unauthorized opens a new session
+// and is sent again, once.
+func (f *JSONFetcher) doInSession(client *http.Client, req *http.Request) (*http.Response, error) {
+	if f.module.PreRequest.Path == "" {
+		return client.Do(req)
+	}
+
+	loginURL, err := req.URL.Parse(f.module.PreRequest.Path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pre request path: %w", err)
+	}
+	key, err := f.sessionKey(loginURL)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := f.session(client, loginURL, key)
+	if err != nil {
+		return nil, err
+	}
+	// Sent again in a new session if rejected, with the cookies of the module
+	// but not those of the rejected session
+	retry := req.Clone(req.Context())
+	s.apply(req)
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || req.GetBody == nil && req.Body != nil {
+		return resp, err
+	}
+
+	// The session expired on the side of the target
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	sessions.CompareAndDelete(key, s)
+	if s, err = f.session(client, loginURL, key); err != nil {
+		return nil, err
+	}
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	s.apply(retry)
+	return client.Do(retry)
+}
+
+// Returns the cached session of the module, or opens a new one with its pre
+// request if there is none or if it expired
+func (f *JSONFetcher) session(client *http.Client, loginURL *url.URL, key string) (*session, error) {
+	if v, ok := sessions.Load(key); ok {
+		s := v.(*session)
+		if s.expires.IsZero() || time.Now().Before(s.expires) {
+			return s, nil
+		}
+		sessions.CompareAndDelete(key, s)
+	}
+
+	pre := f.module.PreRequest
+	method := pre.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	var body io.Reader
+	if pre.Body != "" {
+		body = strings.NewReader(pre.Body)
+	}
+	req, err := http.NewRequestWithContext(f.ctx, method, loginURL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range pre.Headers {
+		req.Header.Set(name, value)
+	}
+
+	// The cookies of a redirecting login are set by the redirect itself
+	login := *client
+	login.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := login.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("pre request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 && resp.StatusCode/100 != 3 {
+		return nil, errors.New("pre request failed: " + resp.Status)
+	}
+
+	s := &session{cookies: resp.Cookies(), header: http.Header{}}
+	for _, name := range pre.CaptureHeaders {
+		if value := resp.Header.Get(name); value != "" {
+			s.header.Set(name, value)
+		}
+	}
+	if pre.SessionTTL > 0 {
+		s.expires = time.Now().Add(time.Duration(pre.SessionTTL))
+	}
+	sessions.Store(key, s)
+	if pre.SessionTTL > 0 {
+		// Deleted once expired even if the target is never probed again
+		time.AfterFunc(time.Duration(pre.SessionTTL), func() {
+			sessions.CompareAndDelete(key, s)
+		})
+	}
+	f.logger.Debug("Opened session with pre request", "url", loginURL.Redacted(), "cookies", len(s.cookies))
+	return s, nil
+}
+
+// Returns the key of the sessions of the module at the login url. As for the
+// shared fetches, the whole module is part of it, so that a session is never
+// shared across credentials.
+func (f *JSONFetcher) sessionKey(loginURL *url.URL) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%q\n", loginURL.String())
+	if err := writeModule(h, f.module); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
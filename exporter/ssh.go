@@ -0,0 +1,75 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Opens an SSH connection to the bastion of the module, through which the
+// connections of the fetch are dialed. It is closed once fetched.
+func (f *JSONFetcher) openSSHTunnel() (*ssh.Client, error) {
+	tunnel := f.module.SSHTunnel
+	key, err := os.ReadFile(tunnel.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read SSH key %s: %w", tunnel.KeyFile, err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse SSH key %s: %w", tunnel.KeyFile, err)
+	}
+	var hostKeyCallback ssh.HostKeyCallback
+	switch {
+	case tunnel.InsecureIgnoreHostKey:
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	case tunnel.KnownHostsFile != "":
+		if hostKeyCallback, err = knownhosts.New(tunnel.KnownHostsFile); err != nil {
+			return nil, fmt.Errorf("unable to read SSH known hosts %s: %w", tunnel.KnownHostsFile, err)
+		}
+	default:
+		return nil, errors.New("ssh_tunnel requires known_hosts_file, or insecure_ignore_host_key")
+	}
+
+	addr := tunnel.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(f.ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// The handshake is bounded by the timeout of the probe
+	if deadline, ok := f.ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+		User:            tunnel.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SSH handshake with %s failed: %w", addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/prometheus-community/json_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// TimeseriesGatherer gathers the metrics of Gatherer along with the samples
+// of the timeseries metrics of Collectors.
+//
+// A timeseries metric emits one sample per point of an array, each with its
+// own timestamp, so several samples share the same series. A registry
+// rejects those as duplicates, hence they are gathered separately here.
+type TimeseriesGatherer struct {
+	Gatherer   prometheus.Gatherer
+	Collectors []JSONMetricCollector
+}
+
+func (g TimeseriesGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	if err != nil {
+		return mfs, err
+	}
+
+	families := make(map[string]*dto.MetricFamily)
+	for _, mf := range mfs {
+		families[mf.GetName()] = mf
+	}
+
+	for _, c := range g.Collectors {
+		if !hasTimeseries(c.JSONMetrics) {
+			continue
+		}
+		if mfs, err = gatherTimeseries(c, families, mfs); err != nil {
+			return mfs, err
+		}
+	}
+
+	sort.Slice(mfs, func(i, j int) bool {
+		return mfs[i].GetName() < mfs[j].GetName()
+	})
+	return mfs, nil
+}
+
+// Appends the samples of the timeseries metrics of the collector to the
+// gathered families, creating the missing ones
+func gatherTimeseries(c JSONMetricCollector, families map[string]*dto.MetricFamily, mfs []*dto.MetricFamily) ([]*dto.MetricFamily, error) {
+	var jsonData interface{}
+	if err := unmarshalData(c.Data, &jsonData); err != nil {
+		// Already reported by the collector
+		return mfs, nil
+	}
+
+	for _, m := range c.JSONMetrics {
+		if m.Type != config.TimeseriesScrape {
+			continue
+		}
+		mf, ok := families[m.Name]
+		if !ok {
+			mf = &dto.MetricFamily{
+				Name: &m.Name,
+				Help: &m.Help,
+				Type: metricType(m.ValueType),
+			}
+			families[m.Name] = mf
+			mfs = append(mfs, mf)
+		} else if mf.GetType() != *metricType(m.ValueType) || mf.GetHelp() != m.Help {
+			return mfs, fmt.Errorf("timeseries metric %s is inconsistent with an already gathered metric of the same name", m.Name)
+		}
+
+		ch := make(chan prometheus.Metric)
+		go func() {
+			c.collectObjects(ch, []JSONMetric{m}, jsonData)
+			close(ch)
+		}()
+		for metric := range ch {
+			dtoMetric := &dto.Metric{}
+			if err := metric.Write(dtoMetric); err != nil {
+				c.Logger.Error("Failed to write timeseries metric", "err", err, "metric", m.Desc)
+				continue
+			}
+			mf.Metric = append(mf.Metric, dtoMetric)
+		}
+	}
+	return mfs, nil
+}
+
+func hasTimeseries(metrics []JSONMetric) bool {
+	for _, m := range metrics {
+		if m.Type == config.TimeseriesScrape {
+			return true
+		}
+	}
+	return false
+}
+
+func metricType(valueType prometheus.ValueType) *dto.MetricType {
+	switch valueType {
+	case prometheus.GaugeValue:
+		return dto.MetricType_GAUGE.Enum()
+	case prometheus.CounterValue:
+		return dto.MetricType_COUNTER.Enum()
+	default:
+		return dto.MetricType_UNTYPED.Enum()
+	}
+}
@@ -14,22 +14,50 @@
 package exporter
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"math"
+	"math/big"
+	"mime"
 	"net/http"
 	"net/url"
+	"path"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"text/template"
+	"time"
 
 	"github.com/Masterminds/sprig/v3"
+	"github.com/google/cel-go/cel"
 	"github.com/prometheus-community/json_exporter/config"
 	"github.com/prometheus/client_golang/prometheus"
 	pconfig "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+	"k8s.io/client-go/util/jsonpath"
+)
+
+const (
+	// ModuleLabel and TargetLabel are the label names injected into every
+	// metric of a module when inject_meta_labels is enabled.
+	ModuleLabel = "module"
+	TargetLabel = "target"
 )
 
 func MakeMetricName(parts ...string) string {
@@ -41,6 +69,11 @@ func SanitizeValue(s string) (float64, error) {
 	var value float64
 	var resultErr string
 
+	// Quoted numbers may carry stray whitespace, such as a trailing newline
+	s = strings.TrimSpace(s)
+	if value, ok := specialFloat(s); ok {
+		return value, nil
+	}
 	if value, err = strconv.ParseFloat(s, 64); err == nil {
 		return value, nil
 	}
@@ -60,6 +93,85 @@ func SanitizeValue(s string) (float64, error) {
 	return value, errors.New(resultErr)
 }
 
+// Returns the special float spelled by s, e.g. quoted by APIs quoting every
+// number: NaN, Inf or Infinity, case insensitive and optionally signed
+func specialFloat(s string) (float64, bool) {
+	unsigned := strings.TrimLeft(s, "+-")
+	if len(s)-len(unsigned) > 1 {
+		return 0, false
+	}
+	switch strings.ToLower(unsigned) {
+	case "nan":
+		return math.NaN(), true
+	case "inf", "infinity":
+		if strings.HasPrefix(s, "-") {
+			return math.Inf(-1), true
+		}
+		return math.Inf(1), true
+	}
+	return 0, false
+}
+
+// Decodes the json data as json.Unmarshal does, except for the integers too
+// large for a float64 to hold exactly, such as nanosecond timestamps or 64-bit
+// counters, which are kept as json.Number so that their labels keep all their
+// digits. The other numbers stay float64, as the filters of the json paths
+// only compare those.
+func unmarshalData(data []byte, v *interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		if err == io.EOF {
+			return errors.New("unexpected end of JSON input")
+		}
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("invalid character after top-level value")
+	}
+	*v = exactNumbers(*v)
+	return nil
+}
+
+// Replaces the numbers of the decoded value by float64, but for the integers
+// from 2^53 on
+func exactNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = exactNumbers(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = exactNumbers(value)
+		}
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return v
+		}
+		if math.Abs(f) >= 1<<53 && !strings.ContainsAny(v.String(), ".eE") {
+			return v
+		}
+		return f
+	}
+	return v
+}
+
+// Compares two numbers, as integers if both are, so that the integers too large
+// for a float64 keep their order, or else as their float values
+func compareNumbers(a, b string, x, y float64) int {
+	if i, ok := new(big.Int).SetString(strings.TrimSpace(a), 10); ok {
+		if j, ok := new(big.Int).SetString(strings.TrimSpace(b), 10); ok {
+			return i.Cmp(j)
+		}
+	}
+	return cmp.Compare(x, y)
+}
+
+// SanitizeIntValue parses an integer, such as an epoch timestamp. The numbers of
+// the data being float64, the json paths render the large ones in exponent
+// notation, e.g. '1.7e+12', which are parsed as floats and truncated.
 func SanitizeIntValue(s string) (int64, error) {
 	var err error
 	var value int64
@@ -70,15 +182,29 @@ func SanitizeIntValue(s string) (int64, error) {
 	}
 	resultErr = fmt.Sprintf("%s", err)
 
+	if f, ferr := strconv.ParseFloat(s, 64); ferr == nil && !math.IsNaN(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+		return int64(f), nil
+	}
+
 	return value, errors.New(resultErr)
 }
 
-func CreateMetricsList(c config.Module) ([]JSONMetric, error) {
+// CreateMetricsList builds the metrics of the module. The global prefix, if
+// set, prefixes the names of the metrics before the namespace of the module.
+// The json paths of the metrics are parsed once in the paths cache, if any.
+func CreateMetricsList(c config.Module, globalPrefix string, paths *JSONPaths) ([]JSONMetric, error) {
 	var (
 		metrics   []JSONMetric
 		valueType prometheus.ValueType
 	)
 	for _, metric := range c.Metrics {
+		// The CEL expressions are evaluated on the whole document
+		if c.BasePath != "" && metric.Engine != config.EngineTypeCEL {
+			var err error
+			if metric.Path, err = joinBasePath(c.BasePath, metric.Path); err != nil {
+				return nil, fmt.Errorf("%w, for metric: '%s'", err, metric.Name)
+			}
+		}
 		switch metric.ValueType {
 		case config.ValueTypeGauge:
 			valueType = prometheus.GaugeValue
@@ -87,106 +213,900 @@ func CreateMetricsList(c config.Module) ([]JSONMetric, error) {
 		default:
 			valueType = prometheus.UntypedValue
 		}
+		var numberFormat *NumberFormat
+		if metric.NumberFormat != nil {
+			var err error
+			if numberFormat, err = NewNumberFormat(*metric.NumberFormat); err != nil {
+				return nil, fmt.Errorf("%w, for metric: '%s'", err, metric.Name)
+			}
+		}
+		for name := range metric.StaticLabels {
+			if _, ok := metric.Labels[name]; ok {
+				return nil, fmt.Errorf("Label '%s' is both in labels and static_labels, for metric: '%s'", name, metric.Name)
+			}
+		}
+		for name := range metric.JoinLabels {
+			if _, ok := metric.Labels[name]; !ok {
+				return nil, fmt.Errorf("Label '%s' of join_labels is not in labels, for metric: '%s'", name, metric.Name)
+			}
+			if metric.Type == config.ZipScrape {
+				return nil, fmt.Errorf("join_labels is not supported by zip metrics, for metric: '%s'", metric.Name)
+			}
+		}
+		for name, hash := range metric.HashLabels {
+			if _, ok := metric.Labels[name]; !ok {
+				return nil, fmt.Errorf("Label '%s' of hash_labels is not in labels, for metric: '%s'", name, metric.Name)
+			}
+			if hash.Hash != config.LabelHashSHA256 {
+				return nil, fmt.Errorf("Unknown hash '%s' of label '%s', for metric: '%s'", hash.Hash, name, metric.Name)
+			}
+			if hash.Length < 0 || hash.Length > 2*sha256.Size {
+				return nil, fmt.Errorf("Invalid hash length %d of label '%s', for metric: '%s'", hash.Length, name, metric.Name)
+			}
+		}
+		for name, c := range metric.LabelCase {
+			if _, ok := metric.Labels[name]; !ok {
+				return nil, fmt.Errorf("Label '%s' of label_case is not in labels, for metric: '%s'", name, metric.Name)
+			}
+			if c != config.LabelCaseLower && c != config.LabelCaseUpper {
+				return nil, fmt.Errorf("Unknown case '%s' of label '%s', for metric: '%s'", c, name, metric.Name)
+			}
+		}
+		if c.Batch.Path != "" {
+			_, ok := metric.Labels[batchIDLabel(c.Batch)]
+			_, static := metric.StaticLabels[batchIDLabel(c.Batch)]
+			if ok || static {
+				return nil, fmt.Errorf("Label '%s' is the batch id label, for metric: '%s'", batchIDLabel(c.Batch), metric.Name)
+			}
+		}
+		metric.StaticLabels = constLabels(c.DefaultLabels, metric)
+		if !metric.AllowRecursiveDescent {
+			if path, ok := recursiveDescentPath(metric); ok {
+				return nil, fmt.Errorf("Recursive descent in path '%s' requires allow_recursive_descent, for metric: '%s'", path, metric.Name)
+			}
+		}
+		if metric.ValueTypePath != "" {
+			switch {
+			case metric.StatusCode:
+				return nil, fmt.Errorf("value_type_path is not supported by status_code metrics, for metric: '%s'", metric.Name)
+			case metric.Cookie != "":
+				return nil, fmt.Errorf("value_type_path is not supported by cookie metrics, for metric: '%s'", metric.Name)
+			case metric.Type == config.InfoScrape, metric.Type == config.DynamicScrape, metric.Type == config.TimeseriesScrape:
+				return nil, fmt.Errorf("value_type_path is not supported by %s metrics, for metric: '%s'", metric.Type, metric.Name)
+			}
+		}
+		if metric.Select != (config.Select{}) {
+			switch {
+			case metric.Select.Max != "" && metric.Select.Min != "":
+				return nil, fmt.Errorf("select max and min are mutually exclusive, for metric: '%s'", metric.Name)
+			case metric.Type != config.ObjectScrape && metric.Type != config.RatioScrape && metric.Type != config.InfoScrape && metric.Type != config.KeyCountScrape:
+				return nil, fmt.Errorf("select is only supported by object, ratio, info and key_count metrics, for metric: '%s'", metric.Name)
+			case metric.Path == "":
+				return nil, fmt.Errorf("select requires a path, for metric: '%s'", metric.Name)
+			}
+		}
+		if metric.RequireAllPaths {
+			switch {
+			case metric.Multi, metric.StatusCode, metric.Cookie != "":
+				return nil, fmt.Errorf("require_all_paths is not supported by multi, status_code and cookie metrics, for metric: '%s'", metric.Name)
+			case metric.Type != config.ValueScrape && metric.Type != config.ObjectScrape && metric.Type != config.RatioScrape && metric.Type != config.InfoScrape && metric.Type != config.KeyCountScrape:
+				return nil, fmt.Errorf("require_all_paths is not supported by %s metrics, for metric: '%s'", metric.Type, metric.Name)
+			}
+		}
+		if metric.Match != "" {
+			switch {
+			case metric.Match != config.MatchFirst && metric.Match != config.MatchLast:
+				return nil, fmt.Errorf("Unknown match '%s', for metric: '%s'", metric.Match, metric.Name)
+			case metric.Type != config.ValueScrape:
+				return nil, fmt.Errorf("match is only supported by value metrics, for metric: '%s'", metric.Name)
+			case metric.Multi, metric.StatusCode, metric.Cookie != "":
+				return nil, fmt.Errorf("match is not supported by multi, status_code and cookie metrics, for metric: '%s'", metric.Name)
+			}
+		}
+		if metric.CheckMonotonic && (metric.Type != config.ValueScrape || !metric.Multi || valueType != prometheus.CounterValue) {
+			return nil, fmt.Errorf("check_monotonic is only supported by multi value counters, for metric: '%s'", metric.Name)
+		}
+		if metric.EmitUpdateTimestamp {
+			switch {
+			case metric.EpochTimestamp == "":
+				return nil, fmt.Errorf("emit_update_timestamp requires epochTimestamp, for metric: '%s'", metric.Name)
+			case metric.Type == config.TimeseriesScrape, metric.Type == config.DynamicScrape:
+				return nil, fmt.Errorf("emit_update_timestamp is not supported by %s metrics, for metric: '%s'", metric.Type, metric.Name)
+			}
+		}
+		if metric.KeyPattern != "" && metric.Type != config.KeyCountScrape {
+			return nil, fmt.Errorf("key_pattern is only supported by key_count metrics, for metric: '%s'", metric.Name)
+		}
+		if metric.Scale != nil || metric.Offset != 0 {
+			switch {
+			case metric.Scale != nil && *metric.Scale == 0:
+				return nil, fmt.Errorf("scale must not be zero, for metric: '%s'", metric.Name)
+			case metric.Type != config.ValueScrape && metric.Type != config.ObjectScrape && metric.Type != config.TimeseriesScrape:
+				return nil, fmt.Errorf("scale and offset are only supported by value, object and timeseries metrics, for metric: '%s'", metric.Name)
+			case metric.StatusCode:
+				return nil, fmt.Errorf("scale and offset are not supported by status_code metrics, for metric: '%s'", metric.Name)
+			}
+		}
+		if metric.Filter != "" && metric.Type != config.ObjectScrape {
+			return nil, fmt.Errorf("filter is only supported by object metrics, for metric: '%s'", metric.Name)
+		}
+		switch metric.Engine {
+		case "", config.EngineTypeJSONPath:
+		case config.EngineTypeCEL:
+			switch {
+			case metric.Type != config.ValueScrape:
+				return nil, fmt.Errorf("engine cel is only supported by value metrics, for metric: '%s'", metric.Name)
+			case metric.Multi, metric.StatusCode, metric.Cookie != "":
+				return nil, fmt.Errorf("engine cel is not supported by multi, status_code and cookie metrics, for metric: '%s'", metric.Name)
+			case metric.Match != "", metric.EpochTimestamp != "", metric.ValueTypePath != "", len(metric.JoinLabels) != 0, metric.RequireAllPaths, metric.Invert, metric.NumberFormat != nil:
+				return nil, fmt.Errorf("engine cel does not support match, epochTimestamp, value_type_path, join_labels, require_all_paths, invert and number_format, for metric: '%s'", metric.Name)
+			}
+		default:
+			return nil, fmt.Errorf("Unknown engine '%s', for metric: '%s'", metric.Engine, metric.Name)
+		}
+		first := len(metrics)
+		metricName := metric.Name
+		if prefix := metricNamePrefix(c, globalPrefix); prefix != "" {
+			metricName = MakeMetricName(prefix, metric.Name)
+		}
 		switch metric.Type {
 		case config.ValueScrape:
-			var variableLabels, variableLabelsValues []string
-			for k, v := range metric.Labels {
-				variableLabels = append(variableLabels, k)
-				variableLabelsValues = append(variableLabelsValues, v)
-			}
-			jsonMetric := JSONMetric{
-				Type: config.ValueScrape,
-				Desc: prometheus.NewDesc(
-					metric.Name,
-					metric.Help,
-					variableLabels,
-					nil,
-				),
-				KeyJSONPath:            metric.Path,
-				LabelsJSONPaths:        variableLabelsValues,
-				ValueType:              valueType,
-				EpochTimestampJSONPath: metric.EpochTimestamp,
+			if err := validatePrefixedName(c, globalPrefix, metricName); err != nil {
+				return nil, err
+			}
+			if metric.StatusCode && (len(metric.Labels) != 0 || metric.Multi || metric.EpochTimestamp != "") {
+				return nil, fmt.Errorf("status_code metrics only support static_labels, for metric: '%s'", metric.Name)
+			}
+			if metric.Cookie != "" && (metric.StatusCode || len(metric.Labels) != 0 || metric.Multi || metric.EpochTimestamp != "") {
+				return nil, fmt.Errorf("cookie metrics only support static_labels, for metric: '%s'", metric.Name)
 			}
+			var indexLabel string
+			if metric.Multi {
+				indexLabel = metric.IndexLabel
+			}
+			var parentPath, valueField string
+			var siblingLabels, siblingLabelsValues []string
+			if len(metric.SiblingLabels) != 0 {
+				if !metric.Multi {
+					return nil, fmt.Errorf("sibling_labels require multi for metric: '%s'", metric.Name)
+				}
+				var ok bool
+				if parentPath, valueField, ok = splitLastField(metric.Path); !ok {
+					return nil, fmt.Errorf("sibling_labels require a path ending with a field, such as '{.items[*].value}', for metric: '%s'", metric.Name)
+				}
+				siblingLabels, siblingLabelsValues = sortedLabels(metric.SiblingLabels)
+			}
+			jsonMetric := newJSONMetric(c, metric, metricName, valueType, numberFormat, []string{indexLabel}, siblingLabels)
+			jsonMetric.Multi = metric.Multi
+			jsonMetric.IndexLabel = indexLabel
+			jsonMetric.ParentJSONPath = parentPath
+			jsonMetric.ValueField = valueField
+			jsonMetric.SiblingLabelsJSONPaths = siblingLabelsValues
+			jsonMetric.Invert = metric.Invert
+			jsonMetric.StatusCode = metric.StatusCode
+			jsonMetric.Cookie = metric.Cookie
+			jsonMetric.Match = metric.Match
+			jsonMetric.CheckMonotonic = metric.CheckMonotonic
+			if metric.Engine == config.EngineTypeCEL {
+				if err := compileCEL(paths, &jsonMetric); err != nil {
+					return nil, fmt.Errorf("%w, for metric: '%s'", err, metric.Name)
+				}
+			}
+			paths.precompile(jsonMetric.ParentJSONPath)
+			paths.precompile(jsonMetric.SiblingLabelsJSONPaths...)
 			metrics = append(metrics, jsonMetric)
-		case config.ObjectScrape:
+		case config.ObjectScrape, config.TimeseriesScrape:
+			if metric.Type == config.TimeseriesScrape && metric.EpochTimestamp == "" {
+				return nil, fmt.Errorf("Missing epochTimestamp for timeseries metric: '%s'", metric.Name)
+			}
 			for subName, valuePath := range metric.Values {
-				name := MakeMetricName(metric.Name, subName)
-				var variableLabels, variableLabelsValues []string
-				for k, v := range metric.Labels {
-					variableLabels = append(variableLabels, k)
-					variableLabelsValues = append(variableLabelsValues, v)
-				}
-				jsonMetric := JSONMetric{
-					Type: config.ObjectScrape,
-					Desc: prometheus.NewDesc(
-						name,
-						metric.Help,
-						variableLabels,
-						nil,
-					),
-					KeyJSONPath:            metric.Path,
-					ValueJSONPath:          valuePath,
-					LabelsJSONPaths:        variableLabelsValues,
-					ValueType:              valueType,
-					EpochTimestampJSONPath: metric.EpochTimestamp,
+				name := MakeMetricName(metricName, subName)
+				if err := validatePrefixedName(c, globalPrefix, name); err != nil {
+					return nil, err
 				}
+				jsonMetric := newJSONMetric(c, metric, name, valueType, numberFormat, []string{metric.KeyLabel, metric.IndexLabel}, nil)
+				jsonMetric.ValueJSONPath = valuePath
+				jsonMetric.IndexLabel = metric.IndexLabel
+				jsonMetric.KeyLabel = metric.KeyLabel
+				jsonMetric.Invert = metric.Invert
+				paths.precompile(jsonMetric.ValueJSONPath)
 				metrics = append(metrics, jsonMetric)
 			}
+			if metric.Type == config.ObjectScrape && len(metrics) > first {
+				metrics[first].SharedValues = len(metrics) - first
+			}
+		case config.ZipScrape:
+			if err := validatePrefixedName(c, globalPrefix, metricName); err != nil {
+				return nil, err
+			}
+			jsonMetric := newJSONMetric(c, metric, metricName, valueType, numberFormat, []string{metric.IndexLabel}, nil)
+			jsonMetric.IndexLabel = metric.IndexLabel
+			jsonMetric.Invert = metric.Invert
+			metrics = append(metrics, jsonMetric)
+		case config.RatioScrape:
+			if metric.Ratio.Numerator == "" || metric.Ratio.Denominator == "" {
+				return nil, fmt.Errorf("Missing ratio numerator or denominator for metric: '%s'", metric.Name)
+			}
+			if err := validatePrefixedName(c, globalPrefix, metricName); err != nil {
+				return nil, err
+			}
+			jsonMetric := newJSONMetric(c, metric, metricName, valueType, numberFormat, []string{metric.IndexLabel}, nil)
+			jsonMetric.IndexLabel = metric.IndexLabel
+			jsonMetric.Ratio = metric.Ratio
+			paths.precompile(metric.Ratio.Numerator, metric.Ratio.Denominator)
+			metrics = append(metrics, jsonMetric)
+		case config.InfoScrape:
+			if len(metric.Labels) == 0 {
+				return nil, fmt.Errorf("Missing labels for info metric: '%s'", metric.Name)
+			}
+			if err := validatePrefixedName(c, globalPrefix, metricName); err != nil {
+				return nil, err
+			}
+			jsonMetric := newJSONMetric(c, metric, metricName, prometheus.GaugeValue, nil, []string{metric.IndexLabel}, nil)
+			jsonMetric.IndexLabel = metric.IndexLabel
+			metrics = append(metrics, jsonMetric)
+		case config.KeyCountScrape:
+			keyPattern, err := regexp.Compile(metric.KeyPattern)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid key_pattern '%s': %w, for metric: '%s'", metric.KeyPattern, err, metric.Name)
+			}
+			if err := validatePrefixedName(c, globalPrefix, metricName); err != nil {
+				return nil, err
+			}
+			jsonMetric := newJSONMetric(c, metric, metricName, valueType, nil, []string{metric.IndexLabel}, nil)
+			jsonMetric.IndexLabel = metric.IndexLabel
+			jsonMetric.KeyPattern = keyPattern
+			metrics = append(metrics, jsonMetric)
+		case config.DynamicScrape:
+			if metric.Dynamic.Name != "" && metric.Dynamic.Value == "" {
+				return nil, fmt.Errorf("Missing dynamic value path for metric: '%s'", metric.Name)
+			}
+			var prefix []string
+			for _, p := range []string{metricNamePrefix(c, globalPrefix), metric.Name} {
+				if p != "" {
+					prefix = append(prefix, p)
+				}
+			}
+			jsonMetric := newJSONMetric(c, metric, MakeMetricName(prefix...), valueType, numberFormat, nil, nil)
+			// Described as they are collected, with the names read from the data
+			jsonMetric.Desc = nil
+			jsonMetric.LabelNames, _ = sortedLabels(metric.Labels)
+			jsonMetric.Invert = metric.Invert
+			jsonMetric.Dynamic = metric.Dynamic
+			paths.precompile(metric.Dynamic.Name, metric.Dynamic.Value, metric.Dynamic.Help, metric.Dynamic.Type)
+			metrics = append(metrics, jsonMetric)
 		default:
 			return nil, fmt.Errorf("Unknown metric type: '%s', for metric: '%s'", metric.Type, metric.Name)
 		}
+		for i := first; i < len(metrics); i++ {
+			metrics[i].ValueTypeJSONPath = metric.ValueTypePath
+			metrics[i].Select = metric.Select
+			metrics[i].FilterJSONPath = metric.Filter
+			metrics[i].Paths = paths
+			if metric.Scale != nil {
+				metrics[i].Scale = *metric.Scale
+			}
+			metrics[i].Offset = metric.Offset
+			metrics[i].RequireAllPaths = metric.RequireAllPaths
+		}
+		if metric.Engine == config.EngineTypeCEL {
+			continue
+		}
+		paths.precompile(metric.Path, metric.EpochTimestamp, metric.ValueTypePath, metric.Select.Max, metric.Select.Min, metric.Filter)
+		if len(metrics) > first {
+			paths.precompile(metrics[first].LabelsJSONPaths...)
+		}
+	}
+	for name := range c.EmitOnFailure {
+		found := false
+		for _, m := range metrics {
+			found = found || m.Name == name
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown metric: '%s', in emit_on_failure", name)
+		}
 	}
 	return metrics, nil
 }
 
+// Compiles the path and the labels of a metric whose engine is CEL, in the
+// cache if any
+func compileCEL(paths *JSONPaths, m *JSONMetric) error {
+	m.EngineType = config.EngineTypeCEL
+	prg, err := paths.program(m.KeyJSONPath)
+	if err != nil {
+		return fmt.Errorf("Invalid CEL expression '%s': %w", m.KeyJSONPath, err)
+	}
+	m.CELProgram = prg
+	m.CELLabelPrograms = make([]cel.Program, len(m.LabelsJSONPaths))
+	for i, expr := range m.LabelsJSONPaths {
+		if m.CELLabelPrograms[i], err = paths.program(expr); err != nil {
+			return fmt.Errorf("Invalid CEL expression '%s': %w", expr, err)
+		}
+	}
+	return nil
+}
+
+// Returns the json metric of the given name with the fields which all the
+// scrape types share. Its variable labels are the labels of the metric, the
+// labels of its type which are set, the meta labels of the module and the
+// trailing labels, in that order.
+func newJSONMetric(c config.Module, metric config.Metric, name string, valueType prometheus.ValueType, numberFormat *NumberFormat, typeLabels, trailingLabels []string) JSONMetric {
+	variableLabels, variableLabelsValues := sortedLabels(metric.Labels)
+	for _, label := range typeLabels {
+		if label != "" {
+			variableLabels = append(variableLabels, label)
+		}
+	}
+	metaLabels := metaLabelNames(c, metric.Labels, metric.StaticLabels)
+	variableLabels = append(variableLabels, metaLabels...)
+	variableLabels = append(variableLabels, trailingLabels...)
+	return JSONMetric{
+		Type: metric.Type,
+		Name: name,
+		Help: metric.Help,
+		Desc: prometheus.NewDesc(
+			name,
+			metric.Help,
+			variableLabels,
+			metric.StaticLabels,
+		),
+		KeyJSONPath:            metric.Path,
+		LabelsJSONPaths:        variableLabelsValues,
+		LabelSeparators:        labelSeparators(metric, variableLabels),
+		LabelHashes:            labelHashes(metric, variableLabels),
+		LabelCases:             labelCases(metric, variableLabels),
+		UpdateTimestampDesc:    updateTimestampDesc(metric, name, variableLabels),
+		MetaLabels:             metaLabels,
+		ValueType:              valueType,
+		EpochTimestampJSONPath: metric.EpochTimestamp,
+		NumberFormat:           numberFormat,
+		MaxMatches:             metric.MaxMatches,
+		StaticLabels:           metric.StaticLabels,
+		AllowMissingKeys:       c.AllowMissingKeys,
+	}
+}
+
+// Returns the constant labels of the metric: its static labels, and the
+// default labels of its module which it does not override with a label or a
+// static label of the same name
+func constLabels(defaultLabels map[string]string, metric config.Metric) map[string]string {
+	if len(defaultLabels) == 0 {
+		return metric.StaticLabels
+	}
+	labels := make(map[string]string, len(defaultLabels)+len(metric.StaticLabels))
+	for name, value := range defaultLabels {
+		if _, ok := metric.Labels[name]; !ok {
+			labels[name] = value
+		}
+	}
+	for name, value := range metric.StaticLabels {
+		labels[name] = value
+	}
+	return labels
+}
+
+// Returns the separators of the labels of the metric joining all their
+// matches, by position in names, which starts with the labels of the metric
+func labelSeparators(metric config.Metric, names []string) map[int]string {
+	if len(metric.JoinLabels) == 0 {
+		return nil
+	}
+	separators := make(map[int]string, len(metric.JoinLabels))
+	for i, name := range names[:len(metric.Labels)] {
+		if sep, ok := metric.JoinLabels[name]; ok {
+			separators[i] = sep
+		}
+	}
+	return separators
+}
+
+// Returns the hashes of the hashed labels, by position in the label names
+func labelHashes(metric config.Metric, names []string) map[int]config.LabelHash {
+	if len(metric.HashLabels) == 0 {
+		return nil
+	}
+	hashes := make(map[int]config.LabelHash, len(metric.HashLabels))
+	for i, name := range names[:len(metric.Labels)] {
+		if hash, ok := metric.HashLabels[name]; ok {
+			hashes[i] = hash
+		}
+	}
+	return hashes
+}
+
+// Returns the hex digest of the label value, truncated to the length of the
+// hash if set. Empty values, such as missing keys, are kept empty.
+func hashLabel(value string, hash config.LabelHash) string {
+	if value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(value))
+	digest := hex.EncodeToString(sum[:])
+	if hash.Length > 0 {
+		digest = digest[:hash.Length]
+	}
+	return digest
+}
+
+// Returns the names of the labels, sorted so that the descriptions of the
+// metrics do not depend on the order of the map, along with their paths
+func sortedLabels(labels map[string]string) ([]string, []string) {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	paths := make([]string, len(names))
+	for i, name := range names {
+		paths[i] = labels[name]
+	}
+	return names, paths
+}
+
+// Returns the description of the gauge holding the timestamp of the data of the
+// metric, with the same labels, if it emits one
+func updateTimestampDesc(metric config.Metric, name string, variableLabels []string) *prometheus.Desc {
+	if !metric.EmitUpdateTimestamp {
+		return nil
+	}
+	return prometheus.NewDesc(
+		name+"_last_update_timestamp_seconds",
+		"Timestamp of the last update of the data of "+name+", in seconds since the epoch.",
+		variableLabels,
+		metric.StaticLabels,
+	)
+}
+
+// Returns the cases of the converted labels, by position in the label names
+func labelCases(metric config.Metric, names []string) map[int]config.LabelCase {
+	if len(metric.LabelCase) == 0 {
+		return nil
+	}
+	cases := make(map[int]config.LabelCase, len(metric.LabelCase))
+	for i, name := range names[:len(metric.Labels)] {
+		if c, ok := metric.LabelCase[name]; ok {
+			cases[i] = c
+		}
+	}
+	return cases
+}
+
+// Converts the label value to the case. It is converted before being hashed,
+// if it also is, so that the values differing only by case hash the same.
+func caseLabel(value string, c config.LabelCase) string {
+	if c == config.LabelCaseUpper {
+		return strings.ToUpper(value)
+	}
+	return strings.ToLower(value)
+}
+
+// ValidateConfig builds the metrics of every module and parses all their json
+// paths up front. It returns every failure found, naming the module and the
+// metric, instead of stopping at the first one. The metric names are built
+// with the global prefix, as CreateMetricsList does.
+func ValidateConfig(c config.Config, globalPrefix string) []error {
+	var errs []error
+	modules := make([]string, 0, len(c.Modules))
+	for name := range c.Modules {
+		modules = append(modules, name)
+	}
+	sort.Strings(modules)
+
+	for _, name := range modules {
+		module := c.Modules[name]
+		if _, err := CreateMetricsList(module, globalPrefix, nil); err != nil {
+			errs = append(errs, fmt.Errorf("module %q: %w", name, err))
+		}
+		for _, p := range []string{module.Batch.Path, module.Batch.ID, module.Batch.Body} {
+			if p == "" {
+				continue
+			}
+			if err := jsonpath.New("jp").Parse(p); err != nil {
+				errs = append(errs, fmt.Errorf("module %q: invalid batch json path %q: %w", name, p, err))
+			}
+		}
+		if module.Body.Content != "" && module.Body.JSON != nil {
+			errs = append(errs, fmt.Errorf("module %q: body content and json are mutually exclusive", name))
+		}
+		if module.Charset != "" {
+			if _, err := htmlindex.Get(module.Charset); err != nil {
+				errs = append(errs, fmt.Errorf("module %q: unsupported charset %q", name, module.Charset))
+			}
+		}
+		if module.ErrorPath != "" {
+			if err := jsonpath.New("jp").Parse(module.ErrorPath); err != nil {
+				errs = append(errs, fmt.Errorf("module %q: invalid error json path %q: %w", name, module.ErrorPath, err))
+			}
+		}
+		if auto := module.AutoModule; auto.Discriminator != "" {
+			errs = append(errs, validateAutoModule(c, name, auto)...)
+			if len(module.Metrics) != 0 {
+				errs = append(errs, fmt.Errorf("module %q: auto_module and metrics are mutually exclusive", name))
+			}
+		} else if auto.Path != "" || len(auto.Modules) != 0 || auto.Default != "" {
+			errs = append(errs, fmt.Errorf("module %q: auto_module requires a discriminator", name))
+		}
+		if _, err := url.Parse(module.PreRequest.Path); err != nil {
+			errs = append(errs, fmt.Errorf("module %q: invalid pre request path: %w", name, err))
+		}
+		for _, metric := range module.Metrics {
+			// The CEL expressions are compiled by CreateMetricsList
+			if metric.Engine == config.EngineTypeCEL {
+				continue
+			}
+			// Relative paths are only valid json paths once joined
+			path, err := joinBasePath(module.BasePath, metric.Path)
+			if module.BasePath == "" || err != nil {
+				path = metric.Path
+			}
+			paths := []string{path}
+			if metric.EpochTimestamp != "" {
+				paths = append(paths, metric.EpochTimestamp)
+			}
+			for _, p := range metric.Labels {
+				paths = append(paths, p)
+			}
+			for _, p := range metric.Values {
+				paths = append(paths, p)
+			}
+			for _, p := range []string{metric.ValueTypePath, metric.Select.Max, metric.Select.Min, metric.Filter, metric.Dynamic.Name, metric.Dynamic.Value, metric.Dynamic.Help, metric.Dynamic.Type, metric.Ratio.Numerator, metric.Ratio.Denominator} {
+				if p != "" {
+					paths = append(paths, p)
+				}
+			}
+			for _, p := range paths {
+				// Templated paths are only valid json paths once rendered
+				if module.TemplatizePaths && strings.Contains(p, "{{") {
+					if _, err := template.New("path").Funcs(pathTemplateFuncs()).Parse(p); err != nil {
+						errs = append(errs, fmt.Errorf("module %q, metric %q: invalid path template %q: %w", name, metric.Name, p, err))
+					}
+					continue
+				}
+				if err := jsonpath.New("jp").Parse(p); err != nil {
+					errs = append(errs, fmt.Errorf("module %q, metric %q: invalid json path %q: %w", name, metric.Name, p, err))
+				}
+			}
+		}
+	}
+	return errs
+}
+
+var lastFieldRE = regexp.MustCompile(`^\{\s*(.*\S)\.([A-Za-z0-9_-]+)\s*\}$`)
+
+// Splits a json path such as '{.items[*].value}' into the path of the parent
+// elements, '{.items[*]}', and the name of the last field, 'value'
+func splitLastField(path string) (string, string, bool) {
+	match := lastFieldRE.FindStringSubmatch(path)
+	if match == nil {
+		return "", "", false
+	}
+	return "{" + match[1] + "}", match[2], true
+}
+
+// Returns the path of a metric relative to the base path of its module, e.g.
+// '{.data.result}' and '{.items[*]}' give '{.data.result.items[*]}'. Empty
+// paths and absolute paths, starting with '{$', are returned as is.
+func joinBasePath(base, path string) (string, error) {
+	inner := func(p string) (string, bool) {
+		p = strings.TrimSpace(p)
+		if !strings.HasPrefix(p, "{") || !strings.HasSuffix(p, "}") {
+			return "", false
+		}
+		return strings.TrimSpace(p[1 : len(p)-1]), true
+	}
+	relative, ok := inner(path)
+	if path == "" || ok && strings.HasPrefix(relative, "$") {
+		return path, nil
+	}
+	prefix, baseOK := inner(base)
+	if !baseOK || !ok {
+		return "", fmt.Errorf("base path '%s' and path '%s' must both be a single '{...}' expression", base, path)
+	}
+	if !strings.HasPrefix(relative, ".") && !strings.HasPrefix(relative, "[") {
+		relative = "." + relative
+	}
+	return "{" + prefix + relative + "}", nil
+}
+
+// Returns the first path of the metric using recursive descent, if any
+func recursiveDescentPath(metric config.Metric) (string, bool) {
+	paths := []string{metric.Path, metric.EpochTimestamp, metric.ValueTypePath, metric.Select.Max, metric.Select.Min, metric.Filter, metric.Dynamic.Name, metric.Dynamic.Value, metric.Dynamic.Help, metric.Dynamic.Type, metric.Ratio.Numerator, metric.Ratio.Denominator}
+	for _, m := range []map[string]string{metric.Labels, metric.Values, metric.SiblingLabels} {
+		for _, p := range m {
+			paths = append(paths, p)
+		}
+	}
+	for _, p := range paths {
+		if hasRecursiveDescent(p) {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// Metric names are only validated when prefixed, to keep accepting the
+// names of existing configurations as is
+func validatePrefixedName(c config.Module, globalPrefix, name string) error {
+	if prefix := metricNamePrefix(c, globalPrefix); prefix != "" && !model.IsValidLegacyMetricName(name) {
+		return fmt.Errorf("Invalid metric name: '%s', with metric name prefix: '%s'", name, prefix)
+	}
+	return nil
+}
+
+// Returns the prefix of the metric names of the module, combining the global
+// prefix and its namespace, subsystem and metric name prefix as in
+// global_namespace_subsystem_name
+func metricNamePrefix(c config.Module, globalPrefix string) string {
+	var parts []string
+	for _, p := range []string{globalPrefix, c.Namespace, c.Subsystem, c.MetricNamePrefix} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return MakeMetricName(parts...)
+}
+
+// Returns the meta label names to inject into a metric of the given module.
+// Labels already defined by the user on the metric take precedence and are
+// not injected again.
+func metaLabelNames(c config.Module, labels, staticLabels map[string]string) []string {
+	var names []string
+	if c.InjectMetaLabels {
+		for _, name := range []string{ModuleLabel, TargetLabel} {
+			_, ok := labels[name]
+			_, static := staticLabels[name]
+			if !ok && !static {
+				names = append(names, name)
+			}
+		}
+	}
+	if c.Batch.Path != "" {
+		names = append(names, batchIDLabel(c.Batch))
+	}
+	return names
+}
+
 type JSONFetcher struct {
-	module config.Module
-	ctx    context.Context
-	logger *slog.Logger
-	method string
-	body   io.Reader
+	module       config.Module
+	ctx          context.Context
+	logger       *slog.Logger
+	method       string
+	contentType  string
+	body         io.Reader
+	requestID    string
+	traceContext http.Header
+	last         FetchRecord
+}
+
+// FetchRecord describes the last request of a fetch and its response, for the
+// audit log. The status code is 0 if no response was received.
+type FetchRecord struct {
+	Method     string
+	StatusCode int
+	Bytes      int
+	Body       []byte
+	// Whether the response of an identical fetch of another probe was
+	// served, within the debounce window of the module
+	Shared bool
 }
 
 func NewJSONFetcher(ctx context.Context, logger *slog.Logger, m config.Module, tplValues url.Values) *JSONFetcher {
-	method, body := renderBody(logger, m.Body, tplValues)
-	return &JSONFetcher{
-		module: m,
-		ctx:    ctx,
-		logger: logger,
-		method: method,
-		body:   body,
+	method, contentType, body := renderBody(logger, m.Body, tplValues)
+	f := &JSONFetcher{
+		module:      m,
+		ctx:         ctx,
+		logger:      logger,
+		method:      method,
+		contentType: contentType,
+		body:        body,
+	}
+	if m.RequestIDHeader != "" {
+		f.requestID = newRequestID()
+		f.logger = logger.With("request_id", f.requestID)
+	}
+	return f
+}
+
+// ForwardTraceContext forwards the W3C trace context headers of the incoming
+// probe request to the target, if enabled by the module
+func (f *JSONFetcher) ForwardTraceContext(incoming http.Header) {
+	if !f.module.ForwardTraceContext {
+		return
 	}
+	f.traceContext = http.Header{}
+	for _, name := range []string{"Traceparent", "Tracestate"} {
+		if value := incoming.Get(name); value != "" {
+			f.traceContext.Set(name, value)
+		}
+	}
+}
+
+// LastFetch returns the record of the last request of the fetch, even if it
+// failed
+func (f *JSONFetcher) LastFetch() FetchRecord {
+	return f.last
+}
+
+// Returns a random identifier for the fetch of a probe
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// FetchJSON fetches the endpoint and returns the response body along with the
+// response headers and status code. The body is nil when the module skips
+// empty responses. Identical fetches are shared within the debounce window of
+// the module.
+func (f *JSONFetcher) FetchJSON(endpoint string) ([]byte, http.Header, int, error) {
+	f.last = FetchRecord{Method: f.method}
+	fetch := f.fetchJSON
+	if f.module.Debounce > 0 {
+		fetch = f.fetchShared
+	}
+	if f.module.InvalidJSONRetries <= 0 {
+		return fetch(endpoint)
+	}
+
+	// The body is read by each fetch
+	var body string
+	hasBody := f.body != nil
+	if hasBody {
+		b, err := io.ReadAll(f.body)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		body = string(b)
+		f.body = strings.NewReader(body)
+	}
+	data, header, status, err := fetch(endpoint)
+	// A response which is not valid json, e.g. while the target refreshes
+	// it, is fetched again. The retries are never shared, as the shared
+	// response would be the same.
+	for i := 0; i < f.module.InvalidJSONRetries && err == nil && len(bytes.TrimSpace(data)) != 0 && !json.Valid(data); i++ {
+		f.logger.Debug("Fetching again invalid json response", "attempt", i+1)
+		if hasBody {
+			f.body = strings.NewReader(body)
+		}
+		data, header, status, err = f.fetchJSON(endpoint)
+	}
+	return data, header, status, err
 }
 
-func (f *JSONFetcher) FetchJSON(endpoint string) ([]byte, error) {
+func (f *JSONFetcher) fetchJSON(endpoint string) ([]byte, http.Header, int, error) {
 	httpClientConfig := f.module.HTTPClientConfig
-	client, err := pconfig.NewClientFromConfig(httpClientConfig, "fetch_json", pconfig.WithKeepAlivesDisabled(), pconfig.WithHTTP2Disabled())
+	renegotiation, err := tlsRenegotiationSupport(f.module.TLSRenegotiation)
 	if err != nil {
 		f.logger.Error("Error generating HTTP client", "err", err)
-		return nil, err
+		return nil, nil, 0, err
+	}
+	newTLSConfig := func(ctx context.Context, cfg *pconfig.TLSConfig, opts ...pconfig.TLSConfigOption) (*tls.Config, error) {
+		tlsConfig, err := pconfig.NewTLSConfigWithContext(ctx, cfg, opts...)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Renegotiation = renegotiation
+		if rule := matchTLSCertRule(f.module.TLSCertRules, endpoint); rule != nil {
+			tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				cert, err := tls.LoadX509KeyPair(rule.CertFile, rule.KeyFile)
+				if err != nil {
+					return nil, fmt.Errorf("unable to load client cert %s and key %s for host %s: %w", rule.CertFile, rule.KeyFile, rule.Host, err)
+				}
+				return &cert, nil
+			}
+		}
+		return tlsConfig, nil
+	}
+	var versionOptions []pconfig.HTTPClientOption
+	if f.module.HTTP3 {
+		var transport io.Closer
+		versionOptions, transport, err = f.http3Options(endpoint, newTLSConfig)
+		if transport != nil {
+			defer transport.Close()
+		}
+	} else {
+		var dial pconfig.DialContextFunc
+		if f.module.SSHTunnel.Host != "" {
+			tunnel, err := f.openSSHTunnel()
+			if err != nil {
+				f.logger.Error("Error opening SSH tunnel", "err", err)
+				return nil, nil, 0, err
+			}
+			defer tunnel.Close()
+			dial = tunnel.DialContext
+		}
+		versionOptions, err = httpVersionOptions(f.module.HTTPVersion, endpoint, &httpClientConfig, dial)
+	}
+	if err != nil {
+		f.logger.Error("Error generating HTTP client", "err", err)
+		return nil, nil, 0, err
+	}
+	client, err := pconfig.NewClientFromConfig(httpClientConfig, "fetch_json", append(versionOptions,
+		pconfig.WithKeepAlivesDisabled(),
+		pconfig.WithNewTLSConfigFunc(newTLSConfig),
+	)...)
+	if err != nil {
+		f.logger.Error("Error generating HTTP client", "err", err)
+		return nil, nil, 0, err
+	}
+	if f.module.HTTP3 {
+		client.Transport = http3Downgrade{client.Transport}
+	}
+	if f.module.MaxRedirects > 0 && httpClientConfig.FollowRedirects {
+		client.CheckRedirect = checkRedirect(f.module.MaxRedirects)
 	}
 
+	method, body := f.method, f.body
+	if f.module.InputFormat == config.InputFormatGRPCWeb {
+		method = http.MethodPost
+		if body, err = grpcWebRequestBody(body); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+
+	f.last = FetchRecord{Method: method}
 	var req *http.Request
-	req, err = http.NewRequest(f.method, endpoint, f.body)
+	req, err = http.NewRequest(method, endpoint, body)
 	req = req.WithContext(f.ctx)
 	if err != nil {
 		f.logger.Error("Failed to create request", "err", err)
-		return nil, err
+		return nil, nil, 0, err
 	}
 
 	for key, value := range f.module.Headers {
 		req.Header.Add(key, value)
 	}
-	if req.Header.Get("Accept") == "" {
+	for _, conditional := range f.module.ConditionalHeaders {
+		if !matchTarget(conditional.Match, req.URL) {
+			continue
+		}
+		for key, value := range conditional.Headers {
+			req.Header.Set(key, value)
+		}
+	}
+	if f.module.InputFormat == config.InputFormatGRPCWeb {
+		if req.Header.Get("Content-Type") == "" {
+			req.Header.Set("Content-Type", grpcWebContentType)
+		}
+		if req.Header.Get("Accept") == "" {
+			req.Header.Set("Accept", grpcWebContentType)
+		}
+		req.Header.Set("X-Grpc-Web", "1")
+	}
+	if f.contentType != "" && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", f.contentType)
+	}
+	if f.requestID != "" {
+		req.Header.Set(f.module.RequestIDHeader, f.requestID)
+	}
+	for name, values := range f.traceContext {
+		req.Header[name] = values
+	}
+	if req.Header.Get("Accept") == "" && f.module.InputFormat == config.InputFormatSSE {
+		req.Header.Add("Accept", "text/event-stream")
+	} else if req.Header.Get("Accept") == "" {
 		req.Header.Add("Accept", "application/json")
 	}
-	resp, err := client.Do(req)
+	if f.module.TailBytes > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=-%d", f.module.TailBytes))
+	}
+	resp, err := f.doInSession(client, req)
 	if err != nil {
-		return nil, err
+		return nil, nil, 0, err
+	}
+	if f.module.HTTPVersion == config.HTTPVersion2 && resp.TLS != nil && resp.ProtoMajor != 2 {
+		resp.Body.Close()
+		return nil, nil, 0, fmt.Errorf("target did not negotiate HTTP/2, got %s", resp.Proto)
 	}
+	f.last.StatusCode = resp.StatusCode
 
+	streaming := f.module.InputFormat == config.InputFormatNDJSONStream || f.module.InputFormat == config.InputFormatSSE
 	defer func() {
-		if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		// A stream is closed once read, so there is nothing left to discard
+		if _, err := io.Copy(io.Discard, resp.Body); err != nil && !streaming {
 			f.logger.Error("Failed to discard body", "err", err)
 		}
 		resp.Body.Close()
@@ -200,32 +1120,555 @@ func (f *JSONFetcher) FetchJSON(endpoint string) ([]byte, error) {
 				break
 			}
 		}
-		if !success {
-			return nil, errors.New(resp.Status)
+		if !success && !(f.module.TailBytes > 0 && resp.StatusCode == http.StatusPartialContent) {
+			return nil, nil, 0, errors.New(resp.Status)
 		}
 	} else if resp.StatusCode/100 != 2 {
-		return nil, errors.New(resp.Status)
+		return nil, nil, 0, errors.New(resp.Status)
+	}
+
+	if f.module.RequireContentType != "" {
+		if err := checkContentType(resp.Header.Get("Content-Type"), f.module.RequireContentType); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+
+	var data []byte
+	switch f.module.InputFormat {
+	case "", config.InputFormatJSON:
+		data, err = io.ReadAll(resp.Body)
+	case config.InputFormatNDJSONStream:
+		data, err = readNDJSONStream(f.logger, resp.Body, time.Duration(f.module.ReadDuration))
+	case config.InputFormatSSE:
+		data, err = readSSEStream(f.logger, resp.Body, time.Duration(f.module.ReadDuration))
+	case config.InputFormatURLEncoded:
+		data, err = readURLEncoded(resp.Body)
+	case config.InputFormatGRPCWeb:
+		data, err = readGRPCWeb(resp.Body, resp.Header)
+	default:
+		err = fmt.Errorf("Unknown input format: '%s'", f.module.InputFormat)
+	}
+	f.last.Bytes, f.last.Body = len(data), data
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	// The other input formats have their own encodings
+	if f.module.InputFormat == "" || f.module.InputFormat == config.InputFormatJSON {
+		if data, err = decodeCharset(data, f.module.Charset, resp.Header.Get("Content-Type")); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+
+	if f.module.StripJSONP && len(bytes.TrimSpace(data)) != 0 {
+		if data, err = stripJSONP(data); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+
+	if f.module.NonFiniteLiterals {
+		data = quoteNonFiniteNumbers(data)
+	}
+
+	if len(bytes.TrimSpace(data)) == 0 {
+		if data, err = emptyBody(f.module.OnEmptyBody); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+
+	if f.module.TailBytes > 0 && data != nil {
+		// Servers not supporting range requests send the whole content
+		if resp.StatusCode != http.StatusPartialContent && int64(len(data)) > f.module.TailBytes {
+			data = data[int64(len(data))-f.module.TailBytes:]
+		}
+		if !json.Valid(data) {
+			return nil, nil, 0, fmt.Errorf("last %d bytes of the response are not valid JSON", f.module.TailBytes)
+		}
+	}
+
+	if f.module.RejectDuplicateKeys || f.logger.Enabled(f.ctx, slog.LevelDebug) {
+		dups, err := duplicateKeys(data)
+		if err != nil {
+			// Invalid JSON is reported while extracting the metrics
+			f.logger.Debug("Failed to check response for duplicate keys", "err", err)
+		} else if len(dups) != 0 {
+			f.logger.Debug("Duplicate keys found in response", "keys", dups)
+			if f.module.RejectDuplicateKeys {
+				return nil, nil, 0, fmt.Errorf("duplicate keys in response: %s", strings.Join(dups, ", "))
+			}
+		}
+	}
+
+	if f.module.ErrorPath != "" && data != nil {
+		if err := responseError(f.logger, data, f.module.ErrorPath); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+
+	return data, resp.Header, resp.StatusCode, nil
+}
+
+// Returns the error reported in the envelope of a response whose status code
+// is accepted, such as '{"error": "rate limited"}' with a 200: the value at the
+// error path, unless it is missing, null, empty, false or 0
+func responseError(logger *slog.Logger, data []byte, path string) error {
+	var jsonData interface{}
+	if err := json.Unmarshal(data, &jsonData); err != nil {
+		// Invalid JSON is reported while extracting the metrics
+		return nil
+	}
+	values, err := extractObjects(nil, logger, jsonData, path, true)
+	if err != nil {
+		return err
+	}
+	for _, value := range values {
+		switch v := value.(type) {
+		case nil:
+			continue
+		case bool:
+			if !v {
+				continue
+			}
+		case float64:
+			if v == 0 {
+				continue
+			}
+		case string:
+			if v == "" {
+				continue
+			}
+			return fmt.Errorf("error in response: %s", v)
+		case map[string]interface{}:
+			if len(v) == 0 {
+				continue
+			}
+		case []interface{}:
+			if len(v) == 0 {
+				continue
+			}
+		}
+		b, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("error in response: %s", b)
+	}
+	return nil
+}
+
+// Reads newline delimited json values from the stream until its end, or
+// until the read duration has elapsed if set, and returns them as a json
+// array. Lines which are not valid json, such as one cut off when the read
+// duration elapses, are skipped.
+func readNDJSONStream(logger *slog.Logger, body io.ReadCloser, readDuration time.Duration) ([]byte, error) {
+	elapsed, stop := closeAfter(body, readDuration)
+	defer stop()
+
+	values := []json.RawMessage{}
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if !json.Valid(line) {
+			logger.Debug("Skipping invalid json line from stream", "line", line)
+			continue
+		}
+		values = append(values, json.RawMessage(bytes.Clone(line)))
+	}
+	if err := scanner.Err(); err != nil && !elapsed.Load() {
+		return nil, err
+	}
+
+	return json.Marshal(values)
+}
+
+// Reads server-sent events from the stream until its end, or until the read
+// duration has elapsed if set, and returns their json data as a json array.
+// The data lines of an event are joined by newlines, as per the spec. Events
+// whose data is not valid json, and an event cut off when the read duration
+// elapses, are skipped.
+func readSSEStream(logger *slog.Logger, body io.ReadCloser, readDuration time.Duration) ([]byte, error) {
+	elapsed, stop := closeAfter(body, readDuration)
+	defer stop()
+
+	values := []json.RawMessage{}
+	var data [][]byte
+	dispatch := func() {
+		if data == nil {
+			return
+		}
+		event := bytes.Join(data, []byte("\n"))
+		data = nil
+		if !json.Valid(event) {
+			logger.Debug("Skipping invalid json event from stream", "data", event)
+			return
+		}
+		values = append(values, json.RawMessage(event))
+	}
+
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := bytes.TrimSuffix(scanner.Bytes(), []byte("\r"))
+		if len(line) == 0 {
+			dispatch()
+			continue
+		}
+		field, value, _ := bytes.Cut(line, []byte(":"))
+		if string(field) != "data" {
+			// Comments, and the other fields of the event
+			continue
+		}
+		data = append(data, bytes.Clone(bytes.TrimPrefix(value, []byte(" "))))
+	}
+	if err := scanner.Err(); err != nil && !elapsed.Load() {
+		return nil, err
 	}
 
-	data, err := io.ReadAll(resp.Body)
+	return json.Marshal(values)
+}
+
+// Reads a form encoded body as a flat json object. The values of repeated
+// keys are collected into an array.
+func readURLEncoded(body io.Reader) ([]byte, error) {
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	values, err := url.ParseQuery(strings.TrimSpace(string(content)))
 	if err != nil {
 		return nil, err
 	}
+	object := make(map[string]interface{}, len(values))
+	for key, v := range values {
+		if len(v) == 1 {
+			object[key] = v[0]
+		} else {
+			object[key] = v
+		}
+	}
+	return json.Marshal(object)
+}
+
+// Closes the body once the read duration has elapsed, if set. The returned
+// flag tells whether it has, and the returned function cancels the timer.
+func closeAfter(body io.Closer, readDuration time.Duration) (*atomic.Bool, func()) {
+	elapsed := new(atomic.Bool)
+	if readDuration <= 0 {
+		return elapsed, func() {}
+	}
+	timer := time.AfterFunc(readDuration, func() {
+		elapsed.Store(true)
+		body.Close()
+	})
+	return elapsed, func() { timer.Stop() }
+}
+
+// Returns the paths of all the object keys which appear more than once in
+// the same object. json.Unmarshal silently keeps the last value of duplicate
+// keys, so the document is walked token by token instead.
+func duplicateKeys(data []byte) ([]string, error) {
+	var dups []string
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if err := walkDuplicateKeys(dec, "$", &dups); err != nil {
+		return nil, err
+	}
+	return dups, nil
+}
+
+func walkDuplicateKeys(dec *json.Decoder, path string, dups *[]string) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return nil
+	}
+	switch delim {
+	case '{':
+		seen := make(map[string]bool)
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			key, ok := tok.(string)
+			if !ok {
+				return fmt.Errorf("unexpected object key %v at %s", tok, path)
+			}
+			if seen[key] {
+				*dups = append(*dups, path+"."+key)
+			}
+			seen[key] = true
+			if err := walkDuplicateKeys(dec, path+"."+key, dups); err != nil {
+				return err
+			}
+		}
+	case '[':
+		for i := 0; dec.More(); i++ {
+			if err := walkDuplicateKeys(dec, fmt.Sprintf("%s[%d]", path, i), dups); err != nil {
+				return err
+			}
+		}
+	}
+	// Consume the closing delimiter
+	_, err = dec.Token()
+	return err
+}
+
+// Returns the first rule whose host pattern matches either the host name or
+// the host and port of the endpoint, or nil if none does
+func matchTLSCertRule(rules []config.TLSCertRule, endpoint string) *config.TLSCertRule {
+	if len(rules) == 0 {
+		return nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil
+	}
+	for i, rule := range rules {
+		if matchHost(rule.Host, u) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// Returns the data to scrape in place of an empty response body, as per the
+// policy of the module. Skipped responses return no data at all.
+func emptyBody(policy config.EmptyBodyPolicy) ([]byte, error) {
+	switch policy {
+	case "":
+		// Reported when the metrics fail to be extracted
+		return []byte{}, nil
+	case config.EmptyBodyError:
+		return nil, errors.New("empty response body")
+	case config.EmptyBodySkip:
+		return nil, nil
+	case config.EmptyBodyEmptyObject:
+		return []byte("{}"), nil
+	default:
+		return nil, fmt.Errorf("Unknown empty body policy: '%s'", policy)
+	}
+}
+
+var jsonpRE = regexp.MustCompile(`(?s)^\s*(?:/\*\*/\s*)?[A-Za-z_$][\w$.]*\s*\((.*)\)\s*;?\s*$`)
+
+// Returns the json wrapped in a JSONP callback, such as 'callback({...});'
+func stripJSONP(data []byte) ([]byte, error) {
+	match := jsonpRE.FindSubmatch(data)
+	if match == nil {
+		return nil, errors.New("response is not wrapped in a JSONP callback")
+	}
+	if !json.Valid(match[1]) {
+		return nil, errors.New("JSONP callback argument is not valid JSON")
+	}
+	return match[1], nil
+}
+
+// The bare literals of the non finite numbers, as written by e.g. Jackson with
+// ALLOW_NON_NUMERIC_NUMBERS, longest first
+var nonFiniteLiterals = [][]byte{[]byte("-Infinity"), []byte("+Infinity"), []byte("Infinity"), []byte("NaN")}
+
+// Returns the json with its bare NaN and Infinity literals quoted, outside of
+// strings, so that it can be decoded. The quoted literals are then parsed as
+// the special floats by SanitizeValue.
+func quoteNonFiniteNumbers(data []byte) []byte {
+	var out []byte
+	last := 0
+	inString, escaped := false, false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+		if c == '"' {
+			inString = true
+			continue
+		}
+		for _, literal := range nonFiniteLiterals {
+			end := i + len(literal)
+			if !bytes.HasPrefix(data[i:], literal) || end < len(data) && isLiteralByte(data[end]) || i > 0 && isLiteralByte(data[i-1]) {
+				continue
+			}
+			out = append(out, data[last:i]...)
+			out = append(out, '"')
+			out = append(out, literal...)
+			out = append(out, '"')
+			last = end
+			i = end - 1
+			break
+		}
+	}
+	if out == nil {
+		return data
+	}
+	return append(out, data[last:]...)
+}
+
+func isLiteralByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.' || c == '+' || c == '-'
+}
+
+// Returns a redirect policy following at most max redirects, and reporting
+// the redirect chain once exceeded
+func checkRedirect(max int) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) <= max {
+			return nil
+		}
+		chain := make([]string, 0, len(via)+1)
+		for _, r := range via {
+			chain = append(chain, r.URL.Redacted())
+		}
+		chain = append(chain, req.URL.Redacted())
+		return fmt.Errorf("stopped after %d redirects: %s", max, strings.Join(chain, " -> "))
+	}
+}
+
+// Returns the errors of the auto module of the named module: its discriminator
+// path, its request path, and the modules it selects, which must exist and not
+// be auto modules themselves
+func validateAutoModule(c config.Config, name string, auto config.AutoModule) []error {
+	var errs []error
+	if err := jsonpath.New("jp").Parse(auto.Discriminator); err != nil {
+		errs = append(errs, fmt.Errorf("module %q: invalid auto_module discriminator %q: %w", name, auto.Discriminator, err))
+	}
+	if _, err := url.Parse(auto.Path); err != nil {
+		errs = append(errs, fmt.Errorf("module %q: invalid auto_module path: %w", name, err))
+	}
+	if len(auto.Modules) == 0 && auto.Default == "" {
+		errs = append(errs, fmt.Errorf("module %q: auto_module has no module to select", name))
+	}
+	_, selected := sortedLabels(auto.Modules)
+	for _, s := range append(selected, auto.Default) {
+		if s == "" {
+			continue
+		}
+		if m, ok := c.Modules[s]; !ok {
+			errs = append(errs, fmt.Errorf("module %q: auto_module selects unknown module %q", name, s))
+		} else if m.AutoModule.Discriminator != "" {
+			errs = append(errs, fmt.Errorf("module %q: auto_module selects auto module %q", name, s))
+		}
+	}
+	return errs
+}
+
+// SelectModule returns the name of the module the auto module maps the value at
+// its discriminator path in the data to
+func SelectModule(logger *slog.Logger, auto config.AutoModule, data []byte) (string, error) {
+	var jsonData interface{}
+	if err := unmarshalData(data, &jsonData); err != nil {
+		return "", err
+	}
+	value, err := extractValue(nil, logger, jsonData, auto.Discriminator, true)
+	if err != nil {
+		return "", err
+	}
+	value = strings.TrimSpace(value)
+	if name, ok := auto.Modules[value]; ok {
+		return name, nil
+	}
+	if auto.Default != "" {
+		return auto.Default, nil
+	}
+	return "", fmt.Errorf("no module for discriminator value %q", value)
+}
+
+// Returns the data transcoded to UTF-8 from the charset of the module, or else
+// from the charset of the content type of the response. Data without a
+// charset is expected to be UTF-8.
+func decodeCharset(data []byte, charset, contentType string) ([]byte, error) {
+	if charset == "" {
+		if _, params, err := mime.ParseMediaType(contentType); err == nil {
+			charset = params["charset"]
+		}
+	}
+	if charset == "" {
+		return data, nil
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset %q", charset)
+	}
+	if name, _ := htmlindex.Name(enc); name == "utf-8" {
+		return data, nil
+	}
+	// A byte order mark, which json does not allow, overrides the charset
+	decoded, _, err := transform.Bytes(unicode.BOMOverride(enc.NewDecoder()), data)
+	return decoded, err
+}
+
+// Checks that the media type of the Content-Type header of a response is the
+// required one, ignoring any parameter such as the charset
+func checkContentType(contentType, required string) error {
+	if contentType == "" {
+		return errors.New("missing content type")
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("invalid content type %q: %w", contentType, err)
+	}
+	if !strings.EqualFold(mediaType, required) {
+		return fmt.Errorf("unexpected content type: %s", mediaType)
+	}
+	return nil
+}
+
+// Reports whether the glob pattern matches either the host name or the host
+// and port of the url
+func matchHost(pattern string, u *url.URL) bool {
+	if ok, _ := path.Match(pattern, u.Hostname()); ok {
+		return true
+	}
+	ok, _ := path.Match(pattern, u.Host)
+	return ok
+}
+
+func matchTarget(match config.TargetMatch, u *url.URL) bool {
+	if match.Scheme != "" && !strings.EqualFold(match.Scheme, u.Scheme) {
+		return false
+	}
+	return match.Host == "" || matchHost(match.Host, u)
+}
 
-	return data, nil
+func tlsRenegotiationSupport(r config.TLSRenegotiation) (tls.RenegotiationSupport, error) {
+	switch r {
+	case "", config.TLSRenegotiateNever:
+		return tls.RenegotiateNever, nil
+	case config.TLSRenegotiateOnce:
+		return tls.RenegotiateOnceAsClient, nil
+	case config.TLSRenegotiateFreely:
+		return tls.RenegotiateFreelyAsClient, nil
+	default:
+		return tls.RenegotiateNever, fmt.Errorf("Unknown TLS renegotiation: '%s'", r)
+	}
 }
 
 // Use the configured template to render the body if enabled
 // Do not treat template errors as fatal, on such errors just log them
 // and continue with static body content
-func renderBody(logger *slog.Logger, body config.Body, tplValues url.Values) (method string, br io.Reader) {
+func renderBody(logger *slog.Logger, body config.Body, tplValues url.Values) (method, contentType string, br io.Reader) {
 	method = "POST"
+	if body.JSON != nil {
+		return method, "application/json", renderJSONBody(logger, body, tplValues)
+	}
 	if body.Content == "" {
-		return "GET", nil
+		return "GET", "", nil
 	}
 	br = strings.NewReader(body.Content)
 	if body.Templatize {
-		tpl, err := template.New("base").Funcs(sprig.TxtFuncMap()).Parse(body.Content)
+		tpl, err := template.New("base").Funcs(templateFuncs(body)).Parse(body.Content)
 		if err != nil {
 			logger.Error("Failed to create a new template from body content", "err", err, "content", body.Content)
 			return
@@ -243,3 +1686,159 @@ func renderBody(logger *slog.Logger, body config.Body, tplValues url.Values) (me
 	}
 	return
 }
+
+// Serializes the json of the body, with its strings rendered as templates if
+// enabled. A string failing to render is kept as is, as the static content.
+func renderJSONBody(logger *slog.Logger, body config.Body, tplValues url.Values) io.Reader {
+	render := func(s string) string {
+		if !body.Templatize || !strings.Contains(s, "{{") {
+			return s
+		}
+		tpl, err := template.New("base").Funcs(templateFuncs(body)).Option("missingkey=zero").Parse(s)
+		if err != nil {
+			logger.Error("Failed to create a new template from body json string", "err", err, "template", s)
+			return s
+		}
+		var b strings.Builder
+		if err := tpl.Execute(&b, tplValues); err != nil {
+			logger.Error("Failed to render template with values", "err", err, "template", s)
+			return s
+		}
+		return b.String()
+	}
+	b, err := json.Marshal(jsonBodyValue(body.JSON, render))
+	if err != nil {
+		logger.Error("Failed to serialize body json", "err", err)
+		return nil
+	}
+	return bytes.NewReader(b)
+}
+
+// Returns the json body of the module with its strings rendered. Its keys,
+// made strings when the config is loaded, are not rendered.
+func jsonBodyValue(value interface{}, render func(string) string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[key] = jsonBodyValue(value, render)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, value := range v {
+			s[i] = jsonBodyValue(value, render)
+		}
+		return s
+	case string:
+		return render(v)
+	}
+	return value
+}
+
+// PathTemplateValues returns the values available to the templated paths of a
+// probe: the first value of every query parameter, the target, and the host
+// name of the target as target_host.
+func PathTemplateValues(target string, query url.Values) map[string]string {
+	values := make(map[string]string, len(query)+2)
+	for key := range query {
+		values[key] = query.Get(key)
+	}
+	values["target"] = target
+	if u, err := url.Parse(target); err == nil {
+		values["target_host"] = u.Hostname()
+	}
+	return values
+}
+
+// RenderPaths returns the module with all the json paths of its metrics
+// rendered as templates with the given values, if templatize_paths is set.
+// Only the safe sprig functions are available to them.
+func RenderPaths(c config.Module, values map[string]string) (config.Module, error) {
+	if !c.TemplatizePaths {
+		return c, nil
+	}
+	funcs := pathTemplateFuncs()
+	render := func(path string) (string, error) {
+		if !strings.Contains(path, "{{") {
+			return path, nil
+		}
+		tpl, err := template.New("path").Funcs(funcs).Option("missingkey=zero").Parse(path)
+		if err != nil {
+			return "", err
+		}
+		var b strings.Builder
+		if err := tpl.Execute(&b, values); err != nil {
+			return "", err
+		}
+		return b.String(), nil
+	}
+	renderMap := func(paths map[string]string) (map[string]string, error) {
+		if paths == nil {
+			return nil, nil
+		}
+		rendered := make(map[string]string, len(paths))
+		for k, v := range paths {
+			var err error
+			if rendered[k], err = render(v); err != nil {
+				return nil, err
+			}
+		}
+		return rendered, nil
+	}
+
+	var err error
+	if c.BasePath, err = render(c.BasePath); err != nil {
+		return c, fmt.Errorf("%w, for base path", err)
+	}
+	metrics := make([]config.Metric, len(c.Metrics))
+	for i, metric := range c.Metrics {
+		for _, p := range []*string{&metric.Path, &metric.EpochTimestamp, &metric.ValueTypePath, &metric.Select.Max, &metric.Select.Min, &metric.Filter, &metric.Dynamic.Name, &metric.Dynamic.Value, &metric.Dynamic.Help, &metric.Dynamic.Type, &metric.Ratio.Numerator, &metric.Ratio.Denominator} {
+			if *p, err = render(*p); err != nil {
+				return c, fmt.Errorf("%w, for metric: '%s'", err, metric.Name)
+			}
+		}
+		for _, m := range []*map[string]string{&metric.Labels, &metric.Values, &metric.SiblingLabels} {
+			if *m, err = renderMap(*m); err != nil {
+				return c, fmt.Errorf("%w, for metric: '%s'", err, metric.Name)
+			}
+		}
+		metrics[i] = metric
+	}
+	c.Metrics = metrics
+	return c, nil
+}
+
+// Returns the functions of the path templates: the safe sprig functions, and
+// pathkey escaping the dots of a value used as a key, such as a host name.
+func pathTemplateFuncs() template.FuncMap {
+	funcs := templateFuncs(config.Body{SafeFunctions: true})
+	funcs["pathkey"] = func(key string) string {
+		return strings.ReplaceAll(key, ".", `\.`)
+	}
+	return funcs
+}
+
+// Sprig functions giving access to the environment of the exporter
+var unsafeTemplateFuncs = []string{"env", "expandenv", "getHostByName"}
+
+// Returns the functions available to the body template. All the sprig
+// functions are available unless restricted by the body configuration.
+func templateFuncs(body config.Body) template.FuncMap {
+	funcs := sprig.TxtFuncMap()
+	if len(body.AllowedFunctions) != 0 {
+		allowed := make(template.FuncMap, len(body.AllowedFunctions))
+		for _, name := range body.AllowedFunctions {
+			if fn, ok := funcs[name]; ok {
+				allowed[name] = fn
+			}
+		}
+		funcs = allowed
+	}
+	if body.SafeFunctions {
+		for _, name := range unsafeTemplateFuncs {
+			delete(funcs, name)
+		}
+	}
+	return funcs
+}
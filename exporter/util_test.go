@@ -14,8 +14,24 @@
 package exporter
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/prometheus-community/json_exporter/config"
+	pconfig "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/common/promslog"
 )
 
 func TestSanitizeValue(t *testing.T) {
@@ -35,6 +51,21 @@ func TestSanitizeValue(t *testing.T) {
 		{"[]", 0, false},
 		{"", 0, false},
 		{"''", 0, false},
+		{"Inf", math.Inf(1), true},
+		{"+Inf", math.Inf(1), true},
+		{"-Inf", math.Inf(-1), true},
+		{"Infinity", math.Inf(1), true},
+		{"-infinity", math.Inf(-1), true},
+		{"--Inf", 0, false},
+		{"Infinite", 0, false},
+		{"+5", 5.0, true},
+		{"  5 ", 5.0, true},
+		{"5\n", 5.0, true},
+		{"\t-1.5\r\n", -1.5, true},
+		{" true\n", 1.0, true},
+		{" -Inf ", math.Inf(-1), true},
+		{"5 6", 0, false},
+		{" \n", 0, false},
 	}
 
 	for i, test := range tests {
@@ -48,12 +79,942 @@ func TestSanitizeValue(t *testing.T) {
 	}
 }
 
+func TestSanitizeIntValue(t *testing.T) {
+	tests := []struct {
+		Input          string
+		ExpectedOutput int64
+		ShouldSucceed  bool
+	}{
+		{"1700000000000", 1700000000000, true},
+		{"-1", -1, true},
+		{"1.7e+12", 1700000000000, true},
+		{"1700000000000.0", 1700000000000, true},
+		{"1700000000000.9", 1700000000000, true},
+		{"1.7000000001234e+12", 1700000000123, true},
+		{"1700000000123456789", 1700000000123456789, true},
+		{"abcd", 0, false},
+		{"", 0, false},
+		{"NaN", 0, false},
+		{"Inf", 0, false},
+		{"1e19", 0, false},
+	}
+
+	for i, test := range tests {
+		actualOutput, err := SanitizeIntValue(test.Input)
+		if err != nil && test.ShouldSucceed {
+			t.Fatalf("Int value sanitization test %d failed with an unexpected error.\nINPUT:\n%q\nERR:\n%s", i, test.Input, err)
+		}
+		if err == nil && !test.ShouldSucceed {
+			t.Fatalf("Int value sanitization test %d succeeded unexpectedly.\nINPUT:\n%q", i, test.Input)
+		}
+		if test.ShouldSucceed && actualOutput != test.ExpectedOutput {
+			t.Fatalf("Int value sanitization test %d fails unexpectedly.\nGOT:\n%d\nEXPECTED:\n%d", i, actualOutput, test.ExpectedOutput)
+		}
+	}
+}
+
 func TestSanitizeValueNaN(t *testing.T) {
-	actualOutput, err := SanitizeValue("<nil>")
+	for _, input := range []string{"<nil>", "NaN", "nan", "-NaN", "+nan", " NaN\n"} {
+		actualOutput, err := SanitizeValue(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !math.IsNaN(actualOutput) {
+			t.Fatalf("Value sanitization test for %q fails unexpectedly, got %f", input, actualOutput)
+		}
+	}
+}
+
+func TestDuplicateKeys(t *testing.T) {
+	tests := []struct {
+		Input          string
+		ExpectedOutput []string
+		ShouldSucceed  bool
+	}{
+		{`{"a": 1, "b": 2}`, nil, true},
+		{`{"a": 1, "a": 2}`, []string{"$.a"}, true},
+		{`{"a": {"b": 1, "b": 2}, "c": [{"d": 1}, {"d": 1, "d": 2}]}`, []string{"$.a.b", "$.c[1].d"}, true},
+		{`[{"a": 1}, {"a": 2}]`, nil, true},
+		{`{"a": 1`, nil, false},
+		{``, nil, false},
+	}
+
+	for i, test := range tests {
+		actualOutput, err := duplicateKeys([]byte(test.Input))
+		if err != nil && test.ShouldSucceed {
+			t.Fatalf("Duplicate keys test %d failed with an unexpected error.\nINPUT:\n%q\nERR:\n%s", i, test.Input, err)
+		}
+		if err == nil && !test.ShouldSucceed {
+			t.Fatalf("Duplicate keys test %d succeeded unexpectedly.\nINPUT:\n%q", i, test.Input)
+		}
+		if test.ShouldSucceed && !reflect.DeepEqual(actualOutput, test.ExpectedOutput) {
+			t.Fatalf("Duplicate keys test %d fails unexpectedly.\nGOT:\n%v\nEXPECTED:\n%v", i, actualOutput, test.ExpectedOutput)
+		}
+	}
+}
+
+func TestMetricNamePrefix(t *testing.T) {
+	metrics := []config.Metric{
+		{Name: "requests", Path: "{.requests}", Type: config.ValueScrape},
+		{Name: "server", Path: "{.servers[*]}", Type: config.ObjectScrape, Values: map[string]string{"connections": "{.connections}"}},
+	}
+	tests := []struct {
+		Global         string
+		Namespace      string
+		Subsystem      string
+		Prefix         string
+		ExpectedOutput []string
+		ShouldSucceed  bool
+	}{
+		{"", "", "", "", []string{"requests", "server_connections"}, true},
+		{"", "", "", "backend", []string{"backend_requests", "backend_server_connections"}, true},
+		{"", "", "", "my-backend", nil, false},
+		{"", "", "", "1backend", nil, false},
+		{"", "acme", "", "", []string{"acme_requests", "acme_server_connections"}, true},
+		{"", "acme", "proxy", "", []string{"acme_proxy_requests", "acme_proxy_server_connections"}, true},
+		{"", "", "proxy", "", []string{"proxy_requests", "proxy_server_connections"}, true},
+		{"", "acme", "proxy", "backend", []string{"acme_proxy_backend_requests", "acme_proxy_backend_server_connections"}, true},
+		{"", "1acme", "proxy", "", nil, false},
+		{"", "acme", "my-proxy", "", nil, false},
+		{"corp", "", "", "", []string{"corp_requests", "corp_server_connections"}, true},
+		{"corp", "acme", "proxy", "backend", []string{"corp_acme_proxy_backend_requests", "corp_acme_proxy_backend_server_connections"}, true},
+		{"my-corp", "", "", "", nil, false},
+	}
+
+	for i, test := range tests {
+		jsonMetrics, err := CreateMetricsList(config.Module{Namespace: test.Namespace, Subsystem: test.Subsystem, MetricNamePrefix: test.Prefix, Metrics: metrics}, test.Global, nil)
+		if err != nil && test.ShouldSucceed {
+			t.Fatalf("Metric name prefix test %d failed with an unexpected error: %s", i, err)
+		}
+		if err == nil && !test.ShouldSucceed {
+			t.Fatalf("Metric name prefix test %d succeeded unexpectedly", i)
+		}
+		var names []string
+		for _, m := range jsonMetrics {
+			names = append(names, m.Name)
+		}
+		sort.Strings(names)
+		if test.ShouldSucceed && !reflect.DeepEqual(names, test.ExpectedOutput) {
+			t.Fatalf("Metric name prefix test %d fails unexpectedly.\nGOT:\n%v\nEXPECTED:\n%v", i, names, test.ExpectedOutput)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	c := config.Config{
+		Modules: map[string]config.Module{
+			"good": {
+				Metrics: []config.Metric{
+					{Name: "value", Path: "{.counter}", Type: config.ValueScrape, Labels: map[string]string{"environment": "beta", "location": "planet-{.location}"}},
+				},
+			},
+			"bad": {
+				Metrics: []config.Metric{
+					{Name: "unclosed", Path: "{.counter", Type: config.ValueScrape},
+					{Name: "object", Path: "{.values[*]}", Type: config.ObjectScrape, Labels: map[string]string{"id": "{.id"}, Values: map[string]string{"count": "{.count}", "active": "{.active"}},
+					{Name: "unknown", Path: "{.counter}", Type: "unknown"},
+				},
+			},
+			"base": {
+				BasePath: "{.data.result}",
+				Metrics: []config.Metric{
+					{Name: "value", Path: "{.counter}", Type: config.ValueScrape},
+					{Name: "unclosed", Path: "{.values[0}", Type: config.ValueScrape},
+				},
+			},
+		},
+	}
+
+	errs := ValidateConfig(c, "")
+	expected := []string{
+		`module "bad": Unknown metric type`,
+		`module "bad", metric "unclosed": invalid json path "{.counter"`,
+		`module "bad", metric "object": invalid json path "{.id"`,
+		`module "bad", metric "object": invalid json path "{.active"`,
+		`module "base", metric "unclosed": invalid json path "{.data.result.values[0}"`,
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("Validate config test fails unexpectedly, expected %d errors, got %d: %v", len(expected), len(errs), errs)
+	}
+	for _, e := range expected {
+		found := false
+		for _, err := range errs {
+			if strings.Contains(err.Error(), e) {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("Validate config test fails unexpectedly, expected an error containing %q, got: %v", e, errs)
+		}
+	}
+}
+
+func TestJoinBasePath(t *testing.T) {
+	tests := []struct {
+		Base           string
+		Path           string
+		ExpectedOutput string
+		ShouldSucceed  bool
+	}{
+		{"{.data.result}", "{.value}", "{.data.result.value}", true},
+		{"{ .data.result }", "{ .items[*].value }", "{.data.result.items[*].value}", true},
+		{"{.data.result}", "{[0].value}", "{.data.result[0].value}", true},
+		{"{.data.result}", "{value}", "{.data.result.value}", true},
+		{"{.data.result}", "{..used}", "{.data.result..used}", true},
+		{"{.data.result}", "{$.status}", "{$.status}", true},
+		{"{.data.result}", "", "", true},
+		{"{.data.result}", "planet-{.location}", "", false},
+		{".data.result", "{.value}", "", false},
+	}
+
+	for i, test := range tests {
+		actualOutput, err := joinBasePath(test.Base, test.Path)
+		if err != nil && test.ShouldSucceed {
+			t.Fatalf("Base path test %d failed with an unexpected error: %s", i, err)
+		}
+		if err == nil && !test.ShouldSucceed {
+			t.Fatalf("Base path test %d succeeded unexpectedly", i)
+		}
+		if actualOutput != test.ExpectedOutput {
+			t.Fatalf("Base path test %d fails unexpectedly.\nGOT:\n%s\nEXPECTED:\n%s", i, actualOutput, test.ExpectedOutput)
+		}
+	}
+}
+
+func TestSplitLastField(t *testing.T) {
+	tests := []struct {
+		Input          string
+		ExpectedParent string
+		ExpectedField  string
+		ShouldSucceed  bool
+	}{
+		{"{.disks[*].used}", "{.disks[*]}", "used", true},
+		{"{ .disks[?(@.mount == \"/\")].used_bytes }", "{.disks[?(@.mount == \"/\")]}", "used_bytes", true},
+		{"{.counter}", "", "", false},
+		{"{.disks[*]}", "", "", false},
+		{"{.disks[*]['used']}", "", "", false},
+	}
+
+	for i, test := range tests {
+		parent, field, ok := splitLastField(test.Input)
+		if ok != test.ShouldSucceed {
+			t.Fatalf("Split last field test %d fails unexpectedly, expected success: %t", i, test.ShouldSucceed)
+		}
+		if parent != test.ExpectedParent || field != test.ExpectedField {
+			t.Fatalf("Split last field test %d fails unexpectedly.\nGOT:\n%s %s\nEXPECTED:\n%s %s", i, parent, field, test.ExpectedParent, test.ExpectedField)
+		}
+	}
+}
+
+func TestCheckContentType(t *testing.T) {
+	tests := []struct {
+		ContentType   string
+		Required      string
+		ShouldSucceed bool
+	}{
+		{"application/json", "application/json", true},
+		{"application/json; charset=utf-8", "application/json", true},
+		{"Application/JSON", "application/json", true},
+		{"text/html; charset=utf-8", "application/json", false},
+		{"", "application/json", false},
+		{"application/", "application/json", false},
+	}
+
+	for i, test := range tests {
+		err := checkContentType(test.ContentType, test.Required)
+		if (err == nil) != test.ShouldSucceed {
+			t.Fatalf("Content type test %d fails unexpectedly, expected success: %t, got error: %v", i, test.ShouldSucceed, err)
+		}
+	}
+}
+
+func TestStaticLabelsConflict(t *testing.T) {
+	module := config.Module{
+		Metrics: []config.Metric{
+			{
+				Name:         "requests",
+				Path:         "{.requests}",
+				Type:         config.ValueScrape,
+				Labels:       map[string]string{"env": "{.env}"},
+				StaticLabels: map[string]string{"env": "prod"},
+			},
+		},
+	}
+	if _, err := CreateMetricsList(module, "", nil); err == nil {
+		t.Fatal("Static labels conflicting with labels are accepted unexpectedly")
+	}
+}
+
+func TestJoinLabelsUnknownLabel(t *testing.T) {
+	module := config.Module{
+		Metrics: []config.Metric{
+			{
+				Name:       "requests",
+				Path:       "{.requests}",
+				Type:       config.ValueScrape,
+				Labels:     map[string]string{"env": "{.env}"},
+				JoinLabels: map[string]string{"tags": ","},
+			},
+		},
+	}
+	if _, err := CreateMetricsList(module, "", nil); err == nil {
+		t.Fatal("Join labels not in labels are accepted unexpectedly")
+	}
+}
+
+func TestHashLabelsValidation(t *testing.T) {
+	tests := []struct {
+		HashLabels    map[string]config.LabelHash
+		ShouldSucceed bool
+	}{
+		{map[string]config.LabelHash{"account": {Hash: "sha256"}}, true},
+		{map[string]config.LabelHash{"account": {Hash: "sha256", Length: 64}}, true},
+		{map[string]config.LabelHash{"tenant": {Hash: "sha256"}}, false},
+		{map[string]config.LabelHash{"account": {Hash: "md5"}}, false},
+		{map[string]config.LabelHash{"account": {Hash: "sha256", Length: 65}}, false},
+		{map[string]config.LabelHash{"account": {Hash: "sha256", Length: -1}}, false},
+	}
+
+	for i, test := range tests {
+		module := config.Module{
+			Metrics: []config.Metric{
+				{Name: "requests", Path: "{.requests}", Type: config.ValueScrape, Labels: map[string]string{"account": "{.account}"}, HashLabels: test.HashLabels},
+			},
+		}
+		_, err := CreateMetricsList(module, "", nil)
+		if err != nil && test.ShouldSucceed {
+			t.Fatalf("Hash labels test %d failed with an unexpected error: %s", i, err)
+		}
+		if err == nil && !test.ShouldSucceed {
+			t.Fatalf("Hash labels test %d succeeded unexpectedly", i)
+		}
+	}
+}
+
+func TestInvert(t *testing.T) {
+	tests := []struct {
+		Input          string
+		ExpectedOutput float64
+		ShouldSucceed  bool
+	}{
+		{"false", 1, true},
+		{"True", 0, true},
+		{"0", 1, true},
+		{"1", 0, true},
+		{"2", 0, false},
+		{"down", 0, false},
+	}
+
+	m := JSONMetric{Invert: true}
+	for i, test := range tests {
+		actualOutput, err := m.parseValue(test.Input)
+		if err != nil && test.ShouldSucceed {
+			t.Fatalf("Value inversion test %d (%s) failed with an unexpected error: %s", i, test.Input, err)
+		}
+		if err == nil && !test.ShouldSucceed {
+			t.Fatalf("Value inversion test %d (%s) succeeded unexpectedly", i, test.Input)
+		}
+		if test.ShouldSucceed && actualOutput != test.ExpectedOutput {
+			t.Fatalf("Value inversion test %d (%s) fails unexpectedly.\nGOT:\n%f\nEXPECTED:\n%f", i, test.Input, actualOutput, test.ExpectedOutput)
+		}
+	}
+}
+
+func TestReadURLEncoded(t *testing.T) {
+	tests := []struct {
+		Input          string
+		ExpectedOutput string
+		ShouldSucceed  bool
+	}{
+		{"status=ok&count=42&latency=5\n", `{"count":"42","latency":"5","status":"ok"}`, true},
+		{"node=a&node=b&msg=hello+world%21", `{"msg":"hello world!","node":["a","b"]}`, true},
+		{"", `{}`, true},
+		{"count=%zz", "", false},
+	}
+
+	for i, test := range tests {
+		data, err := readURLEncoded(strings.NewReader(test.Input))
+		if err != nil && test.ShouldSucceed {
+			t.Fatalf("URL encoded test %d failed with an unexpected error: %s", i, err)
+		}
+		if err == nil && !test.ShouldSucceed {
+			t.Fatalf("URL encoded test %d succeeded unexpectedly", i)
+		}
+		if test.ShouldSucceed && string(data) != test.ExpectedOutput {
+			t.Fatalf("URL encoded test %d fails unexpectedly.\nGOT:\n%s\nEXPECTED:\n%s", i, data, test.ExpectedOutput)
+		}
+	}
+}
+
+func TestRecursiveDescent(t *testing.T) {
+	tests := []struct {
+		Metric        config.Metric
+		ShouldSucceed bool
+	}{
+		{config.Metric{Name: "used", Path: "{.disks[*].used}", Type: config.ValueScrape, Multi: true}, true},
+		{config.Metric{Name: "used", Path: "{..used}", Type: config.ValueScrape, Multi: true}, false},
+		{config.Metric{Name: "used", Path: "{..used}", Type: config.ValueScrape, Multi: true, AllowRecursiveDescent: true}, true},
+		{config.Metric{Name: "disk", Path: "{.disks[?(@..mount == \"/\")]}", Type: config.ObjectScrape, Values: map[string]string{"used": "{.used}"}}, false},
+		{config.Metric{Name: "disk", Path: "{.disks[*]}", Type: config.ObjectScrape, Labels: map[string]string{"mount": "{..mount}"}, Values: map[string]string{"used": "{.used}"}}, false},
+		{config.Metric{Name: "disk", Path: "{.disks[*]}", Type: config.ObjectScrape, Values: map[string]string{"used": "{..used}"}}, false},
+	}
+
+	for i, test := range tests {
+		_, err := CreateMetricsList(config.Module{Metrics: []config.Metric{test.Metric}}, "", nil)
+		if err != nil && test.ShouldSucceed {
+			t.Fatalf("Recursive descent test %d failed with an unexpected error: %s", i, err)
+		}
+		if err == nil && !test.ShouldSucceed {
+			t.Fatalf("Recursive descent test %d succeeded unexpectedly", i)
+		}
+	}
+}
+
+func TestEmitOnFailureUnknownMetric(t *testing.T) {
+	module := config.Module{
+		EmitOnFailure: map[string]float64{"service_down": 0},
+		Metrics: []config.Metric{
+			{Name: "service_up", Path: "{.up}", Type: config.ValueScrape},
+		},
+	}
+	if _, err := CreateMetricsList(module, "", nil); err == nil {
+		t.Fatal("Unknown metric in emit_on_failure is accepted unexpectedly")
+	}
+}
+
+func TestStripJSONP(t *testing.T) {
+	tests := []struct {
+		Input          string
+		ExpectedOutput string
+		ShouldSucceed  bool
+	}{
+		{`callback({"count": 1});`, `{"count": 1}`, true},
+		{"  jQuery.cb_12 ( [1, 2] ) \n", ` [1, 2] `, true},
+		{`/**/ $cb({"count": 1})`, `{"count": 1}`, true},
+		{`{"count": 1}`, "", false},
+		{`callback({"count": 1}`, "", false},
+		{`callback({"count": );`, "", false},
+		{`alert(1); callback({"count": 1});`, "", false},
+	}
+
+	for i, test := range tests {
+		data, err := stripJSONP([]byte(test.Input))
+		if err != nil && test.ShouldSucceed {
+			t.Fatalf("JSONP test %d failed with an unexpected error: %s", i, err)
+		}
+		if err == nil && !test.ShouldSucceed {
+			t.Fatalf("JSONP test %d succeeded unexpectedly", i)
+		}
+		if test.ShouldSucceed && string(data) != test.ExpectedOutput {
+			t.Fatalf("JSONP test %d fails unexpectedly.\nGOT:\n%s\nEXPECTED:\n%s", i, data, test.ExpectedOutput)
+		}
+	}
+}
+
+func TestUnmarshalData(t *testing.T) {
+	tests := []struct {
+		Input          string
+		ExpectedOutput interface{}
+		ShouldSucceed  bool
+	}{
+		{`{"a": 1, "b": 1.5, "c": -2e3}`, map[string]interface{}{"a": 1.0, "b": 1.5, "c": -2000.0}, true},
+		{`[9007199254740991, 9007199254740993, -18446744073709551615]`, []interface{}{9007199254740991.0, json.Number("9007199254740993"), json.Number("-18446744073709551615")}, true},
+		{`{"a": [{"b": 1700000000123456789}]}`, map[string]interface{}{"a": []interface{}{map[string]interface{}{"b": json.Number("1700000000123456789")}}}, true},
+		{`{"a": 1e300, "b": 12345678901234567890.5}`, map[string]interface{}{"a": 1e300, "b": 12345678901234567890.5}, true},
+		{` "a" `, "a", true},
+		{``, nil, false},
+		{`{"a": 1} x`, nil, false},
+		{`{"a": }`, nil, false},
+	}
+
+	for i, test := range tests {
+		var data interface{}
+		err := unmarshalData([]byte(test.Input), &data)
+		if err != nil && test.ShouldSucceed {
+			t.Fatalf("Unmarshal data test %d failed with an unexpected error: %s", i, err)
+		}
+		if err == nil && !test.ShouldSucceed {
+			t.Fatalf("Unmarshal data test %d succeeded unexpectedly", i)
+		}
+		if test.ShouldSucceed && !reflect.DeepEqual(data, test.ExpectedOutput) {
+			t.Fatalf("Unmarshal data test %d fails unexpectedly.\nGOT:\n%#v\nEXPECTED:\n%#v", i, data, test.ExpectedOutput)
+		}
+	}
+}
+
+func TestResponseError(t *testing.T) {
+	tests := []struct {
+		Input         string
+		ExpectedError string
+	}{
+		{`{"value": 1}`, ""},
+		{`{"error": null}`, ""},
+		{`{"error": ""}`, ""},
+		{`{"error": false}`, ""},
+		{`{"error": {}}`, ""},
+		{`{"error": []}`, ""},
+		{`not json`, ""},
+		{`{"error": "rate limited"}`, "error in response: rate limited"},
+		{`{"error": {"code": 429}}`, `error in response: {"code":429}`},
+		{`{"error": true}`, "error in response: true"},
+		{`{"error": 0}`, ""},
+		{`{"error": 429}`, "error in response: 429"},
+	}
+
+	for i, test := range tests {
+		err := responseError(promslog.NewNopLogger(), []byte(test.Input), "{.error}")
+		if test.ExpectedError == "" && err != nil {
+			t.Fatalf("Response error test %d failed with an unexpected error: %s", i, err)
+		}
+		if test.ExpectedError != "" && (err == nil || err.Error() != test.ExpectedError) {
+			t.Fatalf("Response error test %d fails unexpectedly.\nGOT:\n%v\nEXPECTED:\n%s", i, err, test.ExpectedError)
+		}
+	}
+}
+
+func TestQuoteNonFiniteNumbers(t *testing.T) {
+	tests := []struct {
+		Input          string
+		ExpectedOutput string
+	}{
+		{`{"a": NaN, "b": Infinity, "c": -Infinity, "d": +Infinity}`, `{"a": "NaN", "b": "Infinity", "c": "-Infinity", "d": "+Infinity"}`},
+		{`[NaN,1,-Infinity]`, `["NaN",1,"-Infinity"]`},
+		{`{"NaN": "Infinity", "s": "a \" NaN"}`, `{"NaN": "Infinity", "s": "a \" NaN"}`},
+		{`{"a": 1.5e3, "b": null, "c": true}`, `{"a": 1.5e3, "b": null, "c": true}`},
+		{`{"a": NaNa, "b": xInfinity}`, `{"a": NaNa, "b": xInfinity}`},
+	}
+
+	for i, test := range tests {
+		data := quoteNonFiniteNumbers([]byte(test.Input))
+		if string(data) != test.ExpectedOutput {
+			t.Fatalf("Non finite numbers test %d fails unexpectedly.\nGOT:\n%s\nEXPECTED:\n%s", i, data, test.ExpectedOutput)
+		}
+	}
+}
+
+func TestNormalizeSubscripts(t *testing.T) {
+	tests := []struct {
+		Input          string
+		ExpectedOutput string
+	}{
+		{"{[0]}", "{[0]}"},
+		{"{.[0]}", "{[0]}"},
+		{"{$.[0].name}", "{$[0].name}"},
+		{"{.items.[*].value}", "{.items[*].value}"},
+		{"{..[0]}", "{..[0]}"},
+		{`{[?(@.name == "a.[b")].value}`, `{[?(@.name == "a.[b")].value}`},
+		{`{.['a.[b'].[0]}`, `{['a.[b'][0]}`},
+	}
+
+	for i, test := range tests {
+		if output := normalizeSubscripts(test.Input); output != test.ExpectedOutput {
+			t.Fatalf("Normalize subscripts test %d fails unexpectedly.\nGOT:\n%s\nEXPECTED:\n%s", i, output, test.ExpectedOutput)
+		}
+	}
+}
+
+func TestLabelCaseValidation(t *testing.T) {
+	tests := []struct {
+		LabelCase     map[string]config.LabelCase
+		ShouldSucceed bool
+	}{
+		{map[string]config.LabelCase{"env": config.LabelCaseLower}, true},
+		{map[string]config.LabelCase{"env": config.LabelCaseUpper}, true},
+		{map[string]config.LabelCase{"region": config.LabelCaseLower}, false},
+		{map[string]config.LabelCase{"env": "title"}, false},
+	}
+
+	for i, test := range tests {
+		module := config.Module{
+			Metrics: []config.Metric{
+				{Name: "requests", Path: "{.requests}", Type: config.ValueScrape, Labels: map[string]string{"env": "{.env}"}, LabelCase: test.LabelCase},
+			},
+		}
+		_, err := CreateMetricsList(module, "", nil)
+		if err != nil && test.ShouldSucceed {
+			t.Fatalf("Label case test %d failed with an unexpected error: %s", i, err)
+		}
+		if err == nil && !test.ShouldSucceed {
+			t.Fatalf("Label case test %d succeeded unexpectedly", i)
+		}
+	}
+}
+
+func TestMatchValidation(t *testing.T) {
+	tests := []struct {
+		Metric        config.Metric
+		ShouldSucceed bool
+	}{
+		{config.Metric{Name: "v", Path: "{.v[*]}", Type: config.ValueScrape, Match: config.MatchFirst}, true},
+		{config.Metric{Name: "v", Path: "{.v[*]}", Type: config.ValueScrape, Match: config.MatchLast}, true},
+		{config.Metric{Name: "v", Path: "{.v[*]}", Type: config.ValueScrape, Match: "any"}, false},
+		{config.Metric{Name: "v", Path: "{.v[*]}", Type: config.ValueScrape, Match: config.MatchLast, Multi: true}, false},
+		{config.Metric{Name: "v", Type: config.ValueScrape, Match: config.MatchLast, StatusCode: true}, false},
+		{config.Metric{Name: "v", Path: "{.v[*]}", Type: config.ObjectScrape, Match: config.MatchFirst, Values: map[string]string{"a": "{.a}"}}, false},
+	}
+
+	for i, test := range tests {
+		_, err := CreateMetricsList(config.Module{Metrics: []config.Metric{test.Metric}}, "", nil)
+		if err != nil && test.ShouldSucceed {
+			t.Fatalf("Match test %d failed with an unexpected error: %s", i, err)
+		}
+		if err == nil && !test.ShouldSucceed {
+			t.Fatalf("Match test %d succeeded unexpectedly", i)
+		}
+	}
+}
+
+func TestKeyCountValidation(t *testing.T) {
+	tests := []struct {
+		Metric        config.Metric
+		ShouldSucceed bool
+	}{
+		{config.Metric{Name: "v", Path: "{.queues}", Type: config.KeyCountScrape, KeyPattern: "^queue_"}, true},
+		{config.Metric{Name: "v", Type: config.KeyCountScrape}, true},
+		{config.Metric{Name: "v", Path: "{.queues}", Type: config.KeyCountScrape, KeyPattern: "^queue_("}, false},
+		{config.Metric{Name: "v", Path: "{.v}", Type: config.ValueScrape, KeyPattern: "^queue_"}, false},
+	}
+
+	for i, test := range tests {
+		_, err := CreateMetricsList(config.Module{Metrics: []config.Metric{test.Metric}}, "", nil)
+		if err != nil && test.ShouldSucceed {
+			t.Fatalf("Key count test %d failed with an unexpected error: %s", i, err)
+		}
+		if err == nil && !test.ShouldSucceed {
+			t.Fatalf("Key count test %d succeeded unexpectedly", i)
+		}
+	}
+}
+
+func TestScaleValidation(t *testing.T) {
+	milli, zero := 0.001, 0.0
+	tests := []struct {
+		Metric        config.Metric
+		ShouldSucceed bool
+	}{
+		{config.Metric{Name: "v", Path: "{.v}", Type: config.ValueScrape, Scale: &milli}, true},
+		{config.Metric{Name: "v", Path: "{.v}", Type: config.ValueScrape, Offset: -273.15}, true},
+		{config.Metric{Name: "v", Path: "{.v[*]}", Type: config.ObjectScrape, Scale: &milli, Values: map[string]string{"a": "{.a}"}}, true},
+		{config.Metric{Name: "v", Path: "{.v}", Type: config.ValueScrape, Scale: &zero}, false},
+		{config.Metric{Name: "v", Type: config.ValueScrape, Scale: &milli, StatusCode: true}, false},
+		{config.Metric{Name: "v", Type: config.RatioScrape, Scale: &milli, Ratio: config.Ratio{Numerator: "{.a}", Denominator: "{.b}"}}, false},
+	}
+
+	for i, test := range tests {
+		_, err := CreateMetricsList(config.Module{Metrics: []config.Metric{test.Metric}}, "", nil)
+		if err != nil && test.ShouldSucceed {
+			t.Fatalf("Scale test %d failed with an unexpected error: %s", i, err)
+		}
+		if err == nil && !test.ShouldSucceed {
+			t.Fatalf("Scale test %d succeeded unexpectedly", i)
+		}
+	}
+}
+
+func TestCELValidation(t *testing.T) {
+	tests := []struct {
+		Metric        config.Metric
+		ShouldSucceed bool
+	}{
+		{config.Metric{Name: "v", Path: "data.v * 2", Type: config.ValueScrape, Engine: config.EngineTypeCEL, Labels: map[string]string{"l": "data.l"}}, true},
+		{config.Metric{Name: "v", Path: "data.v *", Type: config.ValueScrape, Engine: config.EngineTypeCEL}, false},
+		{config.Metric{Name: "v", Path: "data.v", Type: config.ValueScrape, Engine: config.EngineTypeCEL, Labels: map[string]string{"l": "data.l +"}}, false},
+		{config.Metric{Name: "v", Path: "data.v", Type: config.ValueScrape, Engine: config.EngineTypeCEL, Multi: true}, false},
+		{config.Metric{Name: "v", Path: "data.v", Type: config.ValueScrape, Engine: config.EngineTypeCEL, EpochTimestamp: "data.t"}, false},
+		{config.Metric{Name: "v", Path: "data.v", Type: config.ObjectScrape, Engine: config.EngineTypeCEL, Values: map[string]string{"a": "data.a"}}, false},
+		{config.Metric{Name: "v", Path: "{.v}", Type: config.ValueScrape, Engine: "lua"}, false},
+	}
+
+	for i, test := range tests {
+		_, err := CreateMetricsList(config.Module{Metrics: []config.Metric{test.Metric}}, "", nil)
+		if err != nil && test.ShouldSucceed {
+			t.Fatalf("CEL test %d failed with an unexpected error: %s", i, err)
+		}
+		if err == nil && !test.ShouldSucceed {
+			t.Fatalf("CEL test %d succeeded unexpectedly", i)
+		}
+	}
+
+	errs := ValidateConfig(config.Config{Modules: map[string]config.Module{"default": {Metrics: []config.Metric{tests[1].Metric}}}}, "")
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "Invalid CEL expression 'data.v *'") {
+		t.Fatalf("CEL test fails unexpectedly, expected the compile error, got %v", errs)
+	}
+}
+
+func TestCELCache(t *testing.T) {
+	module := config.Module{Metrics: []config.Metric{{Name: "v", Path: "data.v", Type: config.ValueScrape, Engine: config.EngineTypeCEL}}}
+	paths := &JSONPaths{}
+	first, err := CreateMetricsList(module, "", paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := CreateMetricsList(module, "", paths)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !math.IsNaN(actualOutput) {
-		t.Fatalf("Value sanitization test for %f fails unexpectedly.", math.NaN())
+	if first[0].CELProgram != second[0].CELProgram {
+		t.Fatalf("CEL cache test fails unexpectedly, the expression was compiled twice")
+	}
+}
+
+func TestEmitUpdateTimestampValidation(t *testing.T) {
+	tests := []struct {
+		Metric        config.Metric
+		ShouldSucceed bool
+	}{
+		{config.Metric{Name: "v", Path: "{.v}", Type: config.ValueScrape, EpochTimestamp: "{.t}", EmitUpdateTimestamp: true}, true},
+		{config.Metric{Name: "v", Path: "{.v[*]}", Type: config.ObjectScrape, EpochTimestamp: "{.t}", EmitUpdateTimestamp: true, Values: map[string]string{"a": "{.a}"}}, true},
+		{config.Metric{Name: "v", Path: "{.v}", Type: config.ValueScrape, EmitUpdateTimestamp: true}, false},
+		{config.Metric{Name: "v", Path: "{.v[*]}", Type: config.TimeseriesScrape, EpochTimestamp: "{.t}", EmitUpdateTimestamp: true, Values: map[string]string{"a": "{.a}"}}, false},
+	}
+
+	for i, test := range tests {
+		metrics, err := CreateMetricsList(config.Module{Metrics: []config.Metric{test.Metric}}, "", nil)
+		if err != nil && test.ShouldSucceed {
+			t.Fatalf("Update timestamp test %d failed with an unexpected error: %s", i, err)
+		}
+		if err == nil && !test.ShouldSucceed {
+			t.Fatalf("Update timestamp test %d succeeded unexpectedly", i)
+		}
+		if err == nil && metrics[0].UpdateTimestampDesc == nil {
+			t.Fatalf("Update timestamp test %d fails unexpectedly, no update timestamp gauge", i)
+		}
+	}
+}
+
+func TestCheckMonotonicValidation(t *testing.T) {
+	tests := []struct {
+		Metric        config.Metric
+		ShouldSucceed bool
+	}{
+		{config.Metric{Name: "v", Path: "{.v[*]}", Type: config.ValueScrape, ValueType: config.ValueTypeCounter, Multi: true, CheckMonotonic: true}, true},
+		{config.Metric{Name: "v", Path: "{.v[*]}", Type: config.ValueScrape, ValueType: config.ValueTypeGauge, Multi: true, CheckMonotonic: true}, false},
+		{config.Metric{Name: "v", Path: "{.v}", Type: config.ValueScrape, ValueType: config.ValueTypeCounter, CheckMonotonic: true}, false},
+		{config.Metric{Name: "v", Path: "{.v[*]}", Type: config.ObjectScrape, ValueType: config.ValueTypeCounter, CheckMonotonic: true, Values: map[string]string{"a": "{.a}"}}, false},
+	}
+
+	for i, test := range tests {
+		_, err := CreateMetricsList(config.Module{Metrics: []config.Metric{test.Metric}}, "", nil)
+		if err != nil && test.ShouldSucceed {
+			t.Fatalf("Check monotonic test %d failed with an unexpected error: %s", i, err)
+		}
+		if err == nil && !test.ShouldSucceed {
+			t.Fatalf("Check monotonic test %d succeeded unexpectedly", i)
+		}
+	}
+}
+
+func TestDecodeCharset(t *testing.T) {
+	tests := []struct {
+		Input          string
+		Charset        string
+		ContentType    string
+		ExpectedOutput string
+		ShouldSucceed  bool
+	}{
+		{"{\"name\": \"caf\xe9\"}", "", "application/json; charset=ISO-8859-1", `{"name": "café"}`, true},
+		{"{\"name\": \"caf\xe9\"}", "", "application/json; charset=windows-1252", `{"name": "café"}`, true},
+		{"\xff\xfe{\x00}\x00", "", "application/json; charset=utf-16", `{}`, true},
+		{"\x00{\x00}", "", "application/json; charset=UTF-16BE", `{}`, true},
+		{`{"name": "café"}`, "", "application/json; charset=utf-8", `{"name": "café"}`, true},
+		{`{"name": "café"}`, "", "application/json", `{"name": "café"}`, true},
+		{`{"name": "café"}`, "", "", `{"name": "café"}`, true},
+		{"{\"name\": \"caf\xe9\"}", "latin1", "application/json", `{"name": "café"}`, true},
+		{"{\"name\": \"caf\xe9\"}", "latin1", "application/json; charset=utf-8", `{"name": "café"}`, true},
+		{`{}`, "", "application/json; charset=ebcdic-fr", ``, false},
+	}
+
+	for i, test := range tests {
+		output, err := decodeCharset([]byte(test.Input), test.Charset, test.ContentType)
+		if err != nil && test.ShouldSucceed {
+			t.Fatalf("Decode charset test %d failed with an unexpected error: %s", i, err)
+		}
+		if err == nil && !test.ShouldSucceed {
+			t.Fatalf("Decode charset test %d succeeded unexpectedly", i)
+		}
+		if test.ShouldSucceed && string(output) != test.ExpectedOutput {
+			t.Fatalf("Decode charset test %d fails unexpectedly.\nGOT:\n%q\nEXPECTED:\n%q", i, output, test.ExpectedOutput)
+		}
+	}
+}
+
+func TestLabelOrder(t *testing.T) {
+	labels := map[string]string{"zone": "{.zone}", "app": "{.app}", "env": "{.env}", "host": "{.host}"}
+	module := config.Module{
+		Metrics: []config.Metric{
+			{Name: "value", Path: "{.value}", Type: config.ValueScrape, Labels: labels},
+			{Name: "object", Path: "{.items[*]}", Type: config.ObjectScrape, Labels: labels, Values: map[string]string{"v": "{.v}"}},
+			{Name: "multi", Path: "{.items[*].v}", Type: config.ValueScrape, Multi: true, IndexLabel: "index", SiblingLabels: map[string]string{"b": "{.b}", "a": "{.a}"}},
+		},
+	}
+	expected := [][]string{
+		{"{.app}", "{.env}", "{.host}", "{.zone}"},
+		{"{.app}", "{.env}", "{.host}", "{.zone}"},
+		{"{.a}", "{.b}"},
+	}
+
+	first, err := CreateMetricsList(module, "", nil)
+	if err != nil {
+		t.Fatalf("Failed to create metrics list: %s", err)
+	}
+	for i := 0; i < 10; i++ {
+		metrics, err := CreateMetricsList(module, "", nil)
+		if err != nil {
+			t.Fatalf("Failed to create metrics list: %s", err)
+		}
+		for j, m := range metrics {
+			if m.Desc.String() != first[j].Desc.String() {
+				t.Fatalf("Label order test fails unexpectedly, metric %d is described as %s, and before as %s", j, m.Desc, first[j].Desc)
+			}
+			paths := m.LabelsJSONPaths
+			if m.Multi {
+				paths = m.SiblingLabelsJSONPaths
+			}
+			if !reflect.DeepEqual(paths, expected[j]) {
+				t.Fatalf("Label order test fails unexpectedly, metric %d has label paths %v, expected %v", j, paths, expected[j])
+			}
+		}
+	}
+}
+
+func TestAutoModuleValidation(t *testing.T) {
+	v1 := config.Module{Metrics: []config.Metric{{Name: "count", Path: "{.count}", Type: config.ValueScrape}}}
+	tests := []struct {
+		AutoModule    config.Module
+		ShouldSucceed bool
+	}{
+		{config.Module{AutoModule: config.AutoModule{Discriminator: "{.version}", Modules: map[string]string{"1": "v1"}}}, true},
+		{config.Module{AutoModule: config.AutoModule{Discriminator: "{.version}", Path: "/version", Default: "v1"}}, true},
+		{config.Module{AutoModule: config.AutoModule{Discriminator: "{.version", Modules: map[string]string{"1": "v1"}}}, false},
+		{config.Module{AutoModule: config.AutoModule{Discriminator: "{.version}"}}, false},
+		{config.Module{AutoModule: config.AutoModule{Discriminator: "{.version}", Modules: map[string]string{"1": "v2"}}}, false},
+		{config.Module{AutoModule: config.AutoModule{Discriminator: "{.version}", Default: "auto"}}, false},
+		{config.Module{AutoModule: config.AutoModule{Modules: map[string]string{"1": "v1"}}}, false},
+		{config.Module{AutoModule: config.AutoModule{Discriminator: "{.version}", Default: "v1"}, Metrics: v1.Metrics}, false},
+	}
+
+	for i, test := range tests {
+		c := config.Config{Modules: map[string]config.Module{"v1": v1, "auto": test.AutoModule}}
+		errs := ValidateConfig(c, "")
+		if len(errs) != 0 && test.ShouldSucceed {
+			t.Fatalf("Auto module test %d failed with unexpected errors: %v", i, errs)
+		}
+		if len(errs) == 0 && !test.ShouldSucceed {
+			t.Fatalf("Auto module test %d succeeded unexpectedly", i)
+		}
+	}
+}
+
+func TestFetchKey(t *testing.T) {
+	module := func(password string) config.Module {
+		scale := 0.001
+		return config.Module{
+			HTTPClientConfig: pconfig.HTTPClientConfig{
+				BasicAuth: &pconfig.BasicAuth{Username: "user", Password: pconfig.Secret(password)},
+			},
+			Metrics: []config.Metric{{Name: "v", Path: "{.v}", Scale: &scale}},
+		}
+	}
+	key := func(m config.Module) string {
+		f := NewJSONFetcher(context.Background(), promslog.NewNopLogger(), m, nil)
+		k, err := f.fetchKey("http://example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	if key(module("secret")) != key(module("secret")) {
+		t.Fatal("Fetch key test fails unexpectedly, different keys for identical modules")
+	}
+	if key(module("secret")) == key(module("other")) {
+		t.Fatal("Fetch key test fails unexpectedly, same key for different passwords")
+	}
+}
+
+func TestSessionEviction(t *testing.T) {
+	var loginFails atomic.Bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		if loginFails.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "token"})
+	})
+	mux.HandleFunc("/expiring", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{}`)
+	})
+	mux.HandleFunc("/rejecting", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	target := httptest.NewServer(mux)
+	defer target.Close()
+
+	fetch := func(path string, ttl time.Duration) (string, error) {
+		m := config.Module{PreRequest: config.PreRequest{Path: "/login", SessionTTL: model.Duration(ttl)}}
+		f := NewJSONFetcher(context.Background(), promslog.NewNopLogger(), m, nil)
+		req, _ := http.NewRequest(http.MethodGet, target.URL+path, nil)
+		loginURL, _ := req.URL.Parse("/login")
+		key, err := f.sessionKey(loginURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := f.doInSession(http.DefaultClient, req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return key, err
+	}
+
+	key, err := fetch("/expiring", 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sessions.Load(key); !ok {
+		t.Fatal("Session eviction test fails unexpectedly, the session was not stored")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := sessions.Load(key); ok {
+		t.Fatal("Session eviction test fails unexpectedly, the expired session was kept")
+	}
+
+	// A rejected session is deleted, even when no new one can be opened
+	if key, err = fetch("/rejecting", 0); err != nil {
+		t.Fatal(err)
+	}
+	loginFails.Store(true)
+	if _, err := fetch("/rejecting", 0); err == nil {
+		t.Fatal("Session eviction test fails unexpectedly, the failed login was not reported")
+	}
+	if _, ok := sessions.Load(key); ok {
+		t.Fatal("Session eviction test fails unexpectedly, the rejected session was kept")
+	}
+}
+
+func TestSessionKey(t *testing.T) {
+	module := func(password string) config.Module {
+		return config.Module{
+			HTTPClientConfig: pconfig.HTTPClientConfig{
+				Authorization: &pconfig.Authorization{Type: "Bearer", Credentials: pconfig.Secret(password)},
+			},
+			PreRequest: config.PreRequest{Path: "/login"},
+		}
+	}
+	loginURL, _ := url.Parse("http://example.com/login")
+	key := func(m config.Module) string {
+		f := NewJSONFetcher(context.Background(), promslog.NewNopLogger(), m, nil)
+		k, err := f.sessionKey(loginURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	if key(module("secret")) != key(module("secret")) {
+		t.Fatal("Session key test fails unexpectedly, different keys for identical modules")
+	}
+	if key(module("secret")) == key(module("other")) {
+		t.Fatal("Session key test fails unexpectedly, same key for different credentials")
 	}
 }